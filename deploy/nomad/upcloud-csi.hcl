@@ -33,6 +33,7 @@ job "plugin-upcloud-csi" {
           "--username=${var.upcloud_username}",
           "--password=${var.upcloud_password}",
           "--log-level=info",
+          "--kubelet-dir=",
         ]
         privileged = true
       }
@@ -0,0 +1,14 @@
+// Package accessmode describes volume access modes shared by controller and node.
+package accessmode
+
+import "github.com/container-storage-interface/spec/lib/go/csi"
+
+// ReadOnly returns true if volume is accessed read-only using the access mode.
+func ReadOnly(mode *csi.VolumeCapability_AccessMode) bool {
+	switch mode.GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	default:
+		return false
+	}
+}
@@ -7,12 +7,18 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/UpCloudLtd/upcloud-csi/internal/accessmode"
+	"github.com/UpCloudLtd/upcloud-csi/internal/journal"
 	"github.com/UpCloudLtd/upcloud-csi/internal/logger"
 	"github.com/UpCloudLtd/upcloud-csi/internal/service"
+	"github.com/UpCloudLtd/upcloud-csi/internal/topology"
+	"github.com/UpCloudLtd/upcloud-csi/internal/volumecontext"
 	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
 	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/request"
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -27,50 +33,120 @@ var supportedCapabilities = []csi.ControllerServiceCapability_RPC_Type{ //nolint
 	csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
 	csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
 	csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+	csi.ControllerServiceCapability_RPC_GET_VOLUME,
+	csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+	csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
 }
 
+// mutableParameters contains parameters that can be changed using ControllerModifyVolume.
+var mutableParameters = []string{"tier", "labels"} //nolint: gochecknoglobals // readonly variable
+
 type Controller struct {
-	zone              string
+	csi.UnimplementedControllerServer
+
+	// zones served by the controller, first zone is the default zone.
+	zones             []string
 	maxVolumesPerNode int
+	capacityTracking  bool
 
 	svc service.Service
 	log *logrus.Entry
 
 	storageLabels []upcloud.Label
+
+	// operations tracks volume creation and expansion that can take longer than CO is willing to wait.
+	operations *operations
+	// journal records volumes created from a source until all the steps (clone, label, resize) are completed.
+	journal journal.Journal
+}
+
+// Option configures Controller.
+type Option func(*Controller)
+
+// WithCapacityTracking enables GetCapacity RPC, which reports remaining storage quota of the account.
+func WithCapacityTracking(enabled bool) Option {
+	return func(c *Controller) {
+		c.capacityTracking = enabled
+	}
 }
 
-func NewController(svc service.Service, zone string, maxVolumesPerNode int, l *logrus.Entry, labels ...string) (*Controller, error) {
-	if zone == "" {
+// WithJournal sets journal where volume operations are recorded. Operations are kept in memory by default.
+func WithJournal(j journal.Journal) Option {
+	return func(c *Controller) {
+		if j != nil {
+			c.journal = j
+		}
+	}
+}
+
+// WithLabels sets labels, in key=value format, that are added to created storages.
+func WithLabels(labels ...string) Option {
+	return func(c *Controller) {
+		c.storageLabels = upcloudLabels(labels)
+	}
+}
+
+func NewController(svc service.Service, zones []string, maxVolumesPerNode int, l *logrus.Entry, opts ...Option) (*Controller, error) {
+	if len(zones) == 0 {
 		return nil, errors.New("controller zone is required field")
 	}
-	return &Controller{
-		zone:              zone,
+	for _, zone := range zones {
+		if zone == "" {
+			return nil, errors.New("controller zone can't be empty")
+		}
+	}
+	c := &Controller{
+		zones:             zones,
 		svc:               svc,
 		log:               l,
-		storageLabels:     upcloudLabels(labels),
+		storageLabels:     upcloudLabels(nil),
 		maxVolumesPerNode: maxVolumesPerNode,
-	}, nil
+		operations:        newOperations(),
+		journal:           journal.NewMemoryJournal(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
 }
 
 // CreateVolume provisions storage via UpCloud Storage service.
 func (c *Controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (resp *csi.CreateVolumeResponse, err error) {
+	if err := validateCreateVolumeRequest(req); err != nil {
+		return nil, err
+	}
+	return runOperation(ctx, c.operations, "create volume "+req.GetName(), req, func(ctx context.Context) (*csi.CreateVolumeResponse, error) {
+		return c.createVolume(ctx, req)
+	})
+}
+
+func (c *Controller) createVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
 	log := logger.WithServerContext(ctx, c.log).WithField(logger.VolumeNameKey, req.GetName())
 
-	if err := validateCreateVolumeRequest(req, c.zone); err != nil {
+	zone, err := c.createVolumeRequestZone(req)
+	if err != nil {
 		return nil, err
 	}
+	log = log.WithField(logger.ZoneKey, zone)
+	tier, err := createVolumeRequestTier(req)
+	if err != nil {
+		return nil, err
+	}
+	labels, err := createVolumeRequestLabels(req, c.storageLabels)
+	if err != nil {
+		return nil, err
+	}
+	if req.GetParameters()["encryption"] == volumecontext.EncryptionLUKS {
+		labels = mergeLabels(labels, luksLabels())
+	}
+
 	// get volume first, and skip if exists
 	volumes, err := c.svc.GetStorageByName(ctx, req.GetName())
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 	if len(volumes) > 0 {
-		return createVolumeExistsResponse(ctx, req, volumes, log)
-	}
-
-	tier, err := createVolumeRequestTier(req)
-	if err != nil {
-		return nil, err
+		return c.createVolumeExistsResponse(ctx, req, volumes, zone, labels, log)
 	}
 	// determine the size of the storage
 	storageSize, err := getStorageRange(req.GetCapacityRange())
@@ -81,16 +157,27 @@ func (c *Controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 
 	var vol *upcloud.StorageDetails
 	if volContentSrc := req.GetVolumeContentSource(); volContentSrc != nil {
-		if vol, err = c.createVolumeFromSource(ctx, req, storageSizeGB, tier); err != nil {
+		src, err := c.getVolumeContentSource(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		luks, err := createVolumeFromSourceLUKS(req, src)
+		if err != nil {
+			return nil, err
+		}
+		if luks {
+			labels = mergeLabels(labels, luksLabels())
+		}
+		if vol, err = c.createVolumeFromSource(ctx, req, src, zone, storageSizeGB, tier, labels); err != nil {
 			return nil, err
 		}
 	} else {
 		volumeReq := &request.CreateStorageRequest{
-			Zone:      c.zone,
+			Zone:      zone,
 			Title:     req.GetName(),
 			Size:      storageSizeGB,
 			Tier:      tier,
-			Labels:    c.storageLabels,
+			Labels:    labels,
 			Encrypted: upcloud.FromBool(createVolumeRequestEncryptionAtRest(req)),
 		}
 		logger.WithServiceRequest(log, volumeReq).Info("creating volume")
@@ -105,44 +192,87 @@ func (c *Controller) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 			CapacityBytes: storageSize,
 			AccessibleTopology: []*csi.Topology{
 				{
-					Segments: map[string]string{
-						"region": c.zone,
-					},
+					Segments: topology.Segments(vol.Zone),
 				},
 			},
 			ContentSource: req.GetVolumeContentSource(),
+			VolumeContext: createVolumeRequestVolumeContext(req, isLUKSStorage(labels)),
 		},
 	}, nil
 }
 
-func createVolumeExistsResponse(ctx context.Context, req *csi.CreateVolumeRequest, volumes []*upcloud.StorageDetails, log *logrus.Entry) (resp *csi.CreateVolumeResponse, err error) {
+// createVolumeExistsResponse returns response for volume that already exists. If volume was created from a source
+// and the previous call was interrupted e.g. while storage was copied, remaining steps are completed before responding.
+func (c *Controller) createVolumeExistsResponse(ctx context.Context, req *csi.CreateVolumeRequest, volumes []*upcloud.StorageDetails, zone string, labels []upcloud.Label, log *logrus.Entry) (resp *csi.CreateVolumeResponse, err error) {
 	if len(volumes) > 1 {
 		return nil, fmt.Errorf("fatal: duplicate volume %q exists", req.GetName())
 	}
-	vol := volumes[0].Storage
+	vol := &volumes[0].Storage
+	log = log.WithField(logger.VolumeIDKey, vol.UUID)
+	if vol.Zone != zone {
+		return nil, status.Errorf(codes.AlreadyExists, "volume %s exists in zone %s, requested zone is %s", vol.UUID, vol.Zone, zone)
+	}
 	storageSize, err := getStorageRange(req.GetCapacityRange())
 	if err != nil {
 		return nil, status.Error(codes.OutOfRange, fmt.Sprintf("CreateVolume failed to extract storage size: %s", err.Error()))
 	}
+	op, pending, err := c.journal.Get(ctx, req.GetName())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if pending {
+		// labels of the pending operation include encryption label inherited from the source
+		labels = mergeLabels(labels, op.Labels)
+	}
+	switch vol.State {
+	case upcloud.StorageStateError:
+		if pending {
+			// roll back failed operation so that retried call can start from the beginning
+			if err := c.rollbackVolume(ctx, log, req.GetName(), vol.UUID); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			return nil, status.Errorf(codes.Aborted, "volume %s creation failed and storage was deleted, storage was in state %s", vol.UUID, vol.State)
+		}
+		return nil, status.Errorf(codes.Internal, "volume %s is in state %s", vol.UUID, vol.State)
+	case upcloud.StorageStateMaintenance:
+		log.WithField("state", vol.State).Info("volume creation is in progress")
+		return nil, status.Errorf(codes.Aborted, "volume %s creation is in progress, storage is in state %s", vol.UUID, vol.State)
+	}
+	if req.GetVolumeContentSource() != nil {
+		if vol, err = c.completeVolume(ctx, log, vol, int(storageSize/giB), labels); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if err := c.journal.Complete(ctx, req.GetName()); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
 	if vol.Size*giB != int(storageSize) {
 		return nil, status.Errorf(codes.AlreadyExists, "invalid storage size requested: %d", storageSize)
 	}
-	log.WithField(logger.VolumeIDKey, vol.UUID).Info("volume already exists")
+	log.Info("volume already exists")
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      vol.UUID,
+			VolumeId:      storageVolumeID(vol),
 			CapacityBytes: int64(vol.Size) * giB,
+			AccessibleTopology: []*csi.Topology{
+				{
+					Segments: topology.Segments(vol.Zone),
+				},
+			},
 			ContentSource: req.GetVolumeContentSource(),
+			VolumeContext: createVolumeRequestVolumeContext(req, isLUKSStorage(vol.Labels) || isLUKSStorage(labels)),
 		},
 	}, nil
 }
 
-func (c *Controller) createVolumeFromSource(ctx context.Context, req *csi.CreateVolumeRequest, storageSizeGB int, tier string) (*upcloud.StorageDetails, error) {
+// getVolumeContentSource returns storage or backup used as volume content source.
+func (c *Controller) getVolumeContentSource(ctx context.Context, req *csi.CreateVolumeRequest) (*upcloud.StorageDetails, error) {
 	volContentSrc := req.GetVolumeContentSource()
 	if volContentSrc == nil {
 		return nil, status.Error(codes.Internal, "got empty volume content source")
 	}
 	var sourceID string
+	getSource := c.svc.GetStorageByUUID
 	switch volContentSrc.Type.(type) {
 	case *csi.VolumeContentSource_Snapshot:
 		snapshot := volContentSrc.GetSnapshot()
@@ -156,21 +286,27 @@ func (c *Controller) createVolumeFromSource(ctx context.Context, req *csi.Create
 			return nil, status.Error(codes.Internal, "content source volume is not defined")
 		}
 		sourceID = srcVol.GetVolumeId()
+		getSource = c.getVolumeStorage
 	default:
 		return nil, status.Errorf(codes.InvalidArgument, "%v not a proper volume source", volContentSrc)
 	}
 	log := logger.WithServerContext(ctx, c.log).WithField(logger.VolumeNameKey, req.GetName()).WithField(logger.VolumeSourceKey, sourceID)
-	log.Info("getting source storage by uuid")
-	src, err := c.svc.GetStorageByUUID(ctx, sourceID)
+	log.Info("getting source storage")
+	src, err := getSource(ctx, sourceID)
 	if err != nil {
 		if errors.Is(err, service.ErrStorageNotFound) {
 			return nil, status.Errorf(codes.NotFound, "could not retrieve source volume by ID: %s", err.Error())
 		}
 		return nil, status.Errorf(codes.InvalidArgument, err.Error())
 	}
-	if src.Encrypted.Bool() != createVolumeRequestEncryptionAtRest(req) {
-		// To prevent unexpected dst device properties, only allow cloning from device with same encryption policy.
-		return nil, status.Errorf(codes.InvalidArgument, "source and destination volumes needs to have same encryption policy")
+	return src, nil
+}
+
+func (c *Controller) createVolumeFromSource(ctx context.Context, req *csi.CreateVolumeRequest, src *upcloud.StorageDetails, zone string, storageSizeGB int, tier string, labels []upcloud.Label) (*upcloud.StorageDetails, error) {
+	log := logger.WithServerContext(ctx, c.log).WithField(logger.VolumeNameKey, req.GetName()).WithField(logger.VolumeSourceKey, src.UUID)
+	encrypted, err := createVolumeFromSourceEncryptionAtRest(req, src)
+	if err != nil {
+		return nil, err
 	}
 	log.Info("checking that source storage is online")
 	if err := c.svc.RequireStorageOnline(ctx, &src.Storage); err != nil {
@@ -178,17 +314,47 @@ func (c *Controller) createVolumeFromSource(ctx context.Context, req *csi.Create
 	}
 	volumeReq := &request.CloneStorageRequest{
 		UUID:      src.Storage.UUID,
-		Zone:      c.zone,
+		Zone:      zone,
 		Tier:      tier,
 		Title:     req.GetName(),
-		Encrypted: src.Encrypted,
+		Encrypted: upcloud.FromBool(encrypted),
+	}
+	op := journal.Entry{
+		Name:     req.GetName(),
+		SourceID: src.Storage.UUID,
+		Zone:     zone,
+		SizeGB:   storageSizeGB,
+		Labels:   labels,
+		Started:  time.Now(),
+	}
+	if err := c.journal.Put(ctx, op); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to record operation: %s", err.Error())
+	}
+	if src.Zone != zone {
+		// Copying storage to another zone can take longer than CO is willing to wait, so copy is only started here.
+		// Retried CreateVolume call finds the volume by name and completes remaining steps once the copy is finished.
+		logger.WithServiceRequest(log, volumeReq).WithField("source_zone", src.Zone).Info("copying volume to another zone")
+		vol, err := c.svc.StartCloneStorage(ctx, volumeReq)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		op.StorageUUID = vol.Storage.UUID
+		if err := c.journal.Put(ctx, op); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to record operation: %s", err.Error())
+		}
+		return nil, status.Errorf(codes.Aborted, "volume %s is being copied from zone %s to zone %s, storage is in state %s", vol.Storage.UUID, src.Zone, zone, vol.Storage.State)
 	}
 	logger.WithServiceRequest(log, volumeReq).Info("cloning volume")
-	vol, err := c.svc.CloneStorage(ctx, volumeReq, c.storageLabels...)
+	vol, err := c.svc.CloneStorage(ctx, volumeReq, labels...)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	op.StorageUUID = vol.Storage.UUID
+	if err := c.journal.Put(ctx, op); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to record operation: %s", err.Error())
+	}
+
 	log = log.WithField(logger.VolumeIDKey, vol.Storage.UUID).WithField("size", vol.Storage.Size)
 	if storageSizeGB > vol.Storage.Size {
 		log.WithField("new_size", storageSizeGB).Info("resizing volume")
@@ -197,9 +363,134 @@ func (c *Controller) createVolumeFromSource(ctx context.Context, req *csi.Create
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	}
+	if err := c.journal.Complete(ctx, req.GetName()); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 	return vol, err
 }
 
+// completeVolume completes steps of creating volume from a source that might have been interrupted:
+// storage is resized to the requested size and requested labels are added.
+func (c *Controller) completeVolume(ctx context.Context, log *logrus.Entry, vol *upcloud.Storage, sizeGB int, labels []upcloud.Label) (*upcloud.Storage, error) {
+	if vol.Size < sizeGB {
+		log.WithField("new_size", sizeGB).Info("resizing volume")
+		if _, err := c.svc.ResizeStorage(ctx, vol.UUID, sizeGB, true); err != nil {
+			return vol, err
+		}
+		vol.Size = sizeGB
+	}
+	if newLabels := mergeLabels(vol.Labels, labels); !labelsEqual(vol.Labels, newLabels) {
+		log.WithField("labels", newLabels).Info("updating volume labels")
+		if _, err := c.svc.SetStorageLabels(ctx, vol.UUID, newLabels); err != nil {
+			return vol, err
+		}
+		vol.Labels = newLabels
+	}
+	return vol, nil
+}
+
+// rollbackVolume deletes storage of failed operation and removes the operation from the journal.
+func (c *Controller) rollbackVolume(ctx context.Context, log *logrus.Entry, name, storageUUID string) error {
+	log.Info("rolling back volume creation, deleting storage")
+	if err := c.svc.DeleteStorage(ctx, storageUUID); err != nil && !errors.Is(err, service.ErrStorageNotFound) {
+		return err
+	}
+	return c.journal.Complete(ctx, name)
+}
+
+// ResumeOperations resumes volume operations that were interrupted e.g. by controller restart.
+// Storage of each pending operation is resized and labeled as requested, or deleted if the storage has failed.
+func (c *Controller) ResumeOperations(ctx context.Context) error {
+	entries, err := c.journal.Pending(ctx)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, e := range entries {
+		e := e
+		_, err := runOperation(ctx, c.operations, "create volume "+e.Name, nil, func(ctx context.Context) (*upcloud.Storage, error) {
+			return c.resumeOperation(ctx, e)
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to resume volume %s operation: %w", e.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Controller) resumeOperation(ctx context.Context, e journal.Entry) (*upcloud.Storage, error) {
+	log := logger.WithServerContext(ctx, c.log).WithFields(logrus.Fields{
+		logger.VolumeNameKey:   e.Name,
+		logger.VolumeSourceKey: e.SourceID,
+	})
+	volumes, err := c.svc.GetStorageByName(ctx, e.Name)
+	if err != nil {
+		return nil, err
+	}
+	switch len(volumes) {
+	case 0:
+		// storage was never created, so CO retry starts from the beginning
+		log.Info("storage of pending operation not found, removing operation")
+		return nil, c.journal.Complete(ctx, e.Name)
+	case 1:
+	default:
+		return nil, fmt.Errorf("fatal: duplicate volume %q exists", e.Name)
+	}
+	vol := &volumes[0].Storage
+	log = log.WithField(logger.VolumeIDKey, vol.UUID)
+	if vol.State == upcloud.StorageStateError {
+		return nil, c.rollbackVolume(ctx, log, e.Name, vol.UUID)
+	}
+	log.Info("resuming volume operation")
+	if err := c.svc.RequireStorageOnline(ctx, vol); err != nil {
+		return nil, err
+	}
+	if vol, err = c.completeVolume(ctx, log, vol, e.SizeGB, e.Labels); err != nil {
+		return nil, err
+	}
+	return vol, c.journal.Complete(ctx, e.Name)
+}
+
+// getVolumeStorage returns storage of the volume. Volume ID is the UUID of the storage created with the volume. If that
+// storage has been replaced by a copy, e.g. to change the storage tier, the copy is found using the volume ID label.
+func (c *Controller) getVolumeStorage(ctx context.Context, volumeID string) (*upcloud.StorageDetails, error) {
+	volume, err := c.svc.GetStorageByUUID(ctx, volumeID)
+	if !errors.Is(err, service.ErrStorageNotFound) {
+		return volume, err
+	}
+	copies, err := c.volumeCopies(ctx, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	copies = withoutPendingCopies(copies)
+	switch len(copies) {
+	case 0:
+		return nil, service.ErrStorageNotFound
+	case 1:
+		return c.svc.GetStorageByUUID(ctx, copies[0].UUID)
+	default:
+		return nil, fmt.Errorf("fatal: volume %s has %d storages", volumeID, len(copies))
+	}
+}
+
+// volumeCopies returns storages that have replaced the storage created with the volume, including copies that are
+// still being prepared.
+func (c *Controller) volumeCopies(ctx context.Context, volumeID string) ([]upcloud.Storage, error) {
+	copies := make([]upcloud.Storage, 0)
+	for _, zone := range c.zones {
+		storages, err := c.svc.ListStorage(ctx, zone)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range storages {
+			if labelValue(s.Labels, volumeIDLabelKey) == volumeID {
+				copies = append(copies, s)
+			}
+		}
+	}
+	return copies, nil
+}
+
 // DeleteVolume deletes storage via UpCloud Storage service.
 func (c *Controller) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	if req.VolumeId == "" {
@@ -207,7 +498,13 @@ func (c *Controller) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequ
 	}
 
 	logger.WithServerContext(ctx, c.log).WithField(logger.VolumeIDKey, req.GetVolumeId()).Info("deleting volume")
-	err := c.svc.DeleteStorage(ctx, req.VolumeId)
+	volume, err := c.getVolumeStorage(ctx, req.GetVolumeId())
+	if err == nil {
+		err = c.svc.DeleteStorage(ctx, volume.UUID)
+	}
+	if errors.Is(err, service.ErrStorageBusy) {
+		return nil, status.Error(codes.Aborted, err.Error())
+	}
 	if err != nil && !errors.Is(err, service.ErrStorageNotFound) {
 		return &csi.DeleteVolumeResponse{}, err
 	}
@@ -230,8 +527,8 @@ func (c *Controller) ControllerPublishVolume(ctx context.Context, req *csi.Contr
 	}
 
 	// check if volume exist before trying to attach it
-	log.Info("getting storage by uuid")
-	volume, err := c.svc.GetStorageByUUID(ctx, req.VolumeId)
+	log.Info("getting volume storage")
+	volume, err := c.getVolumeStorage(ctx, req.VolumeId)
 	if err != nil {
 		if errors.Is(err, service.ErrStorageNotFound) {
 			return nil, status.Error(codes.NotFound, err.Error())
@@ -239,6 +536,11 @@ func (c *Controller) ControllerPublishVolume(ctx context.Context, req *csi.Contr
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	if volume.Zone != server.Zone {
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"volume %q in zone %s can't be attached to node in zone %s", req.VolumeId, volume.Zone, server.Zone)
+	}
+
 	log.Info("checking that storage is online")
 	if err = c.svc.RequireStorageOnline(ctx, &volume.Storage); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
@@ -250,9 +552,7 @@ func (c *Controller) ControllerPublishVolume(ctx context.Context, req *csi.Contr
 		if id == server.UUID {
 			log.Info("volume is already attached")
 			return &csi.ControllerPublishVolumeResponse{
-				PublishContext: map[string]string{
-					string(logger.CtxCorrelationIDKey): logger.ContextCorrelationID(ctx),
-				},
+				PublishContext: publishContext(ctx, volume.UUID),
 			}, nil
 		}
 	}
@@ -271,8 +571,12 @@ func (c *Controller) ControllerPublishVolume(ctx context.Context, req *csi.Contr
 	if len(server.StorageDevices) > c.maxVolumesPerNode {
 		return nil, status.Error(codes.ResourceExhausted, "volumes already attached to the node is more than the maximum supported")
 	}
+	if req.GetReadonly() || accessmode.ReadOnly(req.GetVolumeCapability().GetAccessMode()) {
+		// UpCloud doesn't support attaching storage read-only, so read-only access is enforced by the node when mounting the volume.
+		log.Info("attaching read-only volume as read-write device, node mounts the volume read-only")
+	}
 	log.Info("attaching storage to node")
-	err = c.svc.AttachStorage(ctx, req.VolumeId, server.UUID)
+	err = c.svc.AttachStorage(ctx, volume.UUID, server.UUID)
 	if err != nil {
 		var svcError *upcloud.Problem
 		if errors.As(err, &svcError) && svcError.Status != http.StatusConflict && svcError.ErrorCode() == upcloud.ErrCodeStorageDeviceLimitReached {
@@ -282,9 +586,7 @@ func (c *Controller) ControllerPublishVolume(ctx context.Context, req *csi.Contr
 	}
 
 	return &csi.ControllerPublishVolumeResponse{
-		PublishContext: map[string]string{
-			string(logger.CtxCorrelationIDKey): logger.ContextCorrelationID(ctx),
-		},
+		PublishContext: publishContext(ctx, volume.UUID),
 	}, nil
 }
 
@@ -306,9 +608,9 @@ func (c *Controller) ControllerUnpublishVolume(ctx context.Context, req *csi.Con
 		logger.VolumeIDKey: req.GetVolumeId(),
 		logger.NodeIDKey:   req.GetNodeId(),
 	})
-	log.Info("getting storage by uuid")
+	log.Info("getting volume storage")
 	// check if volume exist before trying to detach it
-	_, err := c.svc.GetStorageByUUID(ctx, req.GetVolumeId())
+	volume, err := c.getVolumeStorage(ctx, req.GetVolumeId())
 	if err != nil {
 		if errors.Is(err, service.ErrStorageNotFound) {
 			log.Info("storage not found")
@@ -317,7 +619,16 @@ func (c *Controller) ControllerUnpublishVolume(ctx context.Context, req *csi.Con
 		return nil, err
 	}
 
-	// TODO:  If node ID is not set, the SP MUST unpublish the volume from all nodes it is published to (ref. ControllerUnpublishVolumeRequest.NodeId).
+	if req.GetNodeId() == "" {
+		// If node ID is not set, the SP MUST unpublish the volume from all nodes it is published to (ref. ControllerUnpublishVolumeRequest.NodeId).
+		for _, serverUUID := range volume.ServerUUIDs {
+			if err := c.detachStorage(ctx, log.WithField("server_uuid", serverUUID), volume.UUID, serverUUID); err != nil {
+				return nil, err
+			}
+		}
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+
 	log.Info("getting server by hostname")
 	server, err := c.svc.GetServerByHostname(ctx, req.GetNodeId())
 	if err != nil {
@@ -328,25 +639,226 @@ func (c *Controller) ControllerUnpublishVolume(ctx context.Context, req *csi.Con
 		return nil, err
 	}
 
+	if err := c.detachStorage(ctx, log, volume.UUID, server.UUID); err != nil {
+		return nil, err
+	}
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+func (c *Controller) detachStorage(ctx context.Context, log *logrus.Entry, storageUUID, serverUUID string) error {
 	log.Info("detaching volume")
-	err = c.svc.DetachStorage(ctx, req.VolumeId, server.UUID)
-	if err != nil {
+	if err := c.svc.DetachStorage(ctx, storageUUID, serverUUID); err != nil {
 		if errors.Is(err, service.ErrServerStorageNotFound) {
 			log.Info("volume was already detached from the node")
-			return &csi.ControllerUnpublishVolumeResponse{}, nil
+			return nil
 		}
+		return err
+	}
+	return nil
+}
+
+// ControllerGetVolume returns current information about a volume: capacity, nodes the volume is published to and volume condition.
+//
+// Volume condition is reported as abnormal if the backing storage is in erroneous state or if the volume is attached
+// to a server that can't be found anymore. External health monitor uses condition to emit events for the PVC.
+func (c *Controller) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID must be provided")
+	}
+	log := logger.WithServerContext(ctx, c.log).WithField(logger.VolumeIDKey, req.GetVolumeId())
+
+	log.Info("getting volume storage")
+	volume, err := c.getVolumeStorage(ctx, req.GetVolumeId())
+	if err != nil {
+		if errors.Is(err, service.ErrStorageNotFound) {
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	nodeIDs := make([]string, 0)
+	missingServers := make([]string, 0)
+	for _, id := range volume.ServerUUIDs {
+		log.WithField("server_uuid", id).Info("getting server by uuid")
+		server, err := c.svc.GetServerByUUID(ctx, id)
+		if err != nil {
+			if errors.Is(err, service.ErrServerNotFound) {
+				missingServers = append(missingServers, id)
+				continue
+			}
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		nodeIDs = append(nodeIDs, server.Hostname)
+	}
+
+	condition := volumeCondition(volume, missingServers)
+	log.WithField("condition", condition).Info("volume condition")
+	return &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      req.GetVolumeId(),
+			CapacityBytes: int64(volume.Size) * giB,
+		},
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			PublishedNodeIds: nodeIDs,
+			VolumeCondition:  condition,
+		},
+	}, nil
+}
+
+// ControllerModifyVolume modifies mutable parameters of existing volume.
+//
+// Storage labels are updated in place. UpCloud can't change the tier of existing storage, so storage is copied to
+// the new tier and the copy replaces the volume storage, which is deleted once the copy is online. Volume needs to be
+// detached while the tier is changed. Copying can take longer than CO is willing to wait, so copy runs in background
+// and retried calls are aborted until the copy is finished.
+func (c *Controller) ControllerModifyVolume(ctx context.Context, req *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerModifyVolume volume ID must be provided")
+	}
+	if err := validateMutableParameters(req.GetMutableParameters()); err != nil {
+		return nil, err
+	}
+	tier, err := storageTier(req.GetMutableParameters())
+	if err != nil {
+		return nil, err
+	}
+	labels, err := storageLabels(req.GetMutableParameters())
+	if err != nil {
 		return nil, err
 	}
 
-	return &csi.ControllerUnpublishVolumeResponse{}, nil
+	log := logger.WithServerContext(ctx, c.log).WithField(logger.VolumeIDKey, req.GetVolumeId())
+	volume, err := c.getVolumeStorage(ctx, req.GetVolumeId())
+	if err != nil {
+		if errors.Is(err, service.ErrStorageNotFound) {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found", req.GetVolumeId())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if tier != "" && tier != volume.Tier {
+		return runOperation(ctx, c.operations, "modify volume "+req.GetVolumeId(), req, func(ctx context.Context) (*csi.ControllerModifyVolumeResponse, error) {
+			return &csi.ControllerModifyVolumeResponse{}, c.changeVolumeTier(ctx, req.GetVolumeId(), tier, labels)
+		})
+	}
+
+	if labels != nil {
+		newLabels := mergeLabels(volume.Labels, labels)
+		if !labelsEqual(volume.Labels, newLabels) {
+			log.WithField("labels", newLabels).Info("updating volume labels")
+			if _, err := c.svc.SetStorageLabels(ctx, volume.UUID, newLabels); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		}
+	}
+	log.Info("volume modified")
+	return &csi.ControllerModifyVolumeResponse{}, nil
 }
 
-func (c *Controller) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	// ALPHA FEATURE
-	// This optional RPC MAY be called by the CO to fetch current information about a volume.
-	// A Controller Plugin MUST implement this ControllerGetVolume RPC call if it has GET_VOLUME capability.
-	// When implemented add csi.ControllerServiceCapability_RPC_GET_VOLUME to supportedCapabilities.
-	return nil, status.Errorf(codes.Unimplemented, "method ControllerGetVolume not implemented")
+// changeVolumeTier copies volume storage to the tier and replaces the volume storage with the copy. Copy is labeled with
+// the volume ID, so that volume can still be found using the volume ID, and with UUID of the storage it replaces, so that
+// the copy isn't used before the replaced storage is deleted. Copy left by an interrupted call is reused.
+func (c *Controller) changeVolumeTier(ctx context.Context, volumeID, tier string, labels []upcloud.Label) error {
+	log := logger.WithServerContext(ctx, c.log).WithField(logger.VolumeIDKey, volumeID).WithField("tier", tier)
+	volume, err := c.getVolumeStorage(ctx, volumeID)
+	if err != nil {
+		if errors.Is(err, service.ErrStorageNotFound) {
+			return status.Errorf(codes.NotFound, "volume %s not found", volumeID)
+		}
+		return status.Error(codes.Internal, err.Error())
+	}
+	if len(volume.ServerUUIDs) > 0 {
+		return status.Errorf(codes.FailedPrecondition, "volume %s needs to be detached from server(s) %s to change the storage tier",
+			volumeID, strings.Join(volume.ServerUUIDs, ", "))
+	}
+	log = log.WithField("storage_uuid", volume.UUID)
+	copyLabels := mergeLabels(volume.Labels, labels, []upcloud.Label{
+		{Key: volumeIDLabelKey, Value: volumeID},
+		{Key: replacesLabelKey, Value: volume.UUID},
+	})
+
+	replacement, err := c.copyVolumeStorage(ctx, log, &volume.Storage, tier, copyLabels)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	log = log.WithField("copy_uuid", replacement.UUID)
+	log.Info("deleting replaced volume storage")
+	err = c.svc.DeleteStorage(ctx, volume.UUID)
+	switch {
+	case errors.Is(err, service.ErrStorageNotFound):
+		// volume was deleted while the storage was copied
+		log.Info("volume storage was deleted, deleting the copy")
+		if err := c.svc.DeleteStorage(ctx, replacement.UUID); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		return status.Errorf(codes.NotFound, "volume %s not found", volumeID)
+	case errors.Is(err, service.ErrStorageBusy):
+		return status.Error(codes.Aborted, err.Error())
+	case err != nil:
+		return status.Error(codes.Internal, err.Error())
+	}
+	log.Info("volume storage tier changed")
+	return nil
+}
+
+// copyVolumeStorage copies volume storage to the tier and labels the copy. Copy left by an interrupted call is reused.
+func (c *Controller) copyVolumeStorage(ctx context.Context, log *logrus.Entry, volume *upcloud.Storage, tier string, labels []upcloud.Label) (*upcloud.Storage, error) {
+	replacement, err := c.tierCopy(ctx, log, volume, tier)
+	if err == nil {
+		log.WithField("copy_uuid", replacement.UUID).Info("resuming volume storage copy")
+		if err := c.svc.RequireStorageOnline(ctx, replacement); err != nil {
+			return nil, err
+		}
+		return c.completeVolume(ctx, log, replacement, volume.Size, labels)
+	}
+	if !errors.Is(err, service.ErrStorageNotFound) {
+		return nil, err
+	}
+	log.Info("checking that volume storage is online")
+	if err := c.svc.RequireStorageOnline(ctx, volume); err != nil {
+		return nil, err
+	}
+	copyReq := &request.CloneStorageRequest{
+		UUID:      volume.UUID,
+		Zone:      volume.Zone,
+		Tier:      tier,
+		Title:     volume.Title,
+		Encrypted: volume.Encrypted,
+	}
+	logger.WithServiceRequest(log, copyReq).Info("copying volume storage to the new tier")
+	sd, err := c.svc.CloneStorage(ctx, copyReq, labels...)
+	if err != nil {
+		return nil, err
+	}
+	return &sd.Storage, nil
+}
+
+// tierCopy returns copy of the volume storage left by an interrupted tier change, or service.ErrStorageNotFound if
+// there's no copy. Copy in the wrong tier, e.g. when tier change was requested again with a different tier, or copy
+// that has failed, is deleted.
+func (c *Controller) tierCopy(ctx context.Context, log *logrus.Entry, volume *upcloud.Storage, tier string) (*upcloud.Storage, error) {
+	storages, err := c.svc.GetStorageByName(ctx, volume.Title)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range storages {
+		if s.UUID == volume.UUID || s.Zone != volume.Zone || s.Type != upcloud.StorageTypeNormal {
+			continue
+		}
+		// copy isn't labeled yet if the call was interrupted while storage was being copied
+		if replaces := labelValue(s.Labels, replacesLabelKey); replaces != volume.UUID && replaces != "" {
+			continue
+		}
+		if s.Tier == tier && s.State != upcloud.StorageStateError {
+			return &s.Storage, nil
+		}
+		log.WithFields(logrus.Fields{"copy_uuid": s.UUID, "copy_tier": s.Tier, "copy_state": s.State}).Info("deleting stale volume storage copy")
+		if err := c.svc.DeleteStorage(ctx, s.UUID); err != nil && !errors.Is(err, service.ErrStorageNotFound) {
+			return nil, err
+		}
+	}
+	return nil, service.ErrStorageNotFound
 }
 
 // ValidateVolumeCapabilities checks if the volume capabilities are valid.
@@ -360,23 +872,28 @@ func (c *Controller) ValidateVolumeCapabilities(ctx context.Context, req *csi.Va
 		return nil, status.Error(codes.InvalidArgument, "volume vapabilities must be provided")
 	}
 
-	log.Info("getting storage by uuid")
+	log.Info("getting volume storage")
 	// check if volume exist before trying to validate it
-	if _, err := c.svc.GetStorageByUUID(ctx, req.VolumeId); err != nil {
+	if _, err := c.getVolumeStorage(ctx, req.VolumeId); err != nil {
 		if errors.Is(err, service.ErrStorageNotFound) {
 			return nil, status.Error(codes.NotFound, err.Error())
 		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	// if it's not supported (i.e: wrong region), we shouldn't override it
+	if violations := validateCapabilities(req.GetVolumeCapabilities()); len(violations) > 0 {
+		log.WithField("violations", violations).Info("unsupported capabilities")
+		return &csi.ValidateVolumeCapabilitiesResponse{
+			Message: strings.Join(violations, ", "),
+		}, nil
+	}
+
 	resp := &csi.ValidateVolumeCapabilitiesResponse{
 		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
-			VolumeCapabilities: []*csi.VolumeCapability{
-				{
-					AccessMode: supportedAccessMode,
-				},
-			},
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: req.GetVolumeCapabilities(),
+			Parameters:         req.GetParameters(),
+			MutableParameters:  req.GetMutableParameters(),
 		},
 	}
 
@@ -396,19 +913,28 @@ func (c *Controller) ListVolumes(ctx context.Context, req *csi.ListVolumesReques
 		return nil, status.Error(codes.Aborted, "failed to parse starting_token")
 	}
 	log.Info("getting list of storages")
-	volumes, err := c.svc.ListStorage(ctx, c.zone)
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "listvolumes failed with: %s", err.Error())
+	volumes := make([]upcloud.Storage, 0)
+	for _, zone := range c.zones {
+		zoneVolumes, err := c.svc.ListStorage(ctx, zone)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "listvolumes failed with: %s", err.Error())
+		}
+		volumes = append(volumes, zoneVolumes...)
 	}
 
-	volumes, listNext := paginateStorage(volumes, listStart, int(req.GetMaxEntries()))
+	volumes, listNext := paginateStorage(withoutPendingCopies(volumes), listStart, int(req.GetMaxEntries()))
 
 	entries := make([]*csi.ListVolumesResponse_Entry, 0)
 	for _, vol := range volumes {
 		entries = append(entries, &csi.ListVolumesResponse_Entry{
 			Volume: &csi.Volume{
-				VolumeId:      vol.UUID,
+				VolumeId:      storageVolumeID(&vol),
 				CapacityBytes: int64(vol.Size) * giB,
+				AccessibleTopology: []*csi.Topology{
+					{
+						Segments: topology.Segments(vol.Zone),
+					},
+				},
 			},
 		})
 	}
@@ -421,14 +947,53 @@ func (c *Controller) ListVolumes(ctx context.Context, req *csi.ListVolumesReques
 }
 
 // GetCapacity returns the capacity of the storage pool.
+//
+// Available capacity is the remaining storage quota of the account for the requested storage tier.
+// Capacity is zero if the requested topology is not served by the controller.
 func (c *Controller) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	if !c.capacityTracking {
+		return nil, status.Error(codes.Unimplemented, "capacity tracking is not enabled")
+	}
+	log := logger.WithServerContext(ctx, c.log)
+
+	if zone := topology.Zone(req.GetAccessibleTopology().GetSegments()); zone != "" && !c.servesZone(zone) {
+		log.WithField(logger.ZoneKey, zone).Info("zone is not served by the controller")
+		return &csi.GetCapacityResponse{AvailableCapacity: 0}, nil
+	}
+	tier, err := storageTier(req.GetParameters())
+	if err != nil {
+		return nil, err
+	}
+	if tier == "" {
+		tier = upcloud.StorageTierMaxIOPS
+	}
+
+	log = log.WithField("tier", tier)
+	log.Info("getting storage quota")
+	quota, err := c.svc.GetStorageQuota(ctx, tier)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	capacity := int64(quota) * giB
+	maxVolumeSize := capacity
+	if maxVolumeSize > maximumVolumeSizeInBytes {
+		maxVolumeSize = maximumVolumeSizeInBytes
+	}
+	log.WithField("capacity", capacity).Info("available capacity")
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: capacity,
+		MaximumVolumeSize: &wrappers.Int64Value{Value: maxVolumeSize},
+	}, nil
 }
 
 // ControllerGetCapabilities returns the capacity of the storage pool.
 func (c *Controller) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
+	capabilities := append([]csi.ControllerServiceCapability_RPC_Type{}, supportedCapabilities...)
+	if c.capacityTracking {
+		capabilities = append(capabilities, csi.ControllerServiceCapability_RPC_GET_CAPACITY)
+	}
 	caps := make([]*csi.ControllerServiceCapability, 0)
-	for _, capability := range supportedCapabilities {
+	for _, capability := range capabilities {
 		caps = append(caps, &csi.ControllerServiceCapability{
 			Type: &csi.ControllerServiceCapability_Rpc{
 				Rpc: &csi.ControllerServiceCapability_RPC{
@@ -462,14 +1027,31 @@ func (c *Controller) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshot
 		return nil, status.Errorf(codes.Internal, "CreateSnapshot failed with: %s", err.Error())
 	}
 
-	if s != nil && s.Origin != req.GetSourceVolumeId() {
+	if s != nil && snapshotSourceVolumeID(s) != req.GetSourceVolumeId() {
 		return nil, status.Error(codes.AlreadyExists, "snapshot already exists with different source volume ID")
 	}
 
+	if s != nil && s.State != upcloud.StorageStateOnline {
+		// storage listing might be out of date, so get current state of the backup
+		log.WithField(logger.SnapshotIDKey, s.UUID).Info("getting storage backup state")
+		sd, err := c.svc.GetStorageByUUID(ctx, s.UUID)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "CreateSnapshot failed with: %s", err.Error())
+		}
+		s = &sd.Storage
+		if s.State == upcloud.StorageStateError {
+			return nil, status.Errorf(codes.Internal, "snapshot %s is in state %s", s.UUID, s.State)
+		}
+	}
+
 	if s == nil {
-		log.Info("creating storage backup")
+		volume, err := c.getVolumeStorage(ctx, req.GetSourceVolumeId())
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "CreateSnapshot failed with: %s", err.Error())
+		}
 
-		sd, err := c.svc.CreateStorageBackup(ctx, req.GetSourceVolumeId(), req.GetName())
+		log.Info("creating storage backup")
+		sd, err := c.svc.CreateStorageBackup(ctx, volume.UUID, req.GetName())
 		if err != nil {
 			if errors.Is(err, service.ErrBackupInProgress) {
 				return nil, status.Errorf(codes.Aborted, "cannot create snapshot for volume with backup in progress")
@@ -478,20 +1060,45 @@ func (c *Controller) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshot
 			return nil, status.Errorf(codes.Internal, "CreateSnapshot failed with: %s", err.Error())
 		}
 
-		s = &sd.Storage
+		if s, err = c.labelSnapshot(ctx, log, &sd.Storage, volume, req.GetSourceVolumeId()); err != nil {
+			return nil, status.Errorf(codes.Internal, "CreateSnapshot failed with: %s", err.Error())
+		}
 	}
 
 	return &csi.CreateSnapshotResponse{
 		Snapshot: &csi.Snapshot{
 			SizeBytes:      int64(s.Size) * giB,
 			SnapshotId:     s.UUID,
-			SourceVolumeId: s.Origin,
+			SourceVolumeId: snapshotSourceVolumeID(s),
 			CreationTime:   timestamppb.New(s.Created),
 			ReadyToUse:     s.State == upcloud.StorageStateOnline,
 		},
 	}, nil
 }
 
+// labelSnapshot labels the snapshot just created from the source volume storage. Encryption label of the LUKS encrypted
+// volume is copied, so that volumes restored from the snapshot are LUKS encrypted as well, as backups don't inherit labels
+// of the origin storage. Snapshot of storage that has replaced the storage created with the volume is labeled with
+// the volume ID, as origin of the backup isn't the volume ID.
+func (c *Controller) labelSnapshot(ctx context.Context, log *logrus.Entry, s *upcloud.Storage, src *upcloud.StorageDetails, volumeID string) (*upcloud.Storage, error) {
+	labels := make([]upcloud.Label, 0)
+	if isLUKSStorage(src.Labels) && !isLUKSStorage(s.Labels) {
+		labels = append(labels, luksLabels()...)
+	}
+	if s.Origin != volumeID {
+		labels = append(labels, upcloud.Label{Key: volumeIDLabelKey, Value: volumeID})
+	}
+	if len(labels) == 0 {
+		return s, nil
+	}
+	log.WithField(logger.SnapshotIDKey, s.UUID).WithField("labels", labels).Info("setting storage backup labels")
+	sd, err := c.svc.SetStorageLabels(ctx, s.UUID, mergeLabels(s.Labels, labels))
+	if err != nil {
+		return nil, err
+	}
+	return &sd.Storage, nil
+}
+
 // DeleteSnapshot will be called by the CO to delete a snapshot.
 func (c *Controller) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
 	snapID := req.GetSnapshotId()
@@ -501,6 +1108,9 @@ func (c *Controller) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshot
 	// Delete should succeed if snapshot is not found or an invalid snapshot id is used.
 	if isValidStorageUUID(snapID) {
 		if err := c.svc.DeleteStorageBackup(ctx, snapID); err != nil {
+			if errors.Is(err, service.ErrStorageBusy) {
+				return nil, status.Error(codes.Aborted, err.Error())
+			}
 			var svcError *upcloud.Problem
 			if errors.As(err, &svcError) && svcError.Status != http.StatusNotFound {
 				return nil, status.Errorf(codes.Internal, err.Error())
@@ -546,6 +1156,14 @@ func (c *Controller) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRe
 		if err != nil {
 			return nil, status.Errorf(codes.Internal, "listsnapshots failed with: %s", err.Error())
 		}
+		if req.GetSourceVolumeId() != "" {
+			// snapshots taken after the volume storage was replaced by a copy have the copy as the origin
+			copyBackups, err := c.volumeCopyBackups(ctx, req.GetSourceVolumeId())
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "listsnapshots failed with: %s", err.Error())
+			}
+			backups = append(backups, copyBackups...)
+		}
 	}
 	backups, listNext := paginateStorage(backups, listStart, int(req.GetMaxEntries()))
 	entries := make([]*csi.ListSnapshotsResponse_Entry, 0)
@@ -554,7 +1172,7 @@ func (c *Controller) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRe
 			Snapshot: &csi.Snapshot{
 				SizeBytes:      int64(s.Size) * giB,
 				SnapshotId:     s.UUID,
-				SourceVolumeId: s.Origin,
+				SourceVolumeId: snapshotSourceVolumeID(&s),
 				CreationTime:   timestamppb.New(s.Created),
 				ReadyToUse:     s.State == upcloud.StorageStateOnline,
 			},
@@ -567,17 +1185,37 @@ func (c *Controller) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRe
 	}, nil
 }
 
+// volumeCopyBackups returns backups of storages that have replaced the storage created with the volume.
+func (c *Controller) volumeCopyBackups(ctx context.Context, volumeID string) ([]upcloud.Storage, error) {
+	backups, err := c.svc.ListStorageBackups(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	r := make([]upcloud.Storage, 0)
+	for _, b := range backups {
+		if b.Origin != volumeID && labelValue(b.Labels, volumeIDLabelKey) == volumeID {
+			r = append(r, b)
+		}
+	}
+	return r, nil
+}
+
 // ControllerExpandVolume is called from the resizer to increase the volume size.
 func (c *Controller) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	volumeID := req.GetVolumeId()
-
-	if volumeID == "" {
+	if req.GetVolumeId() == "" {
 		return nil, status.Error(codes.InvalidArgument, "volume ID missing in request")
 	}
+	return runOperation(ctx, c.operations, "expand volume "+req.GetVolumeId(), req, func(ctx context.Context) (*csi.ControllerExpandVolumeResponse, error) {
+		return c.expandVolume(ctx, req)
+	})
+}
+
+func (c *Controller) expandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
 	log := logger.WithServerContext(ctx, c.log).WithField(logger.VolumeIDKey, req.GetVolumeId())
 
-	log.Info("getting storage by uuid")
-	volume, err := c.svc.GetStorageByUUID(ctx, volumeID)
+	log.Info("getting volume storage")
+	volume, err := c.getVolumeStorage(ctx, volumeID)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "could not retrieve existing volumes: %v", err)
 	}
@@ -598,10 +1236,6 @@ func (c *Controller) ControllerExpandVolume(ctx context.Context, req *csi.Contro
 		return &csi.ControllerExpandVolumeResponse{CapacityBytes: int64(volume.Size * giB), NodeExpansionRequired: true}, nil
 	}
 
-	if len(volume.ServerUUIDs) > 0 {
-		return nil, status.Error(codes.FailedPrecondition, "volume is currently published on a node")
-	}
-
 	isBlockDevice := false
 	if req.GetVolumeCapability() != nil {
 		if _, ok := req.VolumeCapability.AccessType.(*csi.VolumeCapability_Block); ok {
@@ -609,6 +1243,19 @@ func (c *Controller) ControllerExpandVolume(ctx context.Context, req *csi.Contro
 		}
 	}
 
+	if len(volume.ServerUUIDs) > 0 {
+		// Volume is published, so only the storage device is resized here. Partition and filesystem are expanded
+		// online by the node (NodeExpandVolume) as UpCloud can resize filesystem only when storage is detached.
+		log.Info("resizing attached storage device")
+		if _, err = c.svc.ResizeBlockDevice(ctx, volume.UUID, int(resizeGigaBytes)); err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot resize volume %s: %s", volumeID, err.Error())
+		}
+		return &csi.ControllerExpandVolumeResponse{
+			CapacityBytes:         resizeGigaBytes * giB,
+			NodeExpansionRequired: !isBlockDevice,
+		}, nil
+	}
+
 	if isBlockDevice {
 		log.Info("resizing block device")
 		_, err = c.svc.ResizeBlockDevice(ctx, volume.UUID, int(resizeGigaBytes))
@@ -742,13 +1389,105 @@ func listSnapshotsErrorResponse(err error) (*csi.ListSnapshotsResponse, error) {
 	return nil, status.Error(codes.Internal, err.Error())
 }
 
+// createVolumeRequestZone returns zone where volume is created. Zone is selected from the preferred topologies
+// and then from the requisite topologies using the first zone served by the controller.
+// Default zone is used if accessibility requirements are not set.
+func (c *Controller) createVolumeRequestZone(r *csi.CreateVolumeRequest) (string, error) {
+	requirements := r.GetAccessibilityRequirements()
+	topologies := make([]*csi.Topology, 0)
+	topologies = append(topologies, requirements.GetPreferred()...)
+	topologies = append(topologies, requirements.GetRequisite()...)
+	for _, t := range topologies {
+		if zone := topology.Zone(t.GetSegments()); zone != "" && c.servesZone(zone) {
+			return zone, nil
+		}
+	}
+	if len(requirements.GetRequisite()) > 0 {
+		return "", status.Errorf(codes.ResourceExhausted, "volume can be only created in zones: %s", strings.Join(c.zones, ", "))
+	}
+	return c.zones[0], nil
+}
+
+// servesZone checks if zone is served by the controller.
+func (c *Controller) servesZone(zone string) bool {
+	for _, z := range c.zones {
+		if z == zone {
+			return true
+		}
+	}
+	return false
+}
+
+// createVolumeRequestParameters returns volume parameters where mutable parameters override parameters with the same key.
+func createVolumeRequestParameters(r *csi.CreateVolumeRequest) map[string]string {
+	parameters := make(map[string]string)
+	for k, v := range r.GetParameters() {
+		parameters[k] = v
+	}
+	for k, v := range r.GetMutableParameters() {
+		parameters[k] = v
+	}
+	return parameters
+}
+
 func createVolumeRequestTier(r *csi.CreateVolumeRequest) (string, error) {
+	return storageTier(createVolumeRequestParameters(r))
+}
+
+// createVolumeRequestLabels returns default labels merged with labels set using `labels` parameter.
+func createVolumeRequestLabels(r *csi.CreateVolumeRequest, defaults []upcloud.Label) ([]upcloud.Label, error) {
+	labels, err := storageLabels(createVolumeRequestParameters(r))
+	if err != nil {
+		return nil, err
+	}
+	return mergeLabels(defaults, labels), nil
+}
+
+// storageLabels returns labels set using `labels` parameter. Parameter value is comma-separated list of key=value pairs.
+func storageLabels(parameters map[string]string) ([]upcloud.Label, error) {
+	p, ok := parameters["labels"]
+	if !ok || strings.TrimSpace(p) == "" {
+		return nil, nil
+	}
+	labels := make([]upcloud.Label, 0)
+	for _, l := range strings.Split(p, ",") {
+		c := strings.SplitN(strings.TrimSpace(l), "=", 2)
+		if len(c) != 2 || c[0] == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid storage label '%s', expected format is key=value", l)
+		}
+		if c[0] == encryptionLabelKey {
+			return nil, status.Errorf(codes.InvalidArgument, "storage label '%s' is reserved for the driver", encryptionLabelKey)
+		}
+		labels = append(labels, upcloud.Label{Key: c[0], Value: c[1]})
+	}
+	return labels, nil
+}
+
+// validateMutableParameters checks that parameters contain only parameters that can be modified after volume creation.
+func validateMutableParameters(parameters map[string]string) error {
+	for k := range parameters {
+		supported := false
+		for _, p := range mutableParameters {
+			if k == p {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return status.Errorf(codes.InvalidArgument, "parameter '%s' is not mutable, supported mutable parameters are: %s", k, strings.Join(mutableParameters, ", "))
+		}
+	}
+	return nil
+}
+
+// storageTier returns storage tier set using `tier` parameter. Empty tier is returned if parameter is not set.
+func storageTier(parameters map[string]string) (string, error) {
 	tierMapper := map[string]string{
 		"maxiops":  upcloud.StorageTierMaxIOPS,
 		"hdd":      upcloud.StorageTierHDD,
 		"standard": upcloud.StorageTierStandard,
 	}
-	p, ok := r.Parameters["tier"]
+	p, ok := parameters["tier"]
 	if !ok {
 		// tier parameter is not required
 		return "", nil
@@ -757,18 +1496,95 @@ func createVolumeRequestTier(r *csi.CreateVolumeRequest) (string, error) {
 	if ok {
 		return tier, nil
 	}
-	return "", status.Error(codes.InvalidArgument, fmt.Sprintf("storage tier '%s' not supported", tier))
+	return "", status.Error(codes.InvalidArgument, fmt.Sprintf("storage tier '%s' not supported", p))
 }
 
 func createVolumeRequestEncryptionAtRest(r *csi.CreateVolumeRequest) bool {
 	e, ok := r.Parameters["encryption"]
-	if ok && e == "data-at-rest" {
+	if ok && e == encryptionDataAtRest {
 		return true
 	}
 	return false
 }
 
-func validateCreateVolumeRequest(r *csi.CreateVolumeRequest, zone string) error {
+// createVolumeFromSourceEncryptionAtRest returns whether volume created from the source is encrypted at rest.
+// Volume has the same encryption at rest as the source, so encryption is inherited from the source if the encryption
+// parameter is not set, and parameter that doesn't match the source is rejected.
+func createVolumeFromSourceEncryptionAtRest(r *csi.CreateVolumeRequest, src *upcloud.StorageDetails) (bool, error) {
+	switch r.GetParameters()["encryption"] {
+	case encryptionDataAtRest:
+		if !src.Encrypted.Bool() {
+			return false, status.Error(codes.InvalidArgument, "volume encrypted at rest can't be created from unencrypted source")
+		}
+	case volumecontext.EncryptionLUKS:
+		if src.Encrypted.Bool() {
+			return false, status.Error(codes.InvalidArgument, "LUKS encrypted volume can't be created from source encrypted at rest")
+		}
+	}
+	return src.Encrypted.Bool(), nil
+}
+
+// createVolumeFromSourceLUKS returns whether volume created from the source uses LUKS encryption. LUKS encryption
+// is inherited from the source if `encryption` parameter is not set, otherwise parameter has to match the source.
+func createVolumeFromSourceLUKS(r *csi.CreateVolumeRequest, src *upcloud.StorageDetails) (bool, error) {
+	srcLUKS := isLUKSStorage(src.Labels)
+	switch r.GetParameters()["encryption"] {
+	case "":
+		return srcLUKS, nil
+	case volumecontext.EncryptionLUKS:
+		if !srcLUKS {
+			return false, status.Errorf(codes.InvalidArgument, "source %s is not LUKS encrypted, volume can't use 'luks' encryption", src.UUID)
+		}
+	default:
+		if srcLUKS {
+			return false, status.Errorf(codes.InvalidArgument, "source %s is LUKS encrypted, volume needs to use 'luks' encryption", src.UUID)
+		}
+	}
+	return srcLUKS, nil
+}
+
+// luksLabels returns storage labels that mark the storage as LUKS encrypted.
+func luksLabels() []upcloud.Label {
+	return []upcloud.Label{{Key: encryptionLabelKey, Value: volumecontext.EncryptionLUKS}}
+}
+
+// isLUKSStorage checks if storage labels mark the storage as LUKS encrypted.
+func isLUKSStorage(labels []upcloud.Label) bool {
+	for _, l := range labels {
+		if l.Key == encryptionLabelKey && l.Value == volumecontext.EncryptionLUKS {
+			return true
+		}
+	}
+	return false
+}
+
+// createVolumeRequestVolumeContext returns volume context passed to the node, or nil if node doesn't need any.
+func createVolumeRequestVolumeContext(r *csi.CreateVolumeRequest, luks bool) map[string]string {
+	volumeContext := make(map[string]string)
+	if luks {
+		volumeContext[volumecontext.EncryptionKey] = volumecontext.EncryptionLUKS
+	}
+	for _, k := range volumecontext.MkfsKeys {
+		if v, ok := r.Parameters[k]; ok {
+			volumeContext[k] = v
+		}
+	}
+	if v, ok := r.Parameters[volumecontext.FsCheckKey]; ok {
+		volumeContext[volumecontext.FsCheckKey] = v
+	}
+	switch r.GetVolumeContentSource().GetType().(type) {
+	case *csi.VolumeContentSource_Snapshot:
+		volumeContext[volumecontext.ContentSourceKey] = volumecontext.ContentSourceSnapshot
+	case *csi.VolumeContentSource_Volume:
+		volumeContext[volumecontext.ContentSourceKey] = volumecontext.ContentSourceVolume
+	}
+	if len(volumeContext) == 0 {
+		return nil
+	}
+	return volumeContext
+}
+
+func validateCreateVolumeRequest(r *csi.CreateVolumeRequest) error {
 	if r.GetName() == "" {
 		return status.Error(codes.InvalidArgument, "CreateVolume Name cannot be empty")
 	}
@@ -780,18 +1596,44 @@ func validateCreateVolumeRequest(r *csi.CreateVolumeRequest, zone string) error
 	if violations := validateCapabilities(r.VolumeCapabilities); len(violations) > 0 {
 		return status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume failed with the following violations: %s", strings.Join(violations, ", ")))
 	}
-	if r.GetAccessibilityRequirements() != nil {
-		for _, t := range r.AccessibilityRequirements.Requisite {
-			region, ok := t.Segments["region"]
-			if !ok {
-				continue // nothing to do
+
+	switch e := r.GetParameters()["encryption"]; e {
+	case "", encryptionDataAtRest, volumecontext.EncryptionLUKS:
+	default:
+		return status.Errorf(codes.InvalidArgument, "CreateVolume encryption '%s' not supported", e)
+	}
+
+	if r.GetParameters()["encryption"] == volumecontext.EncryptionLUKS {
+		for _, c := range r.GetVolumeCapabilities() {
+			if c.GetBlock() != nil {
+				return status.Error(codes.InvalidArgument, "CreateVolume LUKS encryption is not supported with block access type")
+			}
+		}
+	}
+
+	if _, err := volumecontext.FsCheck(r.GetParameters()); err != nil {
+		return status.Errorf(codes.InvalidArgument, "CreateVolume %s", err.Error())
+	}
+
+	for _, c := range r.GetVolumeCapabilities() {
+		if mnt := c.GetMount(); mnt != nil {
+			if _, err := volumecontext.MkfsArgs(mnt.GetFsType(), r.GetParameters()); err != nil {
+				return status.Errorf(codes.InvalidArgument, "CreateVolume %s", err.Error())
 			}
+		}
+	}
 
-			if region != zone {
-				return status.Errorf(codes.ResourceExhausted, "volume can be only created in region: %q, got: %q", zone, region)
+	if r.GetVolumeContentSource() == nil {
+		for _, c := range r.GetVolumeCapabilities() {
+			if accessmode.ReadOnly(c.GetAccessMode()) {
+				return status.Error(codes.InvalidArgument, "CreateVolume read-only volume requires volume content source")
 			}
 		}
 	}
+
+	if err := validateMutableParameters(r.GetMutableParameters()); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -805,8 +1647,5 @@ func validateControllerPublishVolumeRequest(r *csi.ControllerPublishVolumeReques
 	if r.GetVolumeCapability() == nil {
 		return status.Error(codes.InvalidArgument, "volume capability must be provided")
 	}
-	if r.GetReadonly() {
-		return status.Error(codes.Unimplemented, "read only Volumes are not supported")
-	}
 	return nil
 }
@@ -1,12 +1,16 @@
 package controller
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestPaginateStorage(t *testing.T) {
@@ -76,19 +80,13 @@ func TestParseToken(t *testing.T) {
 	assert.Equal(t, want, got)
 }
 
-func TestIsValidUUID(t *testing.T) {
-	t.Parallel()
-
-	assert.False(t, isValidUUID(""))
-	assert.False(t, isValidUUID("0160ffc3-58ec-4670-bdc9"))
-	assert.True(t, isValidUUID("0160ffc3-58ec-4670-bdc9-27fe385d281d"))
-}
-
 func TestIsValidStorageUUID(t *testing.T) {
 	t.Parallel()
 
-	assert.True(t, isValidUUID("1160ffc3-58ec-4670-bdc9-27fe385d281d"))
-	assert.True(t, isValidUUID("0160ffc3-58ec-4670-bdc9-27fe385d281d"))
+	assert.False(t, isValidStorageUUID(""))
+	assert.False(t, isValidStorageUUID("0160ffc3-58ec-4670-bdc9"))
+	assert.False(t, isValidStorageUUID("1160ffc3-58ec-4670-bdc9-27fe385d281d"))
+	assert.True(t, isValidStorageUUID("0160ffc3-58ec-4670-bdc9-27fe385d281d"))
 }
 
 func TestCreateVolumeRequestEncryptionAtRest(t *testing.T) {
@@ -108,3 +106,48 @@ func TestCreateVolumeRequestEncryptionAtRest(t *testing.T) {
 	p["encryption"] = "data-at-rest"
 	require.True(t, createVolumeRequestEncryptionAtRest(&csi.CreateVolumeRequest{Parameters: p}))
 }
+
+func TestRunOperation(t *testing.T) {
+	t.Parallel()
+
+	o := newOperations()
+	req := &csi.CreateVolumeRequest{Name: "vol1"}
+	release := make(chan struct{})
+	calls := 0
+	fn := func(ctx context.Context) (string, error) {
+		calls++
+		<-release
+		return "vol1-id", nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := runOperation(ctx, o, "vol1", req, fn)
+	require.Equal(t, codes.Aborted, status.Code(err), "canceled call should be aborted")
+
+	_, err = runOperation(context.Background(), o, "vol1", req, fn)
+	require.Equal(t, codes.Aborted, status.Code(err), "operation in progress should be aborted")
+
+	close(release)
+	require.Eventually(t, func() bool {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		select {
+		case <-o.ops["vol1"].done:
+			return true
+		default:
+			return false
+		}
+	}, time.Second, time.Millisecond)
+
+	got, err := runOperation(context.Background(), o, "vol1", req, fn)
+	require.NoError(t, err)
+	assert.Equal(t, "vol1-id", got)
+	assert.Equal(t, 1, calls, "finished result should be picked up without running operation again")
+
+	got, err = runOperation(context.Background(), o, "vol1", req, fn)
+	require.NoError(t, err)
+	assert.Equal(t, "vol1-id", got)
+	assert.Equal(t, 2, calls)
+	assert.Empty(t, o.ops)
+}
@@ -6,11 +6,17 @@ import (
 	"testing"
 
 	"github.com/UpCloudLtd/upcloud-csi/internal/controller"
+	"github.com/UpCloudLtd/upcloud-csi/internal/journal"
 	"github.com/UpCloudLtd/upcloud-csi/internal/service"
 	"github.com/UpCloudLtd/upcloud-csi/internal/service/mock"
+	"github.com/UpCloudLtd/upcloud-csi/internal/topology"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 const (
@@ -26,7 +32,7 @@ func newController(svc service.Service) *controller.Controller {
 		svc = &mock.UpCloudServiceMock{StorageSize: 10, CloneStorageSize: 10, VolumeUUIDExists: true}
 	}
 
-	c, _ := controller.NewController(svc, "fi-hel2", 10, logrus.New().WithField("package", "controller_test"))
+	c, _ := controller.NewController(svc, []string{"fi-hel2", "fi-hel1"}, 10, logrus.New().WithField("package", "controller_test"), controller.WithCapacityTracking(true))
 	return c
 }
 
@@ -90,6 +96,25 @@ func TestController_ControllerPublishVolume(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "Test Publish Volume Read Only",
+			args: args{
+				req: &csi.ControllerPublishVolumeRequest{
+					VolumeId: "test-volume-id",
+					NodeId:   "test-node-id",
+					Readonly: true,
+					VolumeCapability: &csi.VolumeCapability{
+						AccessType: &csi.VolumeCapability_Mount{
+							Mount: &csi.VolumeCapability_MountVolume{},
+						},
+						AccessMode: &csi.VolumeCapability_AccessMode{
+							Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+						},
+					},
+				},
+			},
+			wantErr: false,
+		},
 	}
 	for _, testCase := range tests {
 		tt := testCase
@@ -106,6 +131,14 @@ func TestController_ControllerPublishVolume(t *testing.T) {
 			}
 		})
 	}
+	t.Run("Test Publish Volume To Another Zone", func(t *testing.T) {
+		t.Parallel()
+		c := newController(&mock.UpCloudServiceMock{VolumeUUIDExists: true, StorageZone: "fi-hel2", ServerZone: "fi-hel1"})
+		_, err := c.ControllerPublishVolume(context.Background(), tests[0].args.req)
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Errorf("ControllerPublishVolume() should fail with FailedPrecondition, got %v", err)
+		}
+	})
 }
 
 func TestController_CreateVolume(t *testing.T) {
@@ -209,6 +242,52 @@ func TestController_CreateVolume(t *testing.T) {
 			volumeUUIDExists: true,
 			wantErr:          false,
 		},
+		{
+			name: "Test Read Only Volume From Snapshot",
+			args: args{
+				&csi.CreateVolumeRequest{
+					Name:               "testReadOnlyVolume",
+					VolumeCapabilities: readOnlyCaps(csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY),
+					VolumeContentSource: &csi.VolumeContentSource{
+						Type: &csi.VolumeContentSource_Snapshot{
+							Snapshot: &csi.VolumeContentSource_SnapshotSource{
+								SnapshotId: "snapshotID",
+							},
+						},
+					},
+				},
+			},
+			volumeNameExists: false,
+			volumeUUIDExists: true,
+			wantErr:          false,
+		},
+		{
+			name: "Test Read Only Volume Without Source",
+			args: args{
+				&csi.CreateVolumeRequest{
+					Name:               "testReadOnlyVolume",
+					VolumeCapabilities: readOnlyCaps(csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY),
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Test Multi Node Read Only Volume",
+			args: args{
+				&csi.CreateVolumeRequest{
+					Name:               "testReadOnlyVolume",
+					VolumeCapabilities: readOnlyCaps(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY),
+					VolumeContentSource: &csi.VolumeContentSource{
+						Type: &csi.VolumeContentSource_Snapshot{
+							Snapshot: &csi.VolumeContentSource_SnapshotSource{
+								SnapshotId: "snapshotID",
+							},
+						},
+					},
+				},
+			},
+			wantErr: true,
+		},
 	}
 	for _, testCase := range tests {
 		tt := testCase
@@ -218,6 +297,7 @@ func TestController_CreateVolume(t *testing.T) {
 				VolumeNameExists: tt.volumeNameExists,
 				VolumeUUIDExists: tt.volumeUUIDExists,
 				StorageSize:      10,
+				StorageZone:      "fi-hel2",
 				CloneStorageSize: 9, // set smaller size so that resize is triggered
 			})
 			gotResp, err := d.CreateVolume(context.Background(), tt.args.req)
@@ -225,6 +305,9 @@ func TestController_CreateVolume(t *testing.T) {
 				t.Errorf("CreateVolume() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
+			if tt.wantErr {
+				return
+			}
 			if gotResp.Volume.VolumeId == "" {
 				t.Error("volume ID should not be empty")
 				return
@@ -241,6 +324,317 @@ func TestController_CreateVolume(t *testing.T) {
 	}
 }
 
+func TestController_CreateVolume_Topology(t *testing.T) {
+	t.Parallel()
+	newRequest := func(preferred, requisite []string) *csi.CreateVolumeRequest {
+		r := &csi.CreateVolumeRequest{
+			Name:                      "testVolume",
+			VolumeCapabilities:        readOnlyCaps(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			AccessibilityRequirements: &csi.TopologyRequirement{},
+		}
+		for _, zone := range preferred {
+			r.AccessibilityRequirements.Preferred = append(r.AccessibilityRequirements.Preferred, &csi.Topology{Segments: map[string]string{topology.ZoneKey: zone}})
+		}
+		for _, zone := range requisite {
+			r.AccessibilityRequirements.Requisite = append(r.AccessibilityRequirements.Requisite, &csi.Topology{Segments: map[string]string{topology.LegacyZoneKey: zone}})
+		}
+		return r
+	}
+	tests := []struct {
+		name     string
+		req      *csi.CreateVolumeRequest
+		wantZone string
+		wantErr  bool
+	}{
+		{
+			name:     "default zone",
+			req:      newRequest(nil, nil),
+			wantZone: "fi-hel2",
+		},
+		{
+			name:     "preferred zone",
+			req:      newRequest([]string{"de-fra1", "fi-hel1"}, []string{"fi-hel2", "fi-hel1", "de-fra1"}),
+			wantZone: "fi-hel1",
+		},
+		{
+			name:     "requisite zone",
+			req:      newRequest(nil, []string{"de-fra1", "fi-hel1"}),
+			wantZone: "fi-hel1",
+		},
+		{
+			name:    "zone not served",
+			req:     newRequest(nil, []string{"de-fra1"}),
+			wantErr: true,
+		},
+	}
+	for _, testCase := range tests {
+		tt := testCase
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			c := newController(&mock.UpCloudServiceMock{StorageSize: 1})
+			got, err := c.CreateVolume(context.Background(), tt.req)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CreateVolume() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if zone := topology.Zone(got.Volume.AccessibleTopology[0].Segments); zone != tt.wantZone {
+				t.Errorf("volume zone mismatch want %s got %s", tt.wantZone, zone)
+			}
+		})
+	}
+}
+
+func TestController_CreateVolume_ExistsInOtherZone(t *testing.T) {
+	t.Parallel()
+	req := &csi.CreateVolumeRequest{
+		Name:               "testVolume",
+		VolumeCapabilities: readOnlyCaps(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: giB},
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{{Segments: topology.Segments("fi-hel1")}},
+		},
+	}
+	svc := &mock.UpCloudServiceMock{VolumeNameExists: true, StorageSize: 1, StorageZone: "fi-hel2", StorageState: "online"}
+	c := newController(svc)
+
+	_, err := c.CreateVolume(context.Background(), req)
+	if status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("CreateVolume() should fail with AlreadyExists when volume exists in another zone, got %v", err)
+	}
+
+	svc.StorageZone = "fi-hel1"
+	got, err := c.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("CreateVolume() error = %v", err)
+	}
+	if zone := topology.Zone(got.Volume.AccessibleTopology[0].Segments); zone != "fi-hel1" {
+		t.Errorf("volume zone mismatch want fi-hel1 got %s", zone)
+	}
+}
+
+func TestController_CreateVolume_CrossZone(t *testing.T) {
+	t.Parallel()
+	req := &csi.CreateVolumeRequest{
+		Name:               "testCrossZoneVolume",
+		VolumeCapabilities: readOnlyCaps(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 20 * giB},
+		Parameters:         map[string]string{"labels": "env=dr"},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{
+					SnapshotId: "snapshotID",
+				},
+			},
+		},
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{{Segments: topology.Segments("fi-hel1")}},
+		},
+	}
+	svc := &mock.UpCloudServiceMock{VolumeUUIDExists: true, StorageSize: 10, CloneStorageSize: 10, StorageZone: "fi-hel2"}
+	c := newController(svc)
+
+	// copy is started and CO is expected to retry
+	_, err := c.CreateVolume(context.Background(), req)
+	if status.Code(err) != codes.Aborted {
+		t.Fatalf("CreateVolume() should fail with Aborted while volume is copied, got %v", err)
+	}
+
+	// copy is still in progress
+	svc.VolumeNameExists = true
+	svc.StorageZone = "fi-hel1"
+	svc.StorageState = "maintenance"
+	_, err = c.CreateVolume(context.Background(), req)
+	if status.Code(err) != codes.Aborted {
+		t.Fatalf("CreateVolume() should fail with Aborted while volume is copied, got %v", err)
+	}
+
+	// copy is finished, volume is resized and labeled
+	svc.StorageState = "online"
+	got, err := c.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("CreateVolume() error = %v", err)
+	}
+	if got.Volume.CapacityBytes != 20*giB {
+		t.Errorf("volume capacity mismatch want %d got %d", 20*giB, got.Volume.CapacityBytes)
+	}
+	if zone := topology.Zone(got.Volume.AccessibleTopology[0].Segments); zone != "fi-hel1" {
+		t.Errorf("volume zone mismatch want fi-hel1 got %s", zone)
+	}
+	if want := []upcloud.Label{{Key: "env", Value: "dr"}}; !reflect.DeepEqual(svc.StorageLabels, want) {
+		t.Errorf("labels mismatch want %+v got %+v", want, svc.StorageLabels)
+	}
+}
+
+func TestController_CreateVolume_LUKS(t *testing.T) {
+	t.Parallel()
+	newRequest := func(accessType *csi.VolumeCapability) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name:               "testVolume",
+			VolumeCapabilities: []*csi.VolumeCapability{accessType},
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: 10 * giB},
+			Parameters:         map[string]string{"encryption": "luks"},
+		}
+	}
+	accessMode := &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER}
+	d := newController(&mock.UpCloudServiceMock{StorageSize: 10, StorageZone: "fi-hel2"})
+
+	resp, err := d.CreateVolume(context.Background(), newRequest(&csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: accessMode,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"encryption": "luks"}; !reflect.DeepEqual(want, resp.GetVolume().GetVolumeContext()) {
+		t.Errorf("volume context mismatch want %v got %v", want, resp.GetVolume().GetVolumeContext())
+	}
+
+	_, err = d.CreateVolume(context.Background(), newRequest(&csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: accessMode,
+	}))
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("want InvalidArgument for LUKS block volume, got %v", err)
+	}
+}
+
+func TestController_CreateVolume_MkfsOptions(t *testing.T) {
+	t.Parallel()
+	newRequest := func(fsType string, parameters map[string]string) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name: "testVolume",
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsType}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 10 * giB},
+			Parameters:    parameters,
+		}
+	}
+	d := newController(&mock.UpCloudServiceMock{StorageSize: 10, StorageZone: "fi-hel2"})
+
+	resp, err := d.CreateVolume(context.Background(), newRequest("xfs", map[string]string{
+		"tier":        "maxiops",
+		"xfs.reflink": "true",
+		"mkfsOptions": "-K",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"xfs.reflink": "true", "mkfsOptions": "-K"}
+	if !reflect.DeepEqual(want, resp.GetVolume().GetVolumeContext()) {
+		t.Errorf("volume context mismatch want %v got %v", want, resp.GetVolume().GetVolumeContext())
+	}
+
+	_, err = d.CreateVolume(context.Background(), newRequest("ext4", map[string]string{"xfs.reflink": "true"}))
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("want InvalidArgument for XFS parameter with ext4 filesystem, got %v", err)
+	}
+}
+
+func TestController_CreateVolume_FsCheck(t *testing.T) {
+	t.Parallel()
+	d := newController(&mock.UpCloudServiceMock{StorageSize: 10, StorageZone: "fi-hel2"})
+	newRequest := func(fsCheck string) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name:               "testVolume",
+			VolumeCapabilities: readOnlyCaps(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: 10 * giB},
+			Parameters:         map[string]string{"fsCheck": fsCheck},
+		}
+	}
+
+	resp, err := d.CreateVolume(context.Background(), newRequest("true"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.GetVolume().GetVolumeContext()["fsCheck"]; got != "true" {
+		t.Errorf("want fsCheck in volume context, got %q", got)
+	}
+
+	_, err = d.CreateVolume(context.Background(), newRequest("always"))
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("want InvalidArgument for invalid fsCheck value, got %v", err)
+	}
+}
+
+func readOnlyCaps(mode csi.VolumeCapability_AccessMode_Mode) []*csi.VolumeCapability {
+	return []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: mode,
+			},
+		},
+	}
+}
+
+func TestController_ResumeOperations(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		svc         *mock.UpCloudServiceMock
+		wantSize    int
+		wantLabels  []upcloud.Label
+		wantDeleted int
+	}{
+		{
+			name:       "resize and label interrupted clone",
+			svc:        &mock.UpCloudServiceMock{VolumeNameExists: true, StorageSize: 10, StorageState: upcloud.StorageStateOnline},
+			wantSize:   20,
+			wantLabels: []upcloud.Label{{Key: "team", Value: "a"}},
+		},
+		{
+			name:        "roll back failed clone",
+			svc:         &mock.UpCloudServiceMock{VolumeNameExists: true, StorageSize: 10, StorageState: upcloud.StorageStateError},
+			wantDeleted: 1,
+		},
+		{
+			name: "storage not created",
+			svc:  &mock.UpCloudServiceMock{VolumeNameExists: false},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			j := journal.NewMemoryJournal()
+			err := j.Put(context.Background(), journal.Entry{
+				Name:     "vol1",
+				SourceID: uuid.NewString(),
+				Zone:     "fi-hel2",
+				SizeGB:   20,
+				Labels:   []upcloud.Label{{Key: "team", Value: "a"}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, _ := controller.NewController(tt.svc, []string{"fi-hel2"}, 10, logrus.New().WithField("package", "controller_test"), controller.WithJournal(j))
+			if err := c.ResumeOperations(context.Background()); err != nil {
+				t.Fatalf("ResumeOperations() failed: %v", err)
+			}
+			if tt.svc.ResizedStorageSize != tt.wantSize {
+				t.Errorf("storage size want %d got %d", tt.wantSize, tt.svc.ResizedStorageSize)
+			}
+			if !reflect.DeepEqual(tt.svc.StorageLabels, tt.wantLabels) {
+				t.Errorf("storage labels want %v got %v", tt.wantLabels, tt.svc.StorageLabels)
+			}
+			if len(tt.svc.DeletedStorageUUIDs) != tt.wantDeleted {
+				t.Errorf("deleted storages want %d got %d", tt.wantDeleted, len(tt.svc.DeletedStorageUUIDs))
+			}
+			if pending, _ := j.Pending(context.Background()); len(pending) > 0 {
+				t.Errorf("journal should be empty, got %+v", pending)
+			}
+		})
+	}
+}
+
 func TestController_DeleteVolume(t *testing.T) {
 	t.Parallel()
 	type args struct {
@@ -280,6 +674,19 @@ func TestController_DeleteVolume(t *testing.T) {
 	}
 }
 
+func TestController_Delete_StorageBusy(t *testing.T) {
+	t.Parallel()
+	c := newController(&mock.UpCloudServiceMock{VolumeUUIDExists: true, StorageBackingUp: true})
+
+	// storage can't be deleted while backup is created, so CO is expected to retry
+	if _, err := c.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "testVolume"}); status.Code(err) != codes.Aborted {
+		t.Errorf("DeleteVolume() error = %v, want code %s", err, codes.Aborted)
+	}
+	if _, err := c.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: "01000000-0000-4000-8000-000000000001"}); status.Code(err) != codes.Aborted {
+		t.Errorf("DeleteSnapshot() error = %v, want code %s", err, codes.Aborted)
+	}
+}
+
 func TestController_ListVolumes(t *testing.T) {
 	t.Parallel()
 	type args struct {
@@ -319,66 +726,82 @@ func TestController_ListVolumes(t *testing.T) {
 
 func TestController_ControllerUnpublishVolume(t *testing.T) {
 	t.Parallel()
+	serverUUIDs := []string{uuid.NewString(), uuid.NewString()}
 	type args struct {
 		req *csi.ControllerUnpublishVolumeRequest
 	}
 	tests := []struct {
-		name    string
-		args    args
-		want    *csi.ControllerUnpublishVolumeResponse
-		wantErr bool
+		name         string
+		args         args
+		wantDetached int
+		wantErr      bool
 	}{
 		{
 			name: "Test Unpublish Volume",
 			args: args{
 				&csi.ControllerUnpublishVolumeRequest{
 					VolumeId: "testVolume",
+					NodeId:   "node-1",
 				},
 			},
-			wantErr: false,
+			wantDetached: 1,
+			wantErr:      false,
+		},
+		{
+			name: "Test Unpublish Volume from all nodes",
+			args: args{
+				&csi.ControllerUnpublishVolumeRequest{
+					VolumeId: "testVolume",
+				},
+			},
+			wantDetached: len(serverUUIDs),
+			wantErr:      false,
 		},
 	}
 	for _, testCase := range tests {
 		tt := testCase
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
-			c := newController(nil)
+			svc := &mock.UpCloudServiceMock{StorageSize: 10, VolumeUUIDExists: true, ServerUUIDs: serverUUIDs}
+			c := newController(svc)
 			_, err := c.ControllerUnpublishVolume(context.Background(), tt.args.req)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("ControllerUnpublishVolume() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
+			if len(svc.DetachedServerUUIDs) != tt.wantDetached {
+				t.Errorf("detached servers count mismatch want %d got %d", tt.wantDetached, len(svc.DetachedServerUUIDs))
+			}
 		})
 	}
 }
 
 func TestController_ValidateVolumeCapabilities(t *testing.T) {
 	t.Parallel()
-	type args struct {
-		req *csi.ValidateVolumeCapabilitiesRequest
-	}
 	tests := []struct {
-		name    string
-		args    args
-		want    *csi.VolumeCapability_AccessMode
-		wantErr bool
+		name          string
+		mode          csi.VolumeCapability_AccessMode_Mode
+		wantConfirmed bool
 	}{
 		{
-			name: "Test ValidateVolumeCapabilities",
-			args: args{
-				&csi.ValidateVolumeCapabilitiesRequest{
-					VolumeId: "testVolume",
-					VolumeCapabilities: []*csi.VolumeCapability{
-						{
-							AccessType: &csi.VolumeCapability_Mount{
-								Mount: &csi.VolumeCapability_MountVolume{},
-							},
-						},
-					},
-				},
-			},
-			want:    &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
-			wantErr: false,
+			name:          "Test ValidateVolumeCapabilities SINGLE_NODE_WRITER",
+			mode:          csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			wantConfirmed: true,
+		},
+		{
+			name:          "Test ValidateVolumeCapabilities SINGLE_NODE_SINGLE_WRITER",
+			mode:          csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+			wantConfirmed: true,
+		},
+		{
+			name:          "Test ValidateVolumeCapabilities SINGLE_NODE_MULTI_WRITER",
+			mode:          csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+			wantConfirmed: true,
+		},
+		{
+			name:          "Test ValidateVolumeCapabilities MULTI_NODE_MULTI_WRITER",
+			mode:          csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+			wantConfirmed: false,
 		},
 	}
 	for _, testCase := range tests {
@@ -386,13 +809,30 @@ func TestController_ValidateVolumeCapabilities(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
 			c := newController(nil)
-			got, err := c.ValidateVolumeCapabilities(context.Background(), tt.args.req)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("ValidateVolumeCapabilities() error = %v, wantErr %v", err, tt.wantErr)
+			want := &csi.VolumeCapability_AccessMode{Mode: tt.mode}
+			got, err := c.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId: "testVolume",
+				VolumeCapabilities: []*csi.VolumeCapability{
+					{
+						AccessType: &csi.VolumeCapability_Mount{
+							Mount: &csi.VolumeCapability_MountVolume{},
+						},
+						AccessMode: want,
+					},
+				},
+			})
+			if err != nil {
+				t.Errorf("ValidateVolumeCapabilities() error = %v", err)
+				return
+			}
+			if !tt.wantConfirmed {
+				if got.Confirmed != nil || got.Message == "" {
+					t.Errorf("ValidateVolumeCapabilities() should not confirm unsupported access mode, got = %v", got)
+				}
 				return
 			}
-			if !reflect.DeepEqual(got.Confirmed.VolumeCapabilities[0].AccessMode, tt.want) {
-				t.Errorf("ValidateVolumeCapabilities() got = %v, want %v", got, tt.want)
+			if !proto.Equal(got.Confirmed.VolumeCapabilities[0].AccessMode, want) {
+				t.Errorf("ValidateVolumeCapabilities() got = %v, want %v", got, want)
 			}
 		})
 	}
@@ -419,6 +859,31 @@ func TestController_ExpandVolume(t *testing.T) {
 	}
 }
 
+func TestController_ExpandVolume_Online(t *testing.T) {
+	t.Parallel()
+	c := newController(&mock.UpCloudServiceMock{StorageSize: 10, VolumeUUIDExists: true, ServerUUIDs: []string{uuid.NewString()}})
+	wantBytes := int64(30 * giB)
+	r, err := c.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+		VolumeId: "test-vol",
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: wantBytes,
+		},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		},
+	})
+	if err != nil {
+		t.Errorf("ControllerExpandVolume error = %v", err)
+		return
+	}
+	if r.CapacityBytes != wantBytes {
+		t.Errorf("CapacityBytes failed want %d got %d", wantBytes, r.CapacityBytes)
+	}
+	if !r.NodeExpansionRequired {
+		t.Error("node expansion should be required when published volume is expanded")
+	}
+}
+
 func TestDriver_CreateSnapshot(t *testing.T) {
 	t.Parallel()
 
@@ -426,6 +891,7 @@ func TestDriver_CreateSnapshot(t *testing.T) {
 		req          *csi.CreateSnapshotRequest
 		volExists    bool
 		volBackingUp bool
+		noBackup     bool
 	}
 	tests := []struct {
 		name    string
@@ -434,17 +900,30 @@ func TestDriver_CreateSnapshot(t *testing.T) {
 		wantErr bool
 	}{
 		{
-			name: "test without volume",
+			name: "test without backup",
 			args: args{
 				req: &csi.CreateSnapshotRequest{
 					SourceVolumeId: uuid.NewString(),
 					Name:           "snappy",
 				},
-				volExists:    false,
+				volExists:    true,
 				volBackingUp: false,
+				noBackup:     true,
 			},
 			wantErr: false,
 		},
+		{
+			name: "test without volume want err",
+			args: args{
+				req: &csi.CreateSnapshotRequest{
+					SourceVolumeId: uuid.NewString(),
+					Name:           "snappy",
+				},
+				volExists:    false,
+				volBackingUp: false,
+			},
+			wantErr: true,
+		},
 		{
 			name: "test with volume",
 			args: args{
@@ -491,6 +970,7 @@ func TestDriver_CreateSnapshot(t *testing.T) {
 			d := newController(&mock.UpCloudServiceMock{
 				VolumeUUIDExists: tt.args.volExists,
 				StorageBackingUp: tt.args.volBackingUp,
+				BackupNotFound:   tt.args.noBackup,
 				SourceVolumeID:   tt.args.req.SourceVolumeId,
 			})
 
@@ -505,3 +985,212 @@ func TestDriver_CreateSnapshot(t *testing.T) {
 		})
 	}
 }
+
+func TestController_CreateSnapshot_ReadyToUse(t *testing.T) {
+	t.Parallel()
+
+	req := &csi.CreateSnapshotRequest{SourceVolumeId: uuid.NewString(), Name: "snappy"}
+	tests := []struct {
+		name          string
+		backupExists  bool
+		state         string
+		wantReady     bool
+		wantErrorCode codes.Code
+	}{
+		{name: "new backup is returned without waiting", backupExists: false, wantReady: false, wantErrorCode: codes.OK},
+		{name: "backup in progress", backupExists: true, state: upcloud.StorageStateMaintenance, wantReady: false, wantErrorCode: codes.OK},
+		{name: "backup ready", backupExists: true, state: upcloud.StorageStateOnline, wantReady: true, wantErrorCode: codes.OK},
+		{name: "backup failed", backupExists: true, state: upcloud.StorageStateError, wantErrorCode: codes.Internal},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			d := newController(&mock.UpCloudServiceMock{
+				VolumeUUIDExists: true,
+				BackupNotFound:   !tt.backupExists,
+				SourceVolumeID:   req.SourceVolumeId,
+				StorageState:     tt.state,
+			})
+			r, err := d.CreateSnapshot(context.Background(), req)
+			if status.Code(err) != tt.wantErrorCode {
+				t.Fatalf("CreateSnapshot() error code want %s got %s", tt.wantErrorCode, status.Code(err))
+			}
+			if r.GetSnapshot().GetReadyToUse() != tt.wantReady {
+				t.Errorf("CreateSnapshot() ReadyToUse want %t got %t", tt.wantReady, r.GetSnapshot().GetReadyToUse())
+			}
+		})
+	}
+}
+
+func TestController_ControllerGetVolume(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name         string
+		svc          *mock.UpCloudServiceMock
+		wantNodes    int
+		wantAbnormal bool
+		wantErr      bool
+	}{
+		{
+			name:         "volume is online and attached",
+			svc:          &mock.UpCloudServiceMock{VolumeUUIDExists: true, StorageSize: 10, StorageState: "online", ServerUUIDs: []string{uuid.NewString()}},
+			wantNodes:    1,
+			wantAbnormal: false,
+		},
+		{
+			name:         "volume is in error state",
+			svc:          &mock.UpCloudServiceMock{VolumeUUIDExists: true, StorageSize: 10, StorageState: "error"},
+			wantAbnormal: true,
+		},
+		{
+			name:         "volume is attached to missing server",
+			svc:          &mock.UpCloudServiceMock{VolumeUUIDExists: true, StorageSize: 10, StorageState: "online", ServerUUIDs: []string{uuid.NewString()}, ServerNotFound: true},
+			wantAbnormal: true,
+		},
+		{
+			name:    "volume not found",
+			svc:     &mock.UpCloudServiceMock{VolumeUUIDExists: false},
+			wantErr: true,
+		},
+	}
+	for _, testCase := range tests {
+		tt := testCase
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			c := newController(tt.svc)
+			got, err := c.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: "test-volume-id"})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ControllerGetVolume() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.Volume.CapacityBytes != 10*giB {
+				t.Errorf("volume capacity mismatch want %d got %d", 10*giB, got.Volume.CapacityBytes)
+			}
+			if len(got.Status.PublishedNodeIds) != tt.wantNodes {
+				t.Errorf("published node IDs mismatch want %d got %d", tt.wantNodes, len(got.Status.PublishedNodeIds))
+			}
+			if got.Status.VolumeCondition.Abnormal != tt.wantAbnormal {
+				t.Errorf("volume condition mismatch want abnormal %t got %+v", tt.wantAbnormal, got.Status.VolumeCondition)
+			}
+		})
+	}
+}
+
+func TestController_ControllerModifyVolume(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name       string
+		svc        *mock.UpCloudServiceMock
+		parameters  map[string]string
+		wantLabels  []upcloud.Label
+		wantDeleted []string
+		wantErr     bool
+	}{
+		{
+			name:       "update labels",
+			svc:        &mock.UpCloudServiceMock{VolumeUUIDExists: true, StorageTier: "maxiops", StorageLabels: []upcloud.Label{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}}},
+			parameters: map[string]string{"labels": "b=3,c=4", "tier": "maxiops"},
+			wantLabels: []upcloud.Label{{Key: "a", Value: "1"}, {Key: "b", Value: "3"}, {Key: "c", Value: "4"}},
+		},
+		{
+			name:        "change tier",
+			svc:         &mock.UpCloudServiceMock{VolumeUUIDExists: true, StorageTier: "maxiops"},
+			parameters:  map[string]string{"tier": "hdd"},
+			wantDeleted: []string{"test-volume-id"},
+		},
+		{
+			name:       "change tier of attached volume",
+			svc:        &mock.UpCloudServiceMock{VolumeUUIDExists: true, StorageTier: "maxiops", ServerUUIDs: []string{"test-server-uuid"}},
+			parameters: map[string]string{"tier": "hdd"},
+			wantErr:    true,
+		},
+		{
+			name:       "invalid labels",
+			svc:        &mock.UpCloudServiceMock{VolumeUUIDExists: true},
+			parameters: map[string]string{"labels": "a"},
+			wantErr:    true,
+		},
+		{
+			name:       "reserved label",
+			svc:        &mock.UpCloudServiceMock{VolumeUUIDExists: true},
+			parameters: map[string]string{"labels": "csi_encryption=none"},
+			wantErr:    true,
+		},
+		{
+			name:       "immutable parameter",
+			svc:        &mock.UpCloudServiceMock{VolumeUUIDExists: true},
+			parameters: map[string]string{"encryption": "data-at-rest"},
+			wantErr:    true,
+		},
+		{
+			name:       "volume not found",
+			svc:        &mock.UpCloudServiceMock{VolumeUUIDExists: false},
+			parameters: map[string]string{"labels": "a=1"},
+			wantErr:    true,
+		},
+	}
+	for _, testCase := range tests {
+		tt := testCase
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			c := newController(tt.svc)
+			_, err := c.ControllerModifyVolume(context.Background(), &csi.ControllerModifyVolumeRequest{
+				VolumeId:          "test-volume-id",
+				MutableParameters: tt.parameters,
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ControllerModifyVolume() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(tt.svc.StorageLabels, tt.wantLabels) {
+				t.Errorf("labels mismatch want %+v got %+v", tt.wantLabels, tt.svc.StorageLabels)
+			}
+			if !reflect.DeepEqual(tt.svc.DeletedStorageUUIDs, tt.wantDeleted) {
+				t.Errorf("deleted storages mismatch want %+v got %+v", tt.wantDeleted, tt.svc.DeletedStorageUUIDs)
+			}
+		})
+	}
+}
+
+func TestController_GetCapacity(t *testing.T) {
+	t.Parallel()
+	c := newController(&mock.UpCloudServiceMock{StorageQuota: 5000})
+	got, err := c.GetCapacity(context.Background(), &csi.GetCapacityRequest{
+		Parameters: map[string]string{"tier": "hdd"},
+		AccessibleTopology: &csi.Topology{
+			Segments: map[string]string{"region": "fi-hel2"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("GetCapacity() error = %v", err)
+	}
+	if want := int64(5000 * giB); got.AvailableCapacity != want {
+		t.Errorf("available capacity mismatch want %d got %d", want, got.AvailableCapacity)
+	}
+	if want := int64(4096 * giB); got.MaximumVolumeSize.GetValue() != want {
+		t.Errorf("maximum volume size mismatch want %d got %d", want, got.MaximumVolumeSize.GetValue())
+	}
+
+	got, err = c.GetCapacity(context.Background(), &csi.GetCapacityRequest{
+		AccessibleTopology: &csi.Topology{
+			Segments: map[string]string{"region": "de-fra1"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("GetCapacity() error = %v", err)
+	}
+	if got.AvailableCapacity != 0 {
+		t.Errorf("available capacity of zone not served by the controller should be zero, got %d", got.AvailableCapacity)
+	}
+
+	if _, err := c.GetCapacity(context.Background(), &csi.GetCapacityRequest{Parameters: map[string]string{"tier": "ssd"}}); err == nil {
+		t.Error("GetCapacity() should fail with unknown tier")
+	}
+}
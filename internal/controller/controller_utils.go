@@ -1,12 +1,17 @@
 package controller
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"strings"
 
+	"github.com/UpCloudLtd/upcloud-csi/internal/logger"
+	"github.com/UpCloudLtd/upcloud-csi/internal/service"
+	"github.com/UpCloudLtd/upcloud-csi/internal/tracing"
+	"github.com/UpCloudLtd/upcloud-csi/internal/volumecontext"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
 	"github.com/container-storage-interface/spec/lib/go/csi"
-	"github.com/google/uuid"
 
 	"k8s.io/apimachinery/pkg/util/sets"
 )
@@ -29,9 +34,29 @@ const (
 	// defaultVolumeSize is used when the user did not provide a size or
 	// the size they provided did not satisfy our requirements.
 	defaultVolumeSize = 1 * giB
+
+	// encryptionDataAtRest is encryption parameter value of storage encrypted at rest by UpCloud.
+	encryptionDataAtRest = "data-at-rest"
+
+	// encryptionLabelKey is storage label that records encryption done by the node, e.g. LUKS, which isn't visible
+	// in storage details. Label is used to inherit encryption when volume is created from a snapshot or volume.
+	encryptionLabelKey = "csi_encryption"
+
+	// volumeIDLabelKey is storage label that records the volume ID when storage created with the volume has been
+	// replaced by a copy, e.g. to change the storage tier. Volume ID is immutable, so it's the UUID of the first storage.
+	volumeIDLabelKey = "csi_volume_id"
+
+	// replacesLabelKey is storage label that records UUID of the storage that the copy replaces. Copy is used as
+	// the volume storage only after the storage it replaces has been deleted.
+	replacesLabelKey = "csi_replaces"
 )
 
-var supportedAccessMode = &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER} //nolint: gochecknoglobals // supportedAccessMode is readonly variable
+var supportedAccessModes = []csi.VolumeCapability_AccessMode_Mode{ //nolint: gochecknoglobals // supportedAccessModes is readonly variable
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+}
 
 type storageRange struct {
 	requiredBytes int64
@@ -129,8 +154,12 @@ func displayByteString(bytes int64) string {
 func validateCapabilities(capacities []*csi.VolumeCapability) []string {
 	violations := sets.NewString()
 	for _, capacity := range capacities {
-		if capacity.GetAccessMode().GetMode() != supportedAccessMode.GetMode() {
-			violations.Insert(fmt.Sprintf("unsupported access mode %s", capacity.GetAccessMode().GetMode().String()))
+		mode := capacity.GetAccessMode().GetMode()
+		switch {
+		case isMultiNodeAccessMode(mode):
+			violations.Insert(fmt.Sprintf("unsupported access mode %s, storage can be attached to only one node at a time", mode.String()))
+		case !isSupportedAccessMode(mode):
+			violations.Insert(fmt.Sprintf("unsupported access mode %s", mode.String()))
 		}
 
 		accessType := capacity.GetAccessType()
@@ -145,14 +174,94 @@ func validateCapabilities(capacities []*csi.VolumeCapability) []string {
 	return violations.List()
 }
 
-func isValidUUID(s string) bool {
-	_, err := uuid.Parse(s)
-	return err == nil
+func isSupportedAccessMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	for _, m := range supportedAccessModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// isMultiNodeAccessMode checks if access mode requires publishing the volume to several nodes at the same time.
+// Multi-node access modes, including MULTI_NODE_READER_ONLY, are not supported as UpCloud storage can be attached
+// to only one server at a time.
+func isMultiNodeAccessMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	switch mode {
+	case csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+		return true
+	default:
+		return false
+	}
 }
 
 func isValidStorageUUID(s string) bool {
-	if isValidUUID(s) {
+	if service.IsValidUUID(s) {
 		return strings.HasPrefix(s, "01")
 	}
 	return false
 }
+
+// volumeCondition returns condition of the volume based on backing storage state and servers that storage is attached to.
+// missingServers contains UUIDs of servers that storage is attached to, but which can't be found.
+func volumeCondition(volume *upcloud.StorageDetails, missingServers []string) *csi.VolumeCondition {
+	switch volume.State {
+	case upcloud.StorageStateError, upcloud.StorageStateMaintenance:
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("backing storage is in state %s", volume.State),
+		}
+	}
+	if len(missingServers) > 0 {
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("backing storage is attached to server(s) that no longer exist: %s", strings.Join(missingServers, ", ")),
+		}
+	}
+	return &csi.VolumeCondition{
+		Abnormal: false,
+		Message:  fmt.Sprintf("backing storage is in state %s", volume.State),
+	}
+}
+
+// publishContext returns publish context that passes UUID of the attached storage, correlation ID and trace context to the node.
+func publishContext(ctx context.Context, storageUUID string) map[string]string {
+	return tracing.InjectPublishContext(ctx, map[string]string{
+		string(logger.CtxCorrelationIDKey): logger.ContextCorrelationID(ctx),
+		volumecontext.StorageUUIDKey:       storageUUID,
+	})
+}
+
+// storageVolumeID returns ID of the volume that the storage belongs to.
+func storageVolumeID(s *upcloud.Storage) string {
+	if volumeID := labelValue(s.Labels, volumeIDLabelKey); volumeID != "" {
+		return volumeID
+	}
+	return s.UUID
+}
+
+// snapshotSourceVolumeID returns ID of the volume that the snapshot was taken from.
+func snapshotSourceVolumeID(s *upcloud.Storage) string {
+	if volumeID := labelValue(s.Labels, volumeIDLabelKey); volumeID != "" {
+		return volumeID
+	}
+	return s.Origin
+}
+
+// withoutPendingCopies filters out copies of storages that are in the list, i.e. copies that don't replace the original
+// storage yet as the original hasn't been deleted, e.g. while storage tier is being changed.
+func withoutPendingCopies(storages []upcloud.Storage) []upcloud.Storage {
+	uuids := make(map[string]bool, len(storages))
+	for _, s := range storages {
+		uuids[s.UUID] = true
+	}
+	r := make([]upcloud.Storage, 0, len(storages))
+	for _, s := range storages {
+		if replaces := labelValue(s.Labels, replacesLabelKey); replaces == "" || !uuids[replaces] {
+			r = append(r, s)
+		}
+	}
+	return r
+}
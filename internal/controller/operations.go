@@ -0,0 +1,95 @@
+package controller
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// operationResultTTL is how long result of finished operation is kept waiting for the retried call to pick it up.
+const operationResultTTL = 30 * time.Minute
+
+// operations tracks long-running operations (e.g. volume creation) so that operation is not started again
+// while the previous call is still waiting for it to finish. Operations run in background, so they are not
+// interrupted when CO gives up waiting and cancels the call.
+type operations struct {
+	mu  sync.Mutex
+	ops map[string]*operation
+}
+
+type operation struct {
+	req      proto.Message
+	done     chan struct{}
+	finished time.Time
+	resp     any
+	err      error
+}
+
+func newOperations() *operations {
+	return &operations{ops: make(map[string]*operation)}
+}
+
+// runOperation runs fn in background and waits for it to finish or for the call to be canceled.
+// If operation with the same key is already in progress, codes.Aborted error is returned immediately.
+// Result of an operation that finished after the call was canceled is returned to the next call with the same request.
+func runOperation[T any](ctx context.Context, o *operations, key string, req proto.Message, fn func(context.Context) (T, error)) (T, error) {
+	var empty T
+	o.mu.Lock()
+	o.purge()
+	op, ok := o.ops[key]
+	if ok {
+		select {
+		case <-op.done:
+			delete(o.ops, key)
+			if proto.Equal(op.req, req) {
+				o.mu.Unlock()
+				resp, _ := op.resp.(T)
+				return resp, op.err
+			}
+		default:
+			o.mu.Unlock()
+			return empty, status.Errorf(codes.Aborted, "operation %s is already in progress", key)
+		}
+	}
+	op = &operation{req: req, done: make(chan struct{})}
+	o.ops[key] = op
+	o.mu.Unlock()
+
+	go func() {
+		resp, err := fn(context.WithoutCancel(ctx))
+		o.mu.Lock()
+		op.resp, op.err, op.finished = resp, err, time.Now()
+		close(op.done)
+		o.mu.Unlock()
+	}()
+
+	select {
+	case <-op.done:
+		o.mu.Lock()
+		if o.ops[key] == op {
+			delete(o.ops, key)
+		}
+		o.mu.Unlock()
+		resp, _ := op.resp.(T)
+		return resp, op.err
+	case <-ctx.Done():
+		return empty, status.Errorf(codes.Aborted, "operation %s is in progress: %s", key, ctx.Err())
+	}
+}
+
+// purge removes results that were not picked up in time. Caller must hold the lock.
+func (o *operations) purge() {
+	for key, op := range o.ops {
+		select {
+		case <-op.done:
+			if time.Since(op.finished) > operationResultTTL {
+				delete(o.ops, key)
+			}
+		default:
+		}
+	}
+}
@@ -0,0 +1,450 @@
+package controller_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/UpCloudLtd/upcloud-csi/internal/controller"
+	"github.com/UpCloudLtd/upcloud-csi/internal/service/mock"
+	"github.com/UpCloudLtd/upcloud-csi/internal/topology"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestController_Scenario_CreatePublishSnapshotRestoreDelete(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	svc := mock.NewFakeService()
+	svc.Quota[upcloud.StorageTierMaxIOPS] = 100
+	node1 := svc.AddServer("node1", "fi-hel2")
+	svc.AddServer("node2", "fi-hel1")
+	c, err := controller.NewController(svc, []string{"fi-hel2", "fi-hel1"}, 10, logrus.New().WithField("package", "controller_test"), controller.WithCapacityTracking(true))
+	require.NoError(t, err)
+
+	mountCap := []*csi.VolumeCapability{{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}}
+
+	// injected API failure is returned and retried call succeeds
+	createReq := &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 10 << 30},
+		VolumeCapabilities: mountCap,
+		Parameters:         map[string]string{"tier": upcloud.StorageTierMaxIOPS},
+	}
+	svc.InjectFault("CreateStorage", mock.ErrFault)
+	_, err = c.CreateVolume(ctx, createReq)
+	require.Equal(t, codes.Internal, status.Code(err))
+	vol1, err := c.CreateVolume(ctx, createReq)
+	require.NoError(t, err)
+	volumeID := vol1.GetVolume().GetVolumeId()
+
+	// repeated call returns the same volume
+	vol, err := c.CreateVolume(ctx, createReq)
+	require.NoError(t, err)
+	assert.Equal(t, volumeID, vol.GetVolume().GetVolumeId())
+
+	capacity, err := c.GetCapacity(ctx, &csi.GetCapacityRequest{Parameters: createReq.Parameters})
+	require.NoError(t, err)
+	// quota is shared with server root disks
+	assert.Equal(t, int64(100-10-2*10)<<30, capacity.GetAvailableCapacity())
+
+	_, err = c.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: volumeID, NodeId: "node1", VolumeCapability: mountCap[0]})
+	require.NoError(t, err)
+	server, err := svc.GetServerByUUID(ctx, node1.UUID)
+	require.NoError(t, err)
+	assert.Len(t, server.StorageDevices, 2)
+
+	// snapshot is not ready until backup is finished
+	snapReq := &csi.CreateSnapshotRequest{Name: "snap-1", SourceVolumeId: volumeID}
+	snap, err := c.CreateSnapshot(ctx, snapReq)
+	require.NoError(t, err)
+	assert.False(t, snap.GetSnapshot().GetReadyToUse())
+	snap, err = c.CreateSnapshot(ctx, snapReq)
+	require.NoError(t, err)
+	assert.True(t, snap.GetSnapshot().GetReadyToUse())
+	snapshotID := snap.GetSnapshot().GetSnapshotId()
+
+	// restore snapshot to a bigger volume
+	restoreReq := &csi.CreateVolumeRequest{
+		Name:               "pvc-2",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 20 << 30},
+		VolumeCapabilities: mountCap,
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshotID}},
+		},
+	}
+	vol2, err := c.CreateVolume(ctx, restoreReq)
+	require.NoError(t, err)
+	assert.Equal(t, "snapshot", vol2.GetVolume().GetVolumeContext()["contentSource"])
+	restored, err := svc.GetStorageByUUID(ctx, vol2.GetVolume().GetVolumeId())
+	require.NoError(t, err)
+	assert.Equal(t, 20, restored.Size)
+	assert.Equal(t, upcloud.StorageStateOnline, restored.State)
+
+	// volume can't be attached to node in another zone or to node without free device slots
+	_, err = c.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: restored.UUID, NodeId: "node2", VolumeCapability: mountCap[0]})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	svc.SetMaxStorageDevices(2)
+	_, err = c.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: restored.UUID, NodeId: "node1", VolumeCapability: mountCap[0]})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	// attached volume can't be deleted
+	_, err = c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	require.Error(t, err)
+	_, err = c.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeID, NodeId: "node1"})
+	require.NoError(t, err)
+
+	_, err = c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	require.NoError(t, err)
+	_, err = c.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: snapshotID})
+	require.NoError(t, err)
+	_, err = c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: restored.UUID})
+	require.NoError(t, err)
+
+	for _, s := range svc.Storages() {
+		assert.Equal(t, upcloud.StorageTypeDisk, s.Type, "only server root disks should be left")
+	}
+}
+
+func TestController_Scenario_DeleteWhileBackupInProgress(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	svc := mock.NewFakeService()
+	svc.TransitionDelay = time.Hour
+	vol := svc.AddStorage("pvc-1", "fi-hel2", 10)
+	c, err := controller.NewController(svc, []string{"fi-hel2"}, 10, logrus.New().WithField("package", "controller_test"), controller.WithCapacityTracking(true))
+	require.NoError(t, err)
+
+	snap, err := c.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snap-1", SourceVolumeId: vol.UUID})
+	require.NoError(t, err)
+	require.False(t, snap.GetSnapshot().GetReadyToUse())
+
+	// deletes are aborted instead of waiting for the backup, so that CO retries them later
+	_, err = c.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: snap.GetSnapshot().GetSnapshotId()})
+	require.Equal(t, codes.Aborted, status.Code(err))
+	_, err = c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: vol.UUID})
+	require.Equal(t, codes.Aborted, status.Code(err))
+	assert.Len(t, svc.Storages(), 2)
+}
+
+func TestController_Scenario_CrossZoneRestore(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	svc := mock.NewFakeService()
+	svc.TransitionDelay = 50 * time.Millisecond
+	c, err := controller.NewController(svc, []string{"fi-hel2", "fi-hel1"}, 10, logrus.New().WithField("package", "controller_test"))
+	require.NoError(t, err)
+
+	src := svc.AddStorage("pvc-src", "fi-hel2", 10)
+	req := &csi.CreateVolumeRequest{
+		Name:          "pvc-dst",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 15 << 30},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+		Parameters: map[string]string{"labels": "team=a"},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: src.UUID}},
+		},
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{{Segments: topology.Segments("fi-hel1")}},
+		},
+	}
+
+	// copy to another zone is started and call is aborted while copy is in progress
+	_, err = c.CreateVolume(ctx, req)
+	require.Equal(t, codes.Aborted, status.Code(err))
+	_, err = c.CreateVolume(ctx, req)
+	require.Equal(t, codes.Aborted, status.Code(err))
+
+	var resp *csi.CreateVolumeResponse
+	require.Eventually(t, func() bool {
+		resp, err = c.CreateVolume(ctx, req)
+		return err == nil
+	}, 5*time.Second, 20*time.Millisecond)
+
+	vol, err := svc.GetStorageByUUID(ctx, resp.GetVolume().GetVolumeId())
+	require.NoError(t, err)
+	assert.Equal(t, "fi-hel1", vol.Zone)
+	assert.Equal(t, 15, vol.Size)
+	assert.Equal(t, []upcloud.Label{{Key: "team", Value: "a"}}, vol.Labels)
+}
+
+func TestController_Scenario_EncryptedRestore(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	svc := mock.NewFakeService()
+	c, err := controller.NewController(svc, []string{"fi-hel2"}, 10, logrus.New().WithField("package", "controller_test"))
+	require.NoError(t, err)
+
+	mountCap := []*csi.VolumeCapability{{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}}
+	createVolume := func(name, encryption string, src *csi.VolumeContentSource) (*upcloud.StorageDetails, error) {
+		req := &csi.CreateVolumeRequest{
+			Name:                name,
+			CapacityRange:       &csi.CapacityRange{RequiredBytes: 10 << 30},
+			VolumeCapabilities:  mountCap,
+			VolumeContentSource: src,
+		}
+		if encryption != "" {
+			req.Parameters = map[string]string{"encryption": encryption}
+		}
+		resp, err := c.CreateVolume(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return svc.GetStorageByUUID(ctx, resp.GetVolume().GetVolumeId())
+	}
+	snapshotSource := func(volumeID string) *csi.VolumeContentSource {
+		snapReq := &csi.CreateSnapshotRequest{Name: "snap-" + volumeID, SourceVolumeId: volumeID}
+		_, err := c.CreateSnapshot(ctx, snapReq)
+		require.NoError(t, err)
+		snap, err := c.CreateSnapshot(ctx, snapReq)
+		require.NoError(t, err)
+		require.True(t, snap.GetSnapshot().GetReadyToUse())
+		return &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snap.GetSnapshot().GetSnapshotId()}},
+		}
+	}
+
+	encrypted, err := createVolume("pvc-encrypted", "data-at-rest", nil)
+	require.NoError(t, err)
+	require.True(t, encrypted.Encrypted.Bool())
+	plain, err := createVolume("pvc-plain", "", nil)
+	require.NoError(t, err)
+	require.False(t, plain.Encrypted.Bool())
+	encryptedSnapshot := snapshotSource(encrypted.UUID)
+	plainSnapshot := snapshotSource(plain.UUID)
+
+	// encryption is inherited from the source if parameter is not set
+	vol, err := createVolume("pvc-restore-inherit", "", encryptedSnapshot)
+	require.NoError(t, err)
+	assert.True(t, vol.Encrypted.Bool())
+	vol, err = createVolume("pvc-restore-encrypted", "data-at-rest", encryptedSnapshot)
+	require.NoError(t, err)
+	assert.True(t, vol.Encrypted.Bool())
+	vol, err = createVolume("pvc-clone-encrypted", "", &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: encrypted.UUID}},
+	})
+	require.NoError(t, err)
+	assert.True(t, vol.Encrypted.Bool())
+	vol, err = createVolume("pvc-restore-plain", "", plainSnapshot)
+	require.NoError(t, err)
+	assert.False(t, vol.Encrypted.Bool())
+
+	// combinations that can't be satisfied are rejected
+	_, err = createVolume("pvc-restore-luks", "luks", encryptedSnapshot)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = createVolume("pvc-restore-at-rest", "data-at-rest", plainSnapshot)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = createVolume("pvc-restore-unknown", "data-at-restx", encryptedSnapshot)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestController_Scenario_LUKSRestore(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	svc := mock.NewFakeService()
+	c, err := controller.NewController(svc, []string{"fi-hel2"}, 10, logrus.New().WithField("package", "controller_test"))
+	require.NoError(t, err)
+
+	mountCap := []*csi.VolumeCapability{{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}}
+	createVolume := func(name, encryption string, src *csi.VolumeContentSource) (*csi.Volume, error) {
+		req := &csi.CreateVolumeRequest{
+			Name:                name,
+			CapacityRange:       &csi.CapacityRange{RequiredBytes: 10 << 30},
+			VolumeCapabilities:  mountCap,
+			VolumeContentSource: src,
+		}
+		if encryption != "" {
+			req.Parameters = map[string]string{"encryption": encryption}
+		}
+		resp, err := c.CreateVolume(ctx, req)
+		return resp.GetVolume(), err
+	}
+	snapshotSource := func(volumeID string) *csi.VolumeContentSource {
+		snapReq := &csi.CreateSnapshotRequest{Name: "snap-" + volumeID, SourceVolumeId: volumeID}
+		_, err := c.CreateSnapshot(ctx, snapReq)
+		require.NoError(t, err)
+		snap, err := c.CreateSnapshot(ctx, snapReq)
+		require.NoError(t, err)
+		return &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snap.GetSnapshot().GetSnapshotId()}},
+		}
+	}
+	luksLabel := upcloud.Label{Key: "csi_encryption", Value: "luks"}
+
+	luks, err := createVolume("pvc-luks", "luks", nil)
+	require.NoError(t, err)
+	s, err := svc.GetStorageByUUID(ctx, luks.GetVolumeId())
+	require.NoError(t, err)
+	assert.Contains(t, s.Labels, luksLabel)
+	plain, err := createVolume("pvc-plain", "", nil)
+	require.NoError(t, err)
+	luksSnapshot := snapshotSource(luks.GetVolumeId())
+	s, err = svc.GetStorageByUUID(ctx, luksSnapshot.GetSnapshot().GetSnapshotId())
+	require.NoError(t, err)
+	assert.Contains(t, s.Labels, luksLabel)
+	plainSnapshot := snapshotSource(plain.GetVolumeId())
+
+	// source volume is fetched only when the backup is created, not when existing snapshot is requested again
+	svc.Fault = func(op string) error {
+		if op == "GetStorageByUUID" {
+			return errors.New("unexpected source volume lookup")
+		}
+		return nil
+	}
+	_, err = c.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snap-" + plain.GetVolumeId(), SourceVolumeId: plain.GetVolumeId()})
+	require.NoError(t, err)
+	svc.Fault = nil
+
+	// LUKS encryption is inherited from the source if parameter is not set
+	vol, err := createVolume("pvc-restore-inherit", "", luksSnapshot)
+	require.NoError(t, err)
+	assert.Equal(t, "luks", vol.GetVolumeContext()["encryption"])
+	s, err = svc.GetStorageByUUID(ctx, vol.GetVolumeId())
+	require.NoError(t, err)
+	assert.Contains(t, s.Labels, luksLabel)
+	vol, err = createVolume("pvc-restore-luks", "luks", luksSnapshot)
+	require.NoError(t, err)
+	assert.Equal(t, "luks", vol.GetVolumeContext()["encryption"])
+	vol, err = createVolume("pvc-clone-inherit", "", &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: luks.GetVolumeId()}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "luks", vol.GetVolumeContext()["encryption"])
+	vol, err = createVolume("pvc-restore-plain", "", plainSnapshot)
+	require.NoError(t, err)
+	assert.Empty(t, vol.GetVolumeContext()["encryption"])
+
+	// volumes that the node couldn't stage are rejected
+	_, err = createVolume("pvc-restore-at-rest", "data-at-rest", luksSnapshot)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = createVolume("pvc-restore-plain-luks", "luks", plainSnapshot)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestController_Scenario_ChangeTier(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	svc := mock.NewFakeService()
+	svc.AddServer("node1", "fi-hel2")
+	c, err := controller.NewController(svc, []string{"fi-hel2"}, 10, logrus.New().WithField("package", "controller_test"))
+	require.NoError(t, err)
+
+	mountCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	vol, err := c.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 10 << 30},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCap},
+		Parameters:         map[string]string{"tier": "maxiops", "labels": "team=a"},
+	})
+	require.NoError(t, err)
+	volumeID := vol.GetVolume().GetVolumeId()
+	publishReq := &csi.ControllerPublishVolumeRequest{VolumeId: volumeID, NodeId: "node1", VolumeCapability: mountCap}
+	unpublishReq := &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeID, NodeId: "node1"}
+	snapshot := func(name string) *csi.Snapshot {
+		snap, err := c.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: name, SourceVolumeId: volumeID})
+		require.NoError(t, err)
+		return snap.GetSnapshot()
+	}
+	snap1 := snapshot("snap-1")
+
+	// tier can be changed only when volume is detached
+	_, err = c.ControllerPublishVolume(ctx, publishReq)
+	require.NoError(t, err)
+	modifyReq := &csi.ControllerModifyVolumeRequest{VolumeId: volumeID, MutableParameters: map[string]string{"tier": "hdd", "labels": "team=b"}}
+	_, err = c.ControllerModifyVolume(ctx, modifyReq)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = c.ControllerUnpublishVolume(ctx, unpublishReq)
+	require.NoError(t, err)
+
+	// copy is not used until the original storage is deleted, interrupted change is resumed using the same copy
+	svc.InjectFault("DeleteStorage", mock.ErrFault)
+	_, err = c.ControllerModifyVolume(ctx, modifyReq)
+	require.Equal(t, codes.Internal, status.Code(err))
+	volumes, err := c.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	require.NoError(t, err)
+	require.Len(t, volumes.GetEntries(), 1)
+	assert.Equal(t, volumeID, volumes.GetEntries()[0].GetVolume().GetVolumeId())
+	storageCount := len(svc.Storages())
+	_, err = c.ControllerModifyVolume(ctx, modifyReq)
+	require.NoError(t, err)
+	assert.Len(t, svc.Storages(), storageCount-1)
+
+	// volume is backed by a copy in the new tier, but volume ID doesn't change
+	_, err = svc.GetStorageByUUID(ctx, volumeID)
+	require.Error(t, err)
+	got, err := c.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+	require.NoError(t, err)
+	assert.Equal(t, volumeID, got.GetVolume().GetVolumeId())
+	volumes, err = c.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	require.NoError(t, err)
+	require.Len(t, volumes.GetEntries(), 1)
+	assert.Equal(t, volumeID, volumes.GetEntries()[0].GetVolume().GetVolumeId())
+	published, err := c.ControllerPublishVolume(ctx, publishReq)
+	require.NoError(t, err)
+	storage, err := svc.GetStorageByUUID(ctx, published.GetPublishContext()["storageUUID"])
+	require.NoError(t, err)
+	assert.Equal(t, upcloud.StorageTierHDD, storage.Tier)
+	assert.Contains(t, storage.Labels, upcloud.Label{Key: "team", Value: "b"})
+	assert.Len(t, storage.ServerUUIDs, 1)
+
+	// snapshots taken before and after the change belong to the volume
+	snap2 := snapshot("snap-2")
+	assert.Equal(t, volumeID, snap2.GetSourceVolumeId())
+	snaps, err := c.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SourceVolumeId: volumeID})
+	require.NoError(t, err)
+	require.Len(t, snaps.GetEntries(), 2)
+	for _, e := range snaps.GetEntries() {
+		assert.Equal(t, volumeID, e.GetSnapshot().GetSourceVolumeId())
+	}
+
+	// tier can be changed again
+	_, err = c.ControllerUnpublishVolume(ctx, unpublishReq)
+	require.NoError(t, err)
+	_, err = c.ControllerModifyVolume(ctx, &csi.ControllerModifyVolumeRequest{VolumeId: volumeID, MutableParameters: map[string]string{"tier": "standard"}})
+	require.NoError(t, err)
+	expanded, err := c.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{VolumeId: volumeID, CapacityRange: &csi.CapacityRange{RequiredBytes: 20 << 30}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(20<<30), expanded.GetCapacityBytes())
+	volumes, err = c.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	require.NoError(t, err)
+	require.Len(t, volumes.GetEntries(), 1)
+	assert.Equal(t, int64(20<<30), volumes.GetEntries()[0].GetVolume().GetCapacityBytes())
+
+	for _, s := range []*csi.Snapshot{snap1, snap2} {
+		_, err = c.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: s.GetSnapshotId()})
+		require.NoError(t, err)
+	}
+	_, err = c.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	require.NoError(t, err)
+	for _, s := range svc.Storages() {
+		// backup taken when detached storage was resized is kept
+		assert.NotEqual(t, upcloud.StorageTypeNormal, s.Type, "volume storages should be deleted")
+	}
+}
@@ -19,3 +19,47 @@ func upcloudLabels(labels []string) []upcloud.Label {
 	}
 	return r
 }
+
+// mergeLabels merges label slices so that label defined later overrides label with the same key defined earlier.
+func mergeLabels(labels ...[]upcloud.Label) []upcloud.Label {
+	r := make([]upcloud.Label, 0)
+	index := make(map[string]int)
+	for _, l := range labels {
+		for _, label := range l {
+			if i, ok := index[label.Key]; ok {
+				r[i] = label
+				continue
+			}
+			index[label.Key] = len(r)
+			r = append(r, label)
+		}
+	}
+	return r
+}
+
+// labelsEqual checks that label slices contain same labels regardless of the order.
+func labelsEqual(a, b []upcloud.Label) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	m := make(map[string]string, len(a))
+	for _, l := range a {
+		m[l.Key] = l.Value
+	}
+	for _, l := range b {
+		if v, ok := m[l.Key]; !ok || v != l.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// labelValue returns value of the label with the key, or empty string if label is not set.
+func labelValue(labels []upcloud.Label, key string) string {
+	for _, l := range labels {
+		if l.Key == key {
+			return l.Value
+		}
+	}
+	return ""
+}
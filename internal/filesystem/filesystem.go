@@ -2,6 +2,16 @@ package filesystem
 
 import (
 	"context"
+	"errors"
+)
+
+var (
+	// ErrInvalidPassphrase is returned when LUKS device can't be unlocked using the given passphrase.
+	ErrInvalidPassphrase = errors.New("no key available with this passphrase")
+	// ErrLuksDevice is returned when device that is formatted as LUKS device is about to be formatted with a filesystem.
+	ErrLuksDevice = errors.New("device is LUKS device")
+	// ErrFilesystemCorrupted is returned when filesystem check finds errors that can't be repaired automatically.
+	ErrFilesystemCorrupted = errors.New("filesystem is corrupted")
 )
 
 type VolumeStatistics struct {
@@ -13,12 +23,36 @@ type VolumeStatistics struct {
 	UsedInodes int64
 }
 
+// CheckResult is the result of filesystem check or repair.
+type CheckResult struct {
+	// NeedsRepair is set by the check if errors were found.
+	NeedsRepair bool
+	// Repaired is set by the repair if errors were found and repaired.
+	Repaired bool
+	// Message describes the result of the check.
+	Message string
+}
+
 type Filesystem interface {
 	Format(ctx context.Context, source, fsType string, mkfsArgs []string) error
+	Partition(ctx context.Context, source string) (string, error)
+	CreateFilesystem(ctx context.Context, device, fsType string, mkfsArgs []string) error
 	IsMounted(ctx context.Context, target string) (bool, error)
+	MountTargets(ctx context.Context, source string) ([]string, error)
 	Mount(ctx context.Context, source, target, fsType string, opts ...string) error
 	Unmount(ctx context.Context, path string) error
 	Statistics(volumePath string) (VolumeStatistics, error)
 	GetDeviceByID(ctx context.Context, ID string) (string, error)
+	GetDeviceByMount(ctx context.Context, target string) (string, error)
 	GetDeviceLastPartition(ctx context.Context, source string) (string, error)
+	Resize(ctx context.Context, source, target string) error
+	PartitionName(ctx context.Context, partition string) (string, error)
+	SetPartitionName(ctx context.Context, source, partition, name string) error
+	RegenerateUUID(ctx context.Context, device string) error
+	Check(ctx context.Context, device string) (CheckResult, error)
+	Repair(ctx context.Context, device string) (CheckResult, error)
+	LuksFormat(ctx context.Context, device, passphrase string) error
+	LuksOpen(ctx context.Context, device, name, passphrase string, readOnly bool) (string, error)
+	LuksClose(ctx context.Context, name string) error
+	LuksChangeKey(ctx context.Context, device, passphrase, newPassphrase string) error
 }
@@ -53,6 +53,29 @@ func TestSfdiskOutputGetLastPartition(t *testing.T) {
 	}
 }
 
+func TestLsblkOutputGetDisk(t *testing.T) {
+	t.Parallel()
+	outputLUKS := `
+/dev/mapper/luks-01b0d4f1 crypt
+/dev/vdb1                 part
+/dev/vdb                  disk
+`
+	got, err := lsblkOutputGetDisk("/dev/mapper/luks-01b0d4f1", outputLUKS)
+	require.NoError(t, err)
+	assert.Equal(t, "/dev/vdb", got)
+
+	got, err = lsblkOutputGetDisk("/dev/vdc1", "/dev/vdc1 part\n/dev/vdc  disk\n")
+	require.NoError(t, err)
+	assert.Equal(t, "/dev/vdc", got)
+
+	got, err = lsblkOutputGetDisk("/dev/loop0p1", "/dev/loop0p1 part\n/dev/loop0   loop\n")
+	require.NoError(t, err)
+	assert.Equal(t, "/dev/loop0", got)
+
+	_, err = lsblkOutputGetDisk("/dev/vdd1", "/dev/vdd1 part\n")
+	assert.Error(t, err)
+}
+
 func TestLinuxFilesystem_Mount(t *testing.T) {
 	t.Parallel()
 	if err := checkSystemRequirements(); err != nil {
@@ -193,7 +216,7 @@ func TestGetBlockDeviceByDiskID(t *testing.T) {
 	}
 
 	want := vda
-	got, err := getBlockDeviceByDiskID(context.TODO(), vdaSymLink)
+	got, err := getBlockDeviceByDiskID(context.TODO(), idPath, vdaSymLink)
 	require.NoError(t, err)
 	assert.Equal(t, want, got)
 
@@ -207,7 +230,7 @@ func TestGetBlockDeviceByDiskID(t *testing.T) {
 		t.Fatal(err)
 	}
 	want = vdb
-	got, err = getBlockDeviceByDiskID(context.TODO(), vdbSymLink)
+	got, err = getBlockDeviceByDiskID(context.TODO(), idPath, vdbSymLink)
 	require.NoError(t, err)
 	assert.Equal(t, want, got)
 }
@@ -220,6 +243,38 @@ func TestLinuxFilesystem_FormatValidation(t *testing.T) {
 	require.ErrorContains(t, fs.Format(context.TODO(), "", "ext4", nil), "source is not specified for formatting the volume")
 }
 
+func TestPartitionNumber(t *testing.T) {
+	t.Parallel()
+	for partition, want := range map[string]string{"/dev/vda1": "1", "/dev/vdb12": "12", "/dev/nvme0n1p3": "3", "/tmp/disk-123p1": "1"} {
+		got, err := partitionNumber(partition)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	_, err := partitionNumber("/dev/vda")
+	require.Error(t, err)
+}
+
+func TestMountTargets(t *testing.T) {
+	t.Parallel()
+	mounts := []mountEntry{
+		{Target: "/", MajMin: "252:1", FsRoot: "/"},
+		{Target: "/dev", MajMin: "0:5", FsRoot: "/"},
+		{Target: "/var/lib/kubelet/plugins/staging/pv1", MajMin: "8:17", FsRoot: "/"},
+		{Target: "/var/lib/kubelet/pods/pod1/volumes/pv1/mount", MajMin: "8:17", FsRoot: "/"},
+		{Target: "/var/lib/kubelet/pods/pod2/volumes/pv1/mount", MajMin: "8:17", FsRoot: "/"},
+		{Target: "/var/lib/kubelet/pods/pod3/volumes/pv1/subpath", MajMin: "8:17", FsRoot: "/data"},
+		{Target: "/var/lib/kubelet/pods/pod4/volumeDevices/pv2", MajMin: "0:5", FsRoot: "/sdc"},
+	}
+	assert.Equal(t, []string{
+		"/var/lib/kubelet/plugins/staging/pv1",
+		"/var/lib/kubelet/pods/pod1/volumes/pv1/mount",
+		"/var/lib/kubelet/pods/pod2/volumes/pv1/mount",
+	}, mountTargets(mounts, "/var/lib/kubelet/plugins/staging/pv1/"))
+	assert.Equal(t, []string{"/var/lib/kubelet/pods/pod4/volumeDevices/pv2"}, mountTargets(mounts, "/dev/sdc"))
+	assert.Empty(t, mountTargets(mounts, "/dev/sdd"))
+	assert.Empty(t, mountTargets(nil, "/dev/sdc"))
+}
+
 func TestLinuxFilesystem_isSupportedFilesystem(t *testing.T) {
 	t.Parallel()
 	fs := newTestLinuxFilesystem()
@@ -310,3 +365,39 @@ func mount(t *testing.T, m *LinuxFilesystem, source, target, fsType string, opts
 	t.Logf("unmounted %s", target)
 	return nil
 }
+
+func TestLinuxFilesystem_ReadinessChecks(t *testing.T) {
+	t.Parallel()
+
+	m := &LinuxFilesystem{tools: []string{"ls"}, diskByIDPath: t.TempDir()}
+	checks := m.ReadinessChecks("")
+	require.Len(t, checks, 2)
+	for _, c := range checks {
+		assert.NoError(t, c.Run(context.Background()), c.Name)
+	}
+
+	m = &LinuxFilesystem{tools: []string{"missing-tool"}, diskByIDPath: filepath.Join(t.TempDir(), "missing")}
+	for _, c := range m.ReadinessChecks("") {
+		assert.Error(t, c.Run(context.Background()), c.Name)
+	}
+	assert.Len(t, m.ReadinessChecks("/var/lib/kubelet"), 3)
+}
+
+func TestLuksMappingName(t *testing.T) {
+	t.Parallel()
+
+	sys := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(sys, "vda1", "holders", "dm-0"), 0o750))
+	require.NoError(t, os.MkdirAll(filepath.Join(sys, "dm-0", "dm"), 0o750))
+	require.NoError(t, os.WriteFile(filepath.Join(sys, "dm-0", "dm", "name"), []byte("upcloud-csi-vol\n"), 0o600))
+	require.NoError(t, os.MkdirAll(filepath.Join(sys, "vdb1", "holders"), 0o750))
+
+	name, err := luksMappingName(sys, "/dev/vda1")
+	require.NoError(t, err)
+	assert.Equal(t, "upcloud-csi-vol", name)
+
+	_, err = luksMappingName(sys, "/dev/vdb1")
+	assert.Error(t, err, "mapping is not open")
+	_, err = luksMappingName(sys, "/dev/vdc1")
+	assert.Error(t, err, "partition doesn't exist")
+}
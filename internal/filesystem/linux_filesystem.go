@@ -8,8 +8,11 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 
+	"github.com/UpCloudLtd/upcloud-csi/internal/health"
 	"github.com/UpCloudLtd/upcloud-csi/internal/logger"
+	"github.com/UpCloudLtd/upcloud-csi/internal/metrics"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 )
@@ -22,6 +25,16 @@ const (
 	blkidCmdErrCodeNotFound = 2
 	partedCmd               = "parted"
 	sfdiskCmd               = "sfdisk"
+	partxCmd                = "partx"
+	lsblkCmd                = "lsblk"
+	resize2fsCmd            = "resize2fs"
+	xfsGrowfsCmd            = "xfs_growfs"
+	xfsAdminCmd             = "xfs_admin"
+	tune2fsCmd              = "tune2fs"
+	e2fsckCmd               = "e2fsck"
+	xfsRepairCmd            = "xfs_repair"
+	// e2fsckErrCodeCorrected is returned by e2fsck when filesystem errors were corrected.
+	e2fsckErrCodeCorrected = 1
 	// udevDiskTimeout specifies a time limit for waiting disk appear under /dev/disk/by-id.
 	udevDiskTimeout = 60
 	// udevSettleTimeout specifies a time limit for waiting udev event queue to become empty.
@@ -31,17 +44,26 @@ const (
 type LinuxFilesystem struct {
 	log             *logrus.Entry
 	filesystemTypes []string
+	// tools are executables required by the filesystem operations.
+	tools []string
+	// diskByIDPath is the directory of disk ID symbolic links maintained by udev.
+	diskByIDPath string
 }
 
 func NewLinuxFilesystem(filesystemTypes []string, log *logrus.Entry) (*LinuxFilesystem, error) {
-	tools := []string{blkidCmd, partedCmd, sfdiskCmd}
+	tools := []string{blkidCmd, partedCmd, sfdiskCmd, partxCmd, lsblkCmd}
 	for i := range filesystemTypes {
 		tools = append(tools, fmt.Sprintf("mkfs.%s", filesystemTypes[i]))
+		if resizeCmd := filesystemResizeCmd(filesystemTypes[i]); resizeCmd != "" {
+			tools = append(tools, resizeCmd)
+		}
 	}
 
 	return &LinuxFilesystem{
 		log:             log,
 		filesystemTypes: filesystemTypes,
+		tools:           tools,
+		diskByIDPath:    udevDiskByIDPath,
 	}, checkToolsExists(tools...) // allow caller to decide what to do if tools are not present
 }
 
@@ -60,16 +82,44 @@ func (m *LinuxFilesystem) Format(ctx context.Context, source, fsType string, mkf
 	if err := m.isSupportedFilesystem(fsType); err != nil {
 		return err
 	}
-	if err := m.createPartitionTableIfNotExists(ctx, source); err != nil {
+	partition, err := m.Partition(ctx, source)
+	if err != nil {
 		return err
 	}
-	partition, err := m.createPartitionIfNotExists(ctx, source)
+	// LUKS partition of an encrypted volume would otherwise be formatted if volume is staged without 'luks' encryption
+	partitionType, err := m.deviceType(ctx, partition)
 	if err != nil {
 		return err
 	}
+	if partitionType == luksType {
+		return fmt.Errorf("%w: refusing to format partition %s, volume needs to use 'luks' encryption", ErrLuksDevice, partition)
+	}
 	return m.createFilesystemIfNotExists(ctx, partition, fsType, mkfsArgs)
 }
 
+// Partition writes new partition table and creates new partition, if they don't exist yet, and returns the partition.
+func (m *LinuxFilesystem) Partition(ctx context.Context, source string) (string, error) {
+	if source == "" {
+		return "", errors.New("source is not specified for partitioning the volume")
+	}
+	if err := m.createPartitionTableIfNotExists(ctx, source); err != nil {
+		return "", err
+	}
+	return m.createPartitionIfNotExists(ctx, source)
+}
+
+// CreateFilesystem creates new filesystem directly to the device, e.g. LUKS mapping, if one doesn't exist yet.
+func (m *LinuxFilesystem) CreateFilesystem(ctx context.Context, device, fsType string, mkfsArgs []string) error {
+	if fsType == "" {
+		return errors.New("fs type is not specified for formatting the device")
+	}
+	fsType = strings.ToLower(fsType)
+	if err := m.isSupportedFilesystem(fsType); err != nil {
+		return err
+	}
+	return m.createFilesystemIfNotExists(ctx, device, fsType, mkfsArgs)
+}
+
 func (m *LinuxFilesystem) isSupportedFilesystem(fsType string) error {
 	for i := range m.filesystemTypes {
 		if strings.Compare(m.filesystemTypes[i], fsType) == 0 {
@@ -88,7 +138,9 @@ func (m *LinuxFilesystem) createFilesystemIfNotExists(ctx context.Context, parti
 	mkfsCmd := fmt.Sprintf("mkfs.%s", fsType)
 
 	logger.WithServerContext(ctx, m.log).WithFields(logrus.Fields{logger.CommandKey: mkfsCmd, logger.CommandArgsKey: mkfsArgs}).Debug("executing command")
-	output, err := exec.CommandContext(ctx, mkfsCmd, mkfsArgs...).CombinedOutput()
+	start := time.Now()
+	output, err := runCmd(ctx, mkfsCmd, mkfsArgs...)
+	observeNodeOperation(metrics.OperationMkfs, start)
 	if err != nil {
 		return fmt.Errorf("failed to create filesystem %s %s (%s); %w", mkfsCmd, strings.Join(mkfsArgs, " "), formatCmdError(output), err)
 	}
@@ -163,7 +215,9 @@ func (m *LinuxFilesystem) Mount(ctx context.Context, source, target, fsType stri
 
 	logger.WithServerContext(ctx, m.log).WithFields(logrus.Fields{logger.CommandKey: mountCmd, logger.CommandArgsKey: mountArgs}).Debug("executing command")
 
-	return exec.CommandContext(ctx, mountCmd, mountArgs...).Run()
+	defer observeNodeOperation(metrics.OperationMount, time.Now())
+	_, err := runCmd(ctx, mountCmd, mountArgs...)
+	return err
 }
 
 // Unmount unmounts the given target.
@@ -246,6 +300,32 @@ func (m *LinuxFilesystem) IsMounted(ctx context.Context, target string) (bool, e
 	return targetFound, nil
 }
 
+// MountTargets returns target paths of all mounts that mount the same directory or device file as the source path,
+// e.g. bind mounts of the staging path or of the block device. Source path itself is included if it's a mount point.
+// Mounts are read from the mount table, so the result doesn't depend on plugin's state.
+func (m *LinuxFilesystem) MountTargets(ctx context.Context, source string) ([]string, error) {
+	if source == "" {
+		return nil, errors.New("source is not specified for listing mounts")
+	}
+
+	findmntCmd := "findmnt"
+	findmntArgs := []string{"-J", "--list", "-o", "TARGET,MAJ:MIN,FSROOT"}
+
+	logger.WithServerContext(ctx, m.log).WithFields(logrus.Fields{logger.CommandKey: findmntCmd, logger.CommandArgsKey: findmntArgs}).Debug("executing command")
+
+	out, err := exec.CommandContext(ctx, findmntCmd, findmntArgs...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("listing mounts failed: %w cmd: %q output: %s", err, findmntCmd, formatCmdError(out))
+	}
+	var resp struct {
+		FileSystems []mountEntry `json:"filesystems"`
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return nil, fmt.Errorf("couldn't unmarshal data: %q: %w", string(out), err)
+	}
+	return mountTargets(resp.FileSystems, source), nil
+}
+
 // createPartitionTableIfNotExists creates new partition table if one does not exists.
 func (m *LinuxFilesystem) createPartitionTableIfNotExists(ctx context.Context, device string) error {
 	if ok, err := m.hasPartitionTable(ctx, device); ok || err != nil {
@@ -254,7 +334,7 @@ func (m *LinuxFilesystem) createPartitionTableIfNotExists(ctx context.Context, d
 	args := []string{device, "mklabel", "gpt"}
 	log := logger.WithServerContext(ctx, m.log).WithFields(logrus.Fields{logger.CommandKey: partedCmd, logger.CommandArgsKey: args})
 	log.Debug("executing command")
-	output, err := exec.CommandContext(ctx, partedCmd, args...).CombinedOutput()
+	output, err := runCmd(ctx, partedCmd, args...)
 	if err != nil {
 		return fmt.Errorf("failed to create %s partition table '%s'; %w", device, formatCmdError(output), err)
 	}
@@ -303,7 +383,7 @@ func (m *LinuxFilesystem) createPartitionIfNotExists(ctx context.Context, device
 	}
 	args := []string{"-a", "opt", device, "mkpart", "primary", "2048s", "100%"}
 	log.WithFields(logrus.Fields{logger.CommandKey: partedCmd, logger.CommandArgsKey: args}).Debug("executing command")
-	output, err := exec.CommandContext(ctx, partedCmd, args...).CombinedOutput()
+	output, err := runCmd(ctx, partedCmd, args...)
 	if err != nil {
 		return "", fmt.Errorf("failed to create new partition: '%s'; %w", formatCmdError(output), err)
 	}
@@ -337,7 +417,27 @@ func (m *LinuxFilesystem) GetDeviceByID(ctx context.Context, id string) (string,
 	if err != nil {
 		return diskID, err
 	}
-	return getBlockDeviceByDiskID(ctx, diskID)
+	defer observeNodeOperation(metrics.OperationUdevWait, time.Now())
+	return getBlockDeviceByDiskID(ctx, m.diskByIDPath, diskID)
+}
+
+// GetDeviceByMount returns the disk device that holds the filesystem mounted to the target. Filesystem can be on
+// a partition of the disk, or on LUKS mapping of the partition.
+func (m *LinuxFilesystem) GetDeviceByMount(ctx context.Context, target string) (string, error) {
+	if target == "" {
+		return "", errors.New("target is not specified for getting the device")
+	}
+	output, err := exec.CommandContext(ctx, "findmnt", "-n", "-v", "-o", "SOURCE", "-M", target).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to get source of mount %s: '%s'; %w", target, formatCmdError(output), err)
+	}
+	source, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+	// list the source and devices it depends on, e.g. LUKS mapping -> partition -> disk
+	output, err = exec.CommandContext(ctx, lsblkCmd, "-s", "-l", "-n", "-p", "-o", "NAME,TYPE", source).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to list %s devices: '%s'; %w", source, formatCmdError(output), err)
+	}
+	return lsblkOutputGetDisk(source, string(output))
 }
 
 func (m *LinuxFilesystem) GetDeviceLastPartition(ctx context.Context, device string) (string, error) {
@@ -348,3 +448,205 @@ func (m *LinuxFilesystem) GetDeviceLastPartition(ctx context.Context, device str
 
 	return sfdiskOutputGetLastPartition(device, string(output))
 }
+
+// Resize expands last partition of the source device and filesystem mounted to the target path to fill the whole device.
+// Device is expected to be already resized by the controller. Resize is safe to call multiple times.
+func (m *LinuxFilesystem) Resize(ctx context.Context, source, target string) error {
+	if source == "" {
+		return errors.New("source is not specified for resizing the volume")
+	}
+	if target == "" {
+		return errors.New("target is not specified for resizing the volume")
+	}
+	log := logger.WithServerContext(ctx, m.log).WithFields(logrus.Fields{logger.MountSourceKey: source, logger.MountTargetKey: target})
+
+	if err := rescanDevice(source); err != nil {
+		return err
+	}
+	partition, err := m.GetDeviceLastPartition(ctx, source)
+	if err != nil {
+		return err
+	}
+	log = log.WithField("partition", partition)
+	log.Info("growing partition")
+	if err := m.growPartition(ctx, source, partition); err != nil {
+		return err
+	}
+	fsType, err := m.filesystemType(ctx, partition)
+	if err != nil {
+		return err
+	}
+	device := partition
+	if fsType == luksType {
+		// filesystem is inside LUKS mapping which needs to be resized before the filesystem
+		log.Info("growing LUKS mapping")
+		if device, err = m.luksResize(ctx, partition); err != nil {
+			return err
+		}
+		if fsType, err = m.filesystemType(ctx, device); err != nil {
+			return err
+		}
+	}
+	log.WithField(logger.FilesystemTypeKey, fsType).Info("growing filesystem")
+	return m.growFilesystem(ctx, device, target, fsType)
+}
+
+// growPartition moves GPT backup header to the end of the device and grows partition to use all available space.
+func (m *LinuxFilesystem) growPartition(ctx context.Context, device, partition string) error {
+	num, err := partitionNumber(partition)
+	if err != nil {
+		return err
+	}
+	log := logger.WithServerContext(ctx, m.log)
+
+	args := []string{"--relocate", "gpt-bak-std", device}
+	log.WithFields(logrus.Fields{logger.CommandKey: sfdiskCmd, logger.CommandArgsKey: args}).Debug("executing command")
+	if output, err := exec.CommandContext(ctx, sfdiskCmd, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to relocate %s partition table backup header: '%s'; %w", device, formatCmdError(output), err)
+	}
+
+	// partition is in use, so don't let sfdisk re-read partition table and inform kernel using partx instead.
+	args = []string{"--no-reread", "--no-tell-kernel", "-N", num, device}
+	log.WithFields(logrus.Fields{logger.CommandKey: sfdiskCmd, logger.CommandArgsKey: args}).Debug("executing command")
+	cmd := exec.CommandContext(ctx, sfdiskCmd, args...)
+	cmd.Stdin = strings.NewReader(", +\n")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to grow partition %s: '%s'; %w", partition, formatCmdError(output), err)
+	}
+
+	args = []string{"--update", "--nr", num, device}
+	log.WithFields(logrus.Fields{logger.CommandKey: partxCmd, logger.CommandArgsKey: args}).Debug("executing command")
+	if output, err := exec.CommandContext(ctx, partxCmd, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to update partition %s size: '%s'; %w", partition, formatCmdError(output), err)
+	}
+	return nil
+}
+
+// growFilesystem grows filesystem to fill the whole partition. Ext filesystems are resized using partition and XFS using mount point.
+func (m *LinuxFilesystem) growFilesystem(ctx context.Context, partition, target, fsType string) error {
+	resizeCmd := filesystemResizeCmd(fsType)
+	if resizeCmd == "" {
+		return fmt.Errorf("resizing filesystem type '%s' is not supported", fsType)
+	}
+	args := []string{partition}
+	if resizeCmd == xfsGrowfsCmd {
+		args = []string{target}
+	}
+	logger.WithServerContext(ctx, m.log).WithFields(logrus.Fields{logger.CommandKey: resizeCmd, logger.CommandArgsKey: args}).Debug("executing command")
+	if output, err := exec.CommandContext(ctx, resizeCmd, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to resize filesystem %s %s (%s); %w", resizeCmd, strings.Join(args, " "), formatCmdError(output), err)
+	}
+	return nil
+}
+
+// filesystemType returns filesystem type of the partition.
+func (m *LinuxFilesystem) filesystemType(ctx context.Context, partition string) (string, error) {
+	blkidArgs := []string{"--probe", "--output", "value", "--match-tag", "TYPE", partition}
+	logger.WithServerContext(ctx, m.log).WithFields(logrus.Fields{logger.CommandKey: blkidCmd, logger.CommandArgsKey: blkidArgs}).Debug("executing command")
+	output, err := exec.CommandContext(ctx, blkidCmd, blkidArgs...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("checking partition filesystem type failed: %w (%s)", err, formatCmdError(output))
+	}
+	fsType := strings.TrimSpace(strings.ToLower(string(output)))
+	if fsType == "" {
+		return "", fmt.Errorf("partition %s doesn't have filesystem", partition)
+	}
+	return fsType, nil
+}
+
+// PartitionName returns GPT name of the partition, or empty string if partition doesn't have a name.
+func (m *LinuxFilesystem) PartitionName(ctx context.Context, partition string) (string, error) {
+	blkidArgs := []string{"--probe", "--output", "value", "--match-tag", "PART_ENTRY_NAME", partition}
+	logger.WithServerContext(ctx, m.log).WithFields(logrus.Fields{logger.CommandKey: blkidCmd, logger.CommandArgsKey: blkidArgs}).Debug("executing command")
+	output, err := exec.CommandContext(ctx, blkidCmd, blkidArgs...).CombinedOutput()
+	if err != nil {
+		if cmdExitCode(err) == blkidCmdErrCodeNotFound {
+			return "", nil
+		}
+		return "", fmt.Errorf("checking partition %s name failed: %w (%s)", partition, err, formatCmdError(output))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// SetPartitionName sets GPT name of the source device partition. Kernel is not informed about the change,
+// so the name can be set also when partition is in use.
+func (m *LinuxFilesystem) SetPartitionName(ctx context.Context, source, partition, name string) error {
+	num, err := partitionNumber(partition)
+	if err != nil {
+		return err
+	}
+	args := []string{"--no-reread", "--no-tell-kernel", "--part-label", source, num, name}
+	logger.WithServerContext(ctx, m.log).WithFields(logrus.Fields{logger.CommandKey: sfdiskCmd, logger.CommandArgsKey: args}).Debug("executing command")
+	if output, err := runCmd(ctx, sfdiskCmd, args...); err != nil {
+		return fmt.Errorf("failed to set partition %s name: '%s'; %w", partition, formatCmdError(output), err)
+	}
+	return nil
+}
+
+// RegenerateUUID replaces the UUID of the unmounted filesystem in the device with a new random UUID.
+// Ext filesystem is checked before changing the UUID, as tune2fs requires freshly checked filesystem.
+// XFS log is replayed before changing the UUID, as xfs_admin refuses to change the UUID if the log is dirty,
+// e.g. when the volume was cloned from a volume that was in use.
+func (m *LinuxFilesystem) RegenerateUUID(ctx context.Context, device string) error {
+	fsType, err := m.filesystemType(ctx, device)
+	if err != nil {
+		return err
+	}
+	log := logger.WithServerContext(ctx, m.log)
+	commands := make([][]string, 0)
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		commands = append(commands, []string{e2fsckCmd, "-f", "-p", device}, []string{tune2fsCmd, "-U", "random", device})
+	case "xfs":
+		if err := m.replayXFSLog(ctx, device); err != nil {
+			return fmt.Errorf("failed to regenerate filesystem UUID; %w", err)
+		}
+		commands = append(commands, []string{xfsAdminCmd, "-U", "generate", device})
+	default:
+		return fmt.Errorf("regenerating UUID of filesystem type '%s' is not supported", fsType)
+	}
+	for _, c := range commands {
+		log.WithFields(logrus.Fields{logger.CommandKey: c[0], logger.CommandArgsKey: c[1:]}).Debug("executing command")
+		output, err := runCmd(ctx, c[0], c[1:]...)
+		if err != nil && (c[0] != e2fsckCmd || cmdExitCode(err) != e2fsckErrCodeCorrected) {
+			return fmt.Errorf("failed to regenerate filesystem UUID %s %s (%s); %w", c[0], strings.Join(c[1:], " "), formatCmdError(output), err)
+		}
+	}
+	return nil
+}
+
+// replayXFSLog replays XFS log by mounting the filesystem to a temporary directory. Filesystem is mounted using
+// `nouuid` option, as the source of the cloned volume can be mounted on the same node with the same UUID.
+func (m *LinuxFilesystem) replayXFSLog(ctx context.Context, device string) error {
+	dir, err := os.MkdirTemp("", "xfs-log-replay-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dir)
+	logger.WithServerContext(ctx, m.log).WithField("device", device).Info("replaying XFS log")
+	if err := m.Mount(ctx, device, dir, "xfs", "nouuid"); err != nil {
+		return fmt.Errorf("unable to mount %s to replay XFS log; %w", device, err)
+	}
+	return m.Unmount(ctx, dir)
+}
+
+// ReadinessChecks returns checks that node is able to format and mount volumes: required tools are present,
+// disk ID directory is readable and kubelet directory has shared mount propagation. Propagation is not checked if
+// kubeletDir is empty.
+func (m *LinuxFilesystem) ReadinessChecks(kubeletDir string) []health.Check {
+	checks := []health.Check{
+		{Name: "tools", Run: func(context.Context) error {
+			return checkToolsExists(m.tools...)
+		}},
+		{Name: "disk-by-id", Run: func(context.Context) error {
+			_, err := os.ReadDir(m.diskByIDPath)
+			return err
+		}},
+	}
+	if kubeletDir != "" {
+		checks = append(checks, health.Check{Name: "kubelet-dir", Run: func(ctx context.Context) error {
+			return checkSharedPropagation(ctx, kubeletDir)
+		}})
+	}
+	return checks
+}
@@ -0,0 +1,341 @@
+//go:build loopdev
+
+package filesystem
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// loopDeviceSize is large enough for the smallest XFS filesystem mkfs.xfs accepts.
+const loopDeviceSize int64 = 512 << 20
+
+var loopDeviceFilesystemTypes = []string{"ext3", "ext4", "xfs"}
+
+// TestLinuxFilesystem_LoopDevice runs LinuxFilesystem against real block devices. Loop device tests require root
+// privileges and loop device support, so they are opt-in:
+//
+//	sudo go test -tags loopdev ./internal/filesystem/...
+func TestLinuxFilesystem_LoopDevice(t *testing.T) {
+	t.Parallel()
+	requireLoopDeviceSupport(t)
+	for _, fsType := range loopDeviceFilesystemTypes {
+		fsType := fsType
+		t.Run(fsType, func(t *testing.T) {
+			t.Parallel()
+			requireTools(t, "mkfs."+fsType)
+			ctx := context.Background()
+			m := newLoopTestFilesystem(t)
+			volumeID := uuid.NewString()
+			dev := newLoopDevice(t, m, volumeID)
+
+			source, err := m.GetDeviceByID(ctx, volumeID)
+			require.NoError(t, err)
+			assert.Equal(t, dev, source)
+
+			require.NoError(t, m.Format(ctx, source, fsType, nil))
+			partition, err := m.GetDeviceLastPartition(ctx, source)
+			require.NoError(t, err)
+			assert.Equal(t, source+"p1", partition)
+			got, err := m.filesystemType(ctx, partition)
+			require.NoError(t, err)
+			assert.Equal(t, fsType, got)
+
+			target := filepath.Join(newSharedMountDir(t), "target")
+			require.NoError(t, m.Mount(ctx, partition, target, fsType))
+			mounted, err := m.IsMounted(ctx, target)
+			require.NoError(t, err)
+			assert.True(t, mounted)
+			device, err := m.GetDeviceByMount(ctx, target)
+			require.NoError(t, err)
+			assert.Equal(t, dev, device)
+			require.NoError(t, os.WriteFile(filepath.Join(target, "data"), []byte(fsType), 0o600))
+			stats, err := m.Statistics(target)
+			require.NoError(t, err)
+			assert.Positive(t, stats.TotalBytes)
+			assert.Positive(t, stats.UsedBytes)
+			assert.Positive(t, stats.TotalInodes)
+			require.NoError(t, m.Unmount(ctx, target))
+			mounted, err = m.IsMounted(ctx, target)
+			require.NoError(t, err)
+			assert.False(t, mounted)
+
+			// formatting already formatted disk keeps the existing partition and data
+			require.NoError(t, m.Format(ctx, source, fsType, nil))
+			p, err := m.GetDeviceLastPartition(ctx, source)
+			require.NoError(t, err)
+			assert.Equal(t, partition, p)
+			require.NoError(t, m.Mount(ctx, partition, target, fsType))
+			data, err := os.ReadFile(filepath.Join(target, "data"))
+			require.NoError(t, err)
+			assert.Equal(t, fsType, string(data))
+			require.NoError(t, m.Unmount(ctx, target))
+		})
+	}
+}
+
+func TestLinuxFilesystem_LoopDevice_PartialFormat(t *testing.T) {
+	t.Parallel()
+	requireLoopDeviceSupport(t)
+	requireTools(t, "mkfs.ext4")
+	ctx := context.Background()
+
+	for name, prepare := range map[string][]string{
+		"partition table without partition": {"mklabel", "gpt"},
+		"partition without filesystem":      {"mklabel", "gpt", "mkpart", "primary", "2048s", "100%"},
+	} {
+		prepare := prepare
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			m := newLoopTestFilesystem(t)
+			dev := newLoopDevice(t, m, uuid.NewString())
+			// simulate Format that was interrupted before it finished
+			args := append([]string{"--script", dev}, prepare...)
+			if output, err := exec.Command(partedCmd, args...).CombinedOutput(); err != nil { //nolint:gosec // test
+				t.Fatalf("failed to prepare device: %s; %s", output, err)
+			}
+
+			require.NoError(t, m.Format(ctx, dev, "ext4", nil))
+			partition, err := m.GetDeviceLastPartition(ctx, dev)
+			require.NoError(t, err)
+			got, err := m.filesystemType(ctx, partition)
+			require.NoError(t, err)
+			assert.Equal(t, "ext4", got)
+			ok, err := m.hasPartitionTable(ctx, dev)
+			require.NoError(t, err)
+			assert.True(t, ok)
+		})
+	}
+}
+
+func TestLinuxFilesystem_LoopDevice_FormatLuksPartition(t *testing.T) {
+	t.Parallel()
+	requireLoopDeviceSupport(t)
+	requireTools(t, cryptsetupCmd, "mkfs.ext4")
+	ctx := context.Background()
+	m := newLoopTestFilesystem(t)
+	dev := newLoopDevice(t, m, uuid.NewString())
+
+	// partition of LUKS encrypted volume is LUKS device
+	partition, err := m.Partition(ctx, dev)
+	require.NoError(t, err)
+	require.NoError(t, m.LuksFormat(ctx, partition, "passphrase"))
+
+	require.ErrorIs(t, m.Format(ctx, dev, "ext4", nil), ErrLuksDevice)
+	got, err := m.deviceType(ctx, partition)
+	require.NoError(t, err)
+	assert.Equal(t, luksType, got)
+}
+
+func TestLinuxFilesystem_LoopDevice_RegenerateUUID(t *testing.T) {
+	t.Parallel()
+	requireLoopDeviceSupport(t)
+	for fsType, tools := range map[string][]string{
+		"ext4": {"mkfs.ext4", e2fsckCmd, tune2fsCmd},
+		"xfs":  {"mkfs.xfs", xfsAdminCmd},
+	} {
+		fsType, tools := fsType, tools
+		t.Run(fsType, func(t *testing.T) {
+			t.Parallel()
+			requireTools(t, tools...)
+			ctx := context.Background()
+			m := newLoopTestFilesystem(t)
+			volumeID := uuid.NewString()
+			dev := newLoopDevice(t, m, volumeID)
+			require.NoError(t, m.Format(ctx, dev, fsType, nil))
+			partition, err := m.GetDeviceLastPartition(ctx, dev)
+			require.NoError(t, err)
+
+			before := filesystemUUID(t, partition)
+			require.NoError(t, m.RegenerateUUID(ctx, partition))
+			after := filesystemUUID(t, partition)
+			assert.NotEmpty(t, after)
+			assert.NotEqual(t, before, after)
+
+			name, err := m.PartitionName(ctx, partition)
+			require.NoError(t, err)
+			assert.NotEqual(t, volumeID, name)
+			require.NoError(t, m.SetPartitionName(ctx, dev, partition, volumeID))
+			name, err = m.PartitionName(ctx, partition)
+			require.NoError(t, err)
+			assert.Equal(t, volumeID, name)
+		})
+	}
+}
+
+func TestLinuxFilesystem_LoopDevice_RegenerateUUIDDirtyLog(t *testing.T) {
+	t.Parallel()
+	requireLoopDeviceSupport(t)
+	requireTools(t, "mkfs.xfs", xfsAdminCmd, "xfs_io", "cp")
+	ctx := context.Background()
+	m := newLoopTestFilesystem(t)
+	dev := newLoopDevice(t, m, uuid.NewString())
+	require.NoError(t, m.Format(ctx, dev, "xfs", nil))
+	partition, err := m.GetDeviceLastPartition(ctx, dev)
+	require.NoError(t, err)
+
+	// shut down the filesystem after the log is flushed, so that the log stays dirty like in the snapshot of
+	// a volume that is in use
+	target := t.TempDir()
+	require.NoError(t, m.Mount(ctx, partition, target, "xfs"))
+	require.NoError(t, os.WriteFile(filepath.Join(target, "data"), []byte("data"), 0o600))
+	output, err := exec.Command("xfs_io", "-x", "-c", "shutdown -f", target).CombinedOutput() //nolint:gosec // test
+	require.NoError(t, err, string(output))
+	require.NoError(t, m.Unmount(ctx, target))
+
+	clone := newLoopDeviceCopy(t, m, dev, uuid.NewString())
+	clonePartition, err := m.GetDeviceLastPartition(ctx, clone)
+	require.NoError(t, err)
+
+	// source filesystem with the same UUID is mounted while the UUID of the clone is changed
+	require.NoError(t, m.Mount(ctx, partition, target, "xfs"))
+	t.Cleanup(func() {
+		assert.NoError(t, m.Unmount(ctx, target))
+	})
+	before := filesystemUUID(t, clonePartition)
+	require.NoError(t, m.RegenerateUUID(ctx, clonePartition))
+	after := filesystemUUID(t, clonePartition)
+	assert.NotEqual(t, before, after)
+
+	cloneTarget := t.TempDir()
+	require.NoError(t, m.Mount(ctx, clonePartition, cloneTarget, "xfs"))
+	data, err := os.ReadFile(filepath.Join(cloneTarget, "data"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+	require.NoError(t, m.Unmount(ctx, cloneTarget))
+}
+
+func TestLinuxFilesystem_LoopDevice_Check(t *testing.T) {
+	t.Parallel()
+	requireLoopDeviceSupport(t)
+	for fsType, tools := range map[string][]string{
+		"ext4": {"mkfs.ext4", e2fsckCmd},
+		"xfs":  {"mkfs.xfs", xfsRepairCmd},
+	} {
+		fsType, tools := fsType, tools
+		t.Run(fsType, func(t *testing.T) {
+			t.Parallel()
+			requireTools(t, tools...)
+			ctx := context.Background()
+			m := newLoopTestFilesystem(t)
+			dev := newLoopDevice(t, m, uuid.NewString())
+			require.NoError(t, m.Format(ctx, dev, fsType, nil))
+			partition, err := m.GetDeviceLastPartition(ctx, dev)
+			require.NoError(t, err)
+
+			result, err := m.Check(ctx, partition)
+			require.NoError(t, err)
+			assert.False(t, result.NeedsRepair)
+			assert.NotEmpty(t, result.Message)
+
+			result, err = m.Repair(ctx, partition)
+			require.NoError(t, err)
+			assert.False(t, result.Repaired)
+			assert.NotEmpty(t, result.Message)
+		})
+	}
+}
+
+func filesystemUUID(t *testing.T, device string) string {
+	t.Helper()
+	output, err := exec.Command(blkidCmd, "--probe", "--output", "value", "--match-tag", "UUID", device).CombinedOutput() //nolint:gosec // test
+	require.NoError(t, err, string(output))
+	return strings.TrimSpace(string(output))
+}
+
+func requireLoopDeviceSupport(t *testing.T) {
+	t.Helper()
+	if os.Getuid() != 0 {
+		t.Skip("loop device tests require root privileges")
+	}
+	requireTools(t, "losetup", "mount", "umount", "blkid", "findmnt", partedCmd, sfdiskCmd, partxCmd)
+}
+
+func requireTools(t *testing.T, tools ...string) {
+	t.Helper()
+	if err := checkToolsExists(tools...); err != nil {
+		t.Skipf("skipping test: %s", err.Error())
+	}
+}
+
+func newLoopTestFilesystem(t *testing.T) *LinuxFilesystem {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	m, _ := NewLinuxFilesystem(loopDeviceFilesystemTypes, logger.WithFields(nil))
+	m.diskByIDPath = filepath.Join(t.TempDir(), "disk", "by-id")
+	require.NoError(t, os.MkdirAll(m.diskByIDPath, 0o750))
+	return m
+}
+
+// newLoopDevice attaches sparse file to loop device and links it to filesystem's disk ID directory
+// the same way udev links virtio disks, e.g. virtio-014e425736724563ab83 -> ../../loop0.
+func newLoopDevice(t *testing.T, m *LinuxFilesystem, volumeID string) string {
+	t.Helper()
+	disk := filepath.Join(t.TempDir(), "disk.img")
+	f, err := os.Create(disk)
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(loopDeviceSize))
+	require.NoError(t, f.Close())
+	return attachLoopDevice(t, m, disk, volumeID)
+}
+
+// newLoopDeviceCopy attaches copy of the loop device's disk to a new loop device, the same way cloned storage is
+// attached to the node.
+func newLoopDeviceCopy(t *testing.T, m *LinuxFilesystem, dev, volumeID string) string {
+	t.Helper()
+	output, err := exec.Command("losetup", "--noheadings", "--output", "BACK-FILE", dev).CombinedOutput() //nolint:gosec // test
+	require.NoError(t, err, string(output))
+	disk := filepath.Join(t.TempDir(), "disk.img")
+	output, err = exec.Command("cp", "--sparse=always", strings.TrimSpace(string(output)), disk).CombinedOutput() //nolint:gosec // test
+	require.NoError(t, err, string(output))
+	return attachLoopDevice(t, m, disk, volumeID)
+}
+
+func attachLoopDevice(t *testing.T, m *LinuxFilesystem, disk, volumeID string) string {
+	t.Helper()
+	output, err := exec.Command("losetup", "--find", "--show", "--partscan", disk).CombinedOutput() //nolint:gosec // test
+	if err != nil {
+		t.Skipf("skipping test: unable to create loop device: %s; %s", strings.TrimSpace(string(output)), err)
+	}
+	dev := strings.TrimSpace(string(output))
+	t.Cleanup(func() {
+		if output, err := exec.Command("losetup", "--detach", dev).CombinedOutput(); err != nil { //nolint:gosec // test
+			t.Logf("failed to detach loop device %s: %s; %s", dev, output, err)
+		}
+	})
+
+	diskID, err := volumeIDToDiskID(volumeID)
+	require.NoError(t, err)
+	require.NoError(t, os.Symlink(dev, filepath.Join(m.diskByIDPath, diskID)))
+	t.Logf("created loop device %s with disk ID %s", dev, diskID)
+	return dev
+}
+
+// newSharedMountDir returns directory which is bind mounted with shared propagation, so that mounts created
+// under it are shared the same way as mounts under kubelet's directory.
+func newSharedMountDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, args := range [][]string{{"--bind", dir, dir}, {"--make-shared", dir}} {
+		if output, err := exec.Command("mount", args...).CombinedOutput(); err != nil { //nolint:gosec // test
+			t.Fatalf("mount %s failed: %s; %s", strings.Join(args, " "), output, err)
+		}
+	}
+	t.Cleanup(func() {
+		if output, err := exec.Command("umount", dir).CombinedOutput(); err != nil { //nolint:gosec // test
+			t.Logf("failed to unmount %s: %s; %s", dir, output, err)
+		}
+	})
+	return dir
+}
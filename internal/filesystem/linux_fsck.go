@@ -0,0 +1,136 @@
+package filesystem
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/UpCloudLtd/upcloud-csi/internal/logger"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// e2fsck exit codes are bit flags, see e2fsck(8).
+	e2fsckErrCodeReboot      = 2
+	e2fsckErrCodeUncorrected = 4
+	e2fsckErrCodeOperational = 8
+	// xfsRepairErrCodeCorrupted is returned by xfs_repair in no modify mode when corruption was detected.
+	xfsRepairErrCodeCorrupted = 1
+	// xfsRepairErrCodeDirtyLog is returned by xfs_repair when log needs to be replayed before the repair.
+	xfsRepairErrCodeDirtyLog = 2
+)
+
+// Check checks the unmounted filesystem in the device without modifying it. Result's NeedsRepair is set if errors
+// were found, in which case filesystem needs to be repaired using Repair before it's mounted.
+func (m *LinuxFilesystem) Check(ctx context.Context, device string) (CheckResult, error) {
+	fsType, err := m.checkedFilesystemType(ctx, device)
+	if err != nil {
+		return CheckResult{}, err
+	}
+	if fsType == "xfs" {
+		return m.checkXFS(ctx, device)
+	}
+	return m.checkExt(ctx, device)
+}
+
+// Repair repairs errors of the unmounted filesystem in the device that can be repaired without losing data.
+// ErrFilesystemCorrupted is returned if filesystem has errors that need to be repaired manually. Repair shouldn't be
+// interrupted, as interrupted repair may leave the filesystem in a state that needs manual repair.
+func (m *LinuxFilesystem) Repair(ctx context.Context, device string) (CheckResult, error) {
+	fsType, err := m.checkedFilesystemType(ctx, device)
+	if err != nil {
+		return CheckResult{}, err
+	}
+	if fsType == "xfs" {
+		return m.repairXFS(ctx, device)
+	}
+	return m.repairExt(ctx, device)
+}
+
+func (m *LinuxFilesystem) checkedFilesystemType(ctx context.Context, device string) (string, error) {
+	if device == "" {
+		return "", fmt.Errorf("device is not specified for checking the filesystem")
+	}
+	fsType, err := m.filesystemType(ctx, device)
+	if err != nil {
+		return "", err
+	}
+	switch fsType {
+	case "ext2", "ext3", "ext4", "xfs":
+		return fsType, nil
+	default:
+		return "", fmt.Errorf("checking filesystem type '%s' is not supported", fsType)
+	}
+}
+
+// checkExt checks ext filesystem in no modify mode. Journal is not replayed, so errors that replaying the journal
+// would fix are reported as well.
+func (m *LinuxFilesystem) checkExt(ctx context.Context, device string) (CheckResult, error) {
+	output, err := m.runCheckCmd(ctx, e2fsckCmd, "-n", device)
+	if err == nil {
+		return CheckResult{Message: "e2fsck found no errors"}, nil
+	}
+	if code := cmdExitCode(err); code > 0 && code&e2fsckErrCodeOperational == 0 && code&e2fsckErrCodeUncorrected != 0 {
+		return CheckResult{NeedsRepair: true, Message: "e2fsck found errors"}, nil
+	}
+	return CheckResult{}, fmt.Errorf("failed to check filesystem %s (%s); %w", device, formatCmdError(output), err)
+}
+
+// repairExt repairs ext filesystem in preen mode, which replays the journal and repairs errors that can be safely
+// repaired without human intervention.
+func (m *LinuxFilesystem) repairExt(ctx context.Context, device string) (CheckResult, error) {
+	output, err := m.runCheckCmd(ctx, e2fsckCmd, "-p", device)
+	if err == nil {
+		return CheckResult{Message: "e2fsck found no errors after journal was replayed"}, nil
+	}
+	code := cmdExitCode(err)
+	switch {
+	case code <= 0 || code&e2fsckErrCodeOperational != 0:
+		return CheckResult{}, fmt.Errorf("failed to repair filesystem %s (%s); %w", device, formatCmdError(output), err)
+	case code&e2fsckErrCodeUncorrected != 0:
+		return CheckResult{}, fmt.Errorf("e2fsck found errors in %s that need to be repaired manually (%s); %w", device, formatCmdError(output), ErrFilesystemCorrupted)
+	case code&(e2fsckErrCodeCorrected|e2fsckErrCodeReboot) != 0:
+		return CheckResult{Repaired: true, Message: "e2fsck repaired filesystem errors"}, nil
+	}
+	return CheckResult{}, fmt.Errorf("failed to repair filesystem %s (%s); %w", device, formatCmdError(output), err)
+}
+
+// checkXFS checks XFS filesystem in no modify mode. Dirty log is reported as an error, as xfs_repair can't check
+// the filesystem before the log is replayed.
+func (m *LinuxFilesystem) checkXFS(ctx context.Context, device string) (CheckResult, error) {
+	output, err := m.runCheckCmd(ctx, xfsRepairCmd, "-n", device)
+	if err == nil {
+		return CheckResult{Message: "xfs_repair found no errors"}, nil
+	}
+	switch cmdExitCode(err) {
+	case xfsRepairErrCodeCorrupted:
+		return CheckResult{NeedsRepair: true, Message: "xfs_repair found errors"}, nil
+	case xfsRepairErrCodeDirtyLog:
+		return CheckResult{NeedsRepair: true, Message: "xfs_repair found dirty log"}, nil
+	}
+	return CheckResult{}, fmt.Errorf("failed to check filesystem %s (%s); %w", device, formatCmdError(output), err)
+}
+
+// repairXFS mounts and unmounts the filesystem to replay the log before the repair, as xfs_repair would otherwise
+// need to discard the log. Errors can be caused by unreplayed log, so filesystem is checked again after the replay.
+func (m *LinuxFilesystem) repairXFS(ctx context.Context, device string) (CheckResult, error) {
+	// filesystem that can't be mounted is regarded as corrupted, as repairing it requires discarding the log
+	if err := m.replayXFSLog(ctx, device); err != nil {
+		return CheckResult{}, fmt.Errorf("%s, repair requires discarding the log; %w", err.Error(), ErrFilesystemCorrupted)
+	}
+	output, err := m.runCheckCmd(ctx, xfsRepairCmd, "-n", device)
+	if err == nil {
+		return CheckResult{Message: "xfs_repair found no errors after log was replayed"}, nil
+	}
+	if cmdExitCode(err) != xfsRepairErrCodeCorrupted {
+		return CheckResult{}, fmt.Errorf("failed to check filesystem %s (%s); %w", device, formatCmdError(output), err)
+	}
+	if output, err = m.runCheckCmd(ctx, xfsRepairCmd, device); err != nil {
+		return CheckResult{}, fmt.Errorf("xfs_repair failed to repair %s (%s); %w", device, formatCmdError(output), ErrFilesystemCorrupted)
+	}
+	return CheckResult{Repaired: true, Message: "xfs_repair repaired filesystem errors"}, nil
+}
+
+func (m *LinuxFilesystem) runCheckCmd(ctx context.Context, name string, args ...string) ([]byte, error) {
+	logger.WithServerContext(ctx, m.log).WithFields(logrus.Fields{logger.CommandKey: name, logger.CommandArgsKey: args}).Debug("executing command")
+	return runCmd(ctx, name, args...)
+}
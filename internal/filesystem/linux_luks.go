@@ -0,0 +1,190 @@
+package filesystem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/UpCloudLtd/upcloud-csi/internal/logger"
+	"github.com/UpCloudLtd/upcloud-csi/internal/tracing"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	cryptsetupCmd = "cryptsetup"
+	// cryptsetupErrCodePermission is returned by cryptsetup when device can't be unlocked using the passphrase.
+	cryptsetupErrCodePermission = 2
+	// luksType is the blkid type of LUKS device.
+	luksType         = "crypto_luks"
+	deviceMapperPath = "/dev/mapper"
+	sysClassBlock    = "/sys/class/block"
+)
+
+// LuksFormat initializes LUKS2 header to the device using the passphrase, if the device isn't LUKS device already.
+// Device that contains other filesystem or partition table signature is not formatted.
+func (m *LinuxFilesystem) LuksFormat(ctx context.Context, device, passphrase string) error {
+	if device == "" {
+		return errors.New("device is not specified for formatting LUKS device")
+	}
+	if passphrase == "" {
+		return errors.New("passphrase is not specified for formatting LUKS device")
+	}
+	deviceType, err := m.deviceType(ctx, device)
+	if err != nil {
+		return err
+	}
+	log := logger.WithServerContext(ctx, m.log).WithField("device", device)
+	switch deviceType {
+	case luksType:
+		log.Info("existing LUKS header found")
+		return nil
+	case "":
+	default:
+		return fmt.Errorf("device %s contains %s signature, refusing to format it as LUKS device", device, deviceType)
+	}
+	args := []string{"luksFormat", "--batch-mode", "--type", "luks2", "--key-file", "-", device}
+	log.WithFields(logrus.Fields{logger.CommandKey: cryptsetupCmd, logger.CommandArgsKey: args}).Debug("executing command")
+	if output, err := runCmdWithInput(ctx, strings.NewReader(passphrase), cryptsetupCmd, args...); err != nil {
+		return fmt.Errorf("failed to format LUKS device %s (%s); %w", device, formatCmdError(output), err)
+	}
+	return nil
+}
+
+// LuksOpen opens LUKS device to the mapping with the given name and returns the path of the mapped device.
+// Volume key is stored to the mapping instead of kernel keyring, so that the mapping can be resized without the passphrase.
+// Mapping that is already open is returned as is. ErrInvalidPassphrase is returned if passphrase doesn't unlock the device.
+func (m *LinuxFilesystem) LuksOpen(ctx context.Context, device, name, passphrase string, readOnly bool) (string, error) {
+	if device == "" {
+		return "", errors.New("device is not specified for opening LUKS device")
+	}
+	if name == "" {
+		return "", errors.New("mapping name is not specified for opening LUKS device")
+	}
+	mapping := filepath.Join(deviceMapperPath, name)
+	log := logger.WithServerContext(ctx, m.log).WithFields(logrus.Fields{"device": device, "mapping": mapping})
+	if _, err := os.Stat(mapping); err == nil {
+		log.Info("LUKS mapping is already open")
+		return mapping, nil
+	}
+	args := []string{"luksOpen", "--disable-keyring", "--key-file", "-"}
+	if readOnly {
+		args = append(args, "--readonly")
+	}
+	args = append(args, device, name)
+	log.WithFields(logrus.Fields{logger.CommandKey: cryptsetupCmd, logger.CommandArgsKey: args}).Debug("executing command")
+	if output, err := runCmdWithInput(ctx, strings.NewReader(passphrase), cryptsetupCmd, args...); err != nil {
+		if cmdExitCode(err) == cryptsetupErrCodePermission {
+			return "", fmt.Errorf("failed to open LUKS device %s; %w", device, ErrInvalidPassphrase)
+		}
+		return "", fmt.Errorf("failed to open LUKS device %s (%s); %w", device, formatCmdError(output), err)
+	}
+	return mapping, nil
+}
+
+// LuksClose closes LUKS mapping with the given name. Closing mapping that is not open is not regarded as an error.
+func (m *LinuxFilesystem) LuksClose(ctx context.Context, name string) error {
+	if name == "" {
+		return errors.New("mapping name is not specified for closing LUKS device")
+	}
+	if _, err := os.Stat(filepath.Join(deviceMapperPath, name)); os.IsNotExist(err) {
+		return nil
+	}
+	args := []string{"luksClose", name}
+	logger.WithServerContext(ctx, m.log).WithFields(logrus.Fields{logger.CommandKey: cryptsetupCmd, logger.CommandArgsKey: args}).Debug("executing command")
+	if output, err := runCmd(ctx, cryptsetupCmd, args...); err != nil {
+		return fmt.Errorf("failed to close LUKS mapping %s (%s); %w", name, formatCmdError(output), err)
+	}
+	return nil
+}
+
+// LuksChangeKey replaces the passphrase of the LUKS device with the new passphrase. ErrInvalidPassphrase is returned
+// if current passphrase doesn't unlock the device.
+func (m *LinuxFilesystem) LuksChangeKey(ctx context.Context, device, passphrase, newPassphrase string) error {
+	if device == "" {
+		return errors.New("device is not specified for changing LUKS passphrase")
+	}
+	if newPassphrase == "" {
+		return errors.New("new passphrase is not specified for changing LUKS passphrase")
+	}
+	// current passphrase is read from stdin and new passphrase from the pipe passed as file descriptor 3
+	args := []string{"luksChangeKey", "--batch-mode", "--key-file", "-", device, "/dev/fd/3"}
+	logger.WithServerContext(ctx, m.log).WithFields(logrus.Fields{logger.CommandKey: cryptsetupCmd, logger.CommandArgsKey: args}).Debug("executing command")
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	go func() {
+		_, _ = io.WriteString(w, newPassphrase)
+		w.Close()
+	}()
+
+	ctx, span := tracing.Start(ctx, "exec "+cryptsetupCmd,
+		attribute.String(logger.CommandKey, cryptsetupCmd),
+		attribute.StringSlice(logger.CommandArgsKey, args),
+	)
+	cmd := exec.CommandContext(ctx, cryptsetupCmd, args...)
+	cmd.Stdin = strings.NewReader(passphrase)
+	cmd.ExtraFiles = []*os.File{r}
+	output, err := cmd.CombinedOutput()
+	tracing.End(span, err)
+	if err != nil {
+		if cmdExitCode(err) == cryptsetupErrCodePermission {
+			return fmt.Errorf("failed to change LUKS device %s passphrase; %w", device, ErrInvalidPassphrase)
+		}
+		return fmt.Errorf("failed to change LUKS device %s passphrase (%s); %w", device, formatCmdError(output), err)
+	}
+	return nil
+}
+
+// luksResize resizes LUKS mapping of the partition to fill the whole partition and returns the path of the mapped device.
+func (m *LinuxFilesystem) luksResize(ctx context.Context, partition string) (string, error) {
+	name, err := luksMappingName(sysClassBlock, partition)
+	if err != nil {
+		return "", err
+	}
+	args := []string{"resize", name}
+	logger.WithServerContext(ctx, m.log).WithFields(logrus.Fields{logger.CommandKey: cryptsetupCmd, logger.CommandArgsKey: args}).Debug("executing command")
+	if output, err := runCmd(ctx, cryptsetupCmd, args...); err != nil {
+		return "", fmt.Errorf("failed to resize LUKS mapping %s (%s); %w", name, formatCmdError(output), err)
+	}
+	return filepath.Join(deviceMapperPath, name), nil
+}
+
+// deviceType returns the type of the filesystem or other signature (e.g. crypto_luks) found from the device,
+// or empty string if device doesn't have known signature.
+func (m *LinuxFilesystem) deviceType(ctx context.Context, device string) (string, error) {
+	blkidArgs := []string{"--probe", "--output", "value", "--match-tag", "TYPE", "--match-tag", "PTTYPE", device}
+	logger.WithServerContext(ctx, m.log).WithFields(logrus.Fields{logger.CommandKey: blkidCmd, logger.CommandArgsKey: blkidArgs}).Debug("executing command")
+	output, err := exec.CommandContext(ctx, blkidCmd, blkidArgs...).CombinedOutput()
+	if err != nil {
+		if cmdExitCode(err) == blkidCmdErrCodeNotFound {
+			return "", nil
+		}
+		return "", fmt.Errorf("checking device %s type failed: %w (%s)", device, err, formatCmdError(output))
+	}
+	return strings.Join(strings.Fields(strings.ToLower(string(output))), " "), nil
+}
+
+// luksMappingName returns the name of device mapper device that holds the partition, e.g. /dev/vda1 -> luks-vda1.
+func luksMappingName(sysBlockPath, partition string) (string, error) {
+	holders, err := os.ReadDir(filepath.Join(sysBlockPath, filepath.Base(partition), "holders"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s holders; %w", partition, err)
+	}
+	if len(holders) == 0 {
+		return "", fmt.Errorf("LUKS device %s is not open", partition)
+	}
+	name, err := os.ReadFile(filepath.Join(sysBlockPath, holders[0].Name(), "dm", "name"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s mapping name; %w", partition, err)
+	}
+	return strings.TrimSpace(string(name)), nil
+}
@@ -4,11 +4,18 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
+	"unicode"
+
+	"github.com/UpCloudLtd/upcloud-csi/internal/logger"
+	"github.com/UpCloudLtd/upcloud-csi/internal/metrics"
+	"github.com/UpCloudLtd/upcloud-csi/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var (
@@ -19,10 +26,11 @@ var (
 
 // getBlockDeviceByDiskID returns actual block device path (e.g. /dev/vda) that correspond to disk ID (hardware serial number).
 // diskID can be udev disk ID or path to disk ID symbolic link e.g. /dev/disk/by-id/virtio-014e425736724563ab83.
-func getBlockDeviceByDiskID(ctx context.Context, diskID string) (dev string, err error) {
+// Relative disk ID is looked up from diskByIDPath directory.
+func getBlockDeviceByDiskID(ctx context.Context, diskByIDPath, diskID string) (dev string, err error) {
 	ln := diskID
 	if !filepath.IsAbs(diskID) {
-		ln = filepath.Join(udevDiskByIDPath, diskID)
+		ln = filepath.Join(diskByIDPath, diskID)
 	}
 
 	if err := udevWaitDiskToSettle(ctx, ln); err != nil {
@@ -57,12 +65,13 @@ func getBlockDeviceByDiskID(ctx context.Context, diskID string) (dev string, err
 // udevWaitDiskToSettle uses udevadm to wait events in event queue to be handled.
 func udevWaitDiskToSettle(ctx context.Context, path string) error {
 	if udevadm, err := exec.LookPath("udevadm"); err == nil {
-		return exec.CommandContext(ctx,
+		_, err := runCmd(ctx,
 			udevadm,
 			"settle",
 			fmt.Sprintf("--timeout=%d", udevSettleTimeout),
 			fmt.Sprintf("--exit-if-exists=%s", path),
-		).Run()
+		)
+		return err
 	}
 	return nil
 }
@@ -92,6 +101,89 @@ func sfdiskOutputGetLastPartition(source, sfdiskOutput string) (string, error) {
 	return lastPartition, nil
 }
 
+// lsblkOutputGetDisk returns the disk from lsblk output that lists the source device and devices it depends on.
+// Loop device is regarded as a disk.
+func lsblkOutputGetDisk(source, lsblkOutput string) (string, error) {
+	for _, line := range strings.Split(lsblkOutput, "\n") {
+		name, devType, ok := strings.Cut(strings.TrimSpace(line), " ")
+		if devType = strings.TrimSpace(devType); ok && (devType == "disk" || devType == "loop") {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("unable to read disk of %s from lsblk output [%s]", source, strings.Join(strings.Split(strings.TrimSpace(lsblkOutput), "\n"), ", "))
+}
+
+// partitionNumber returns partition number from the partition device path e.g. /dev/vda1 -> 1.
+func partitionNumber(partition string) (string, error) {
+	i := strings.LastIndexFunc(partition, func(r rune) bool {
+		return !unicode.IsDigit(r)
+	})
+	if i < 0 || i == len(partition)-1 {
+		return "", fmt.Errorf("unable to parse partition number from '%s'", partition)
+	}
+	return partition[i+1:], nil
+}
+
+// rescanDevice requests kernel to re-read device size. Virtio block devices are updated by the kernel automatically
+// and they don't provide rescan interface, so missing rescan interface is not regarded as an error.
+func rescanDevice(device string) error {
+	rescan := filepath.Join(sysClassBlock, filepath.Base(device), "device", "rescan")
+	if _, err := os.Stat(rescan); err != nil {
+		return nil //nolint:nilerr // rescan is not supported by the device
+	}
+	return os.WriteFile(rescan, []byte("1"), 0o200)
+}
+
+// filesystemResizeCmd returns command used to grow filesystem of the given type.
+func filesystemResizeCmd(fsType string) string {
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		return resize2fsCmd
+	case "xfs":
+		return xfsGrowfsCmd
+	}
+	return ""
+}
+
+// mountEntry is a mount table entry listed by findmnt.
+type mountEntry struct {
+	Target string `json:"target"`
+	MajMin string `json:"maj:min"`
+	FsRoot string `json:"fsroot"`
+}
+
+// mountTargets returns targets of mounts that mount the same directory or file as the source path. Mounted tree is
+// identified by device number and path within the filesystem, which bind mounts share with the original mount.
+// Mount containing the source is the last mount, whose target is the longest prefix of the source path.
+func mountTargets(mounts []mountEntry, source string) []string {
+	source = filepath.Clean(source)
+	var containing *mountEntry
+	for i := range mounts {
+		target := filepath.Clean(mounts[i].Target)
+		if target != source && !strings.HasPrefix(source, strings.TrimSuffix(target, "/")+"/") {
+			continue
+		}
+		if containing == nil || len(target) >= len(filepath.Clean(containing.Target)) {
+			containing = &mounts[i]
+		}
+	}
+	if containing == nil {
+		return nil
+	}
+	rel, err := filepath.Rel(filepath.Clean(containing.Target), source)
+	if err != nil {
+		return nil
+	}
+	fsRoot := filepath.Join("/", containing.FsRoot, rel)
+	targets := make([]string, 0)
+	for _, mnt := range mounts {
+		if mnt.MajMin == containing.MajMin && filepath.Join("/", mnt.FsRoot) == fsRoot {
+			targets = append(targets, mnt.Target)
+		}
+	}
+	return targets
+}
+
 func createBlockDevice(target string) error {
 	err := os.MkdirAll(filepath.Dir(target), 0o750)
 	if err != nil {
@@ -129,3 +221,44 @@ func cmdExitCode(err error) int {
 func formatCmdError(output []byte) string {
 	return strings.Join(strings.Split(string(output), "\n"), " ")
 }
+
+func observeNodeOperation(operation string, start time.Time) {
+	metrics.ObserveNodeOperation(operation, time.Since(start))
+}
+
+// checkSharedPropagation checks that mount containing the path has shared propagation, so that volumes mounted by
+// the driver are visible to kubelet and pods.
+func checkSharedPropagation(ctx context.Context, path string) error {
+	output, err := exec.CommandContext(ctx, "findmnt", "-n", "-o", "PROPAGATION", "-T", path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to find mount of %s (%s); %w", path, formatCmdError(output), err)
+	}
+	if propagation := strings.TrimSpace(string(output)); !strings.Contains(propagation, "shared") {
+		return fmt.Errorf("mount propagation of %s is %q, shared propagation is required", path, propagation)
+	}
+	return nil
+}
+
+// runCmd executes command and returns its combined output. Command is recorded as a span of the calling operation.
+func runCmd(ctx context.Context, name string, args ...string) ([]byte, error) {
+	ctx, span := tracing.Start(ctx, "exec "+filepath.Base(name),
+		attribute.String(logger.CommandKey, name),
+		attribute.StringSlice(logger.CommandArgsKey, args),
+	)
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	tracing.End(span, err)
+	return output, err
+}
+
+// runCmdWithInput executes command like runCmd, but writes input to command's standard input. Input is not recorded.
+func runCmdWithInput(ctx context.Context, input io.Reader, name string, args ...string) ([]byte, error) {
+	ctx, span := tracing.Start(ctx, "exec "+filepath.Base(name),
+		attribute.String(logger.CommandKey, name),
+		attribute.StringSlice(logger.CommandArgsKey, args),
+	)
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = input
+	output, err := cmd.CombinedOutput()
+	tracing.End(span, err)
+	return output, err
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/UpCloudLtd/upcloud-csi/internal/filesystem"
 	"github.com/sirupsen/logrus"
@@ -13,17 +15,48 @@ import (
 
 type MockFilesystem struct {
 	log *logrus.Logger
+
+	// luksDevices contains passphrases of LUKS formatted devices, keyed by device.
+	luksDevices   map[string]string
+	luksDevicesMu sync.Mutex
+
+	// partitionNames contains GPT names of partitions, keyed by partition.
+	partitionNames   map[string]string
+	partitionNamesMu sync.Mutex
+
+	// mounts contains sources of mounts, keyed by target.
+	mounts   map[string]string
+	mountsMu sync.Mutex
 }
 
 func NewFilesystem(log *logrus.Logger) filesystem.Filesystem {
-	return &MockFilesystem{log: log}
+	return &MockFilesystem{log: log, luksDevices: make(map[string]string), partitionNames: make(map[string]string), mounts: make(map[string]string)}
 }
 
 func (m *MockFilesystem) Format(ctx context.Context, source, fsType string, mkfsArgs []string) error {
+	partition, _ := m.GetDeviceLastPartition(ctx, source)
+	m.luksDevicesMu.Lock()
+	_, isLuks := m.luksDevices[partition]
+	m.luksDevicesMu.Unlock()
+	if isLuks {
+		m.log.Debugf("Mock Format(%s, %s, [%s]) -> %s", source, fsType, mkfsArgs, filesystem.ErrLuksDevice)
+		return fmt.Errorf("%w: refusing to format partition %s", filesystem.ErrLuksDevice, partition)
+	}
 	m.log.Debugf("Mock Format(%s, %s, [%s]) -> nil", source, fsType, mkfsArgs)
 	return nil
 }
 
+func (m *MockFilesystem) Partition(ctx context.Context, source string) (string, error) {
+	partition, err := m.GetDeviceLastPartition(ctx, source)
+	m.log.Debugf("Mock Partition(%s) -> %s, %v", source, partition, err)
+	return partition, err
+}
+
+func (m *MockFilesystem) CreateFilesystem(ctx context.Context, device, fsType string, mkfsArgs []string) error {
+	m.log.Debugf("Mock CreateFilesystem(%s, %s, [%s]) -> nil", device, fsType, mkfsArgs)
+	return nil
+}
+
 func (m *MockFilesystem) IsMounted(ctx context.Context, target string) (bool, error) {
 	if _, err := os.Stat(target); os.IsNotExist(err) {
 		m.log.Debugf("Mock IsMounted(%s) -> false, nil", target)
@@ -33,7 +66,26 @@ func (m *MockFilesystem) IsMounted(ctx context.Context, target string) (bool, er
 	return true, nil
 }
 
+func (m *MockFilesystem) MountTargets(ctx context.Context, source string) ([]string, error) {
+	m.mountsMu.Lock()
+	defer m.mountsMu.Unlock()
+	targets := make([]string, 0)
+	if _, ok := m.mounts[source]; ok {
+		targets = append(targets, source)
+	}
+	for target, src := range m.mounts {
+		if src == source {
+			targets = append(targets, target)
+		}
+	}
+	m.log.Debugf("Mock MountTargets(%s) -> %v, nil", source, targets)
+	return targets, nil
+}
+
 func (m *MockFilesystem) Mount(ctx context.Context, source, target, fsType string, opts ...string) error {
+	m.mountsMu.Lock()
+	m.mounts[target] = source
+	m.mountsMu.Unlock()
 	if strings.HasPrefix(target, os.TempDir()) {
 		m.log.Debugf("Mock Mount(%s, %s, %s, [%s]) -> os.MkdirAll(%s) ", source, target, fsType, opts, target)
 		return os.MkdirAll(target, 0o750)
@@ -43,6 +95,9 @@ func (m *MockFilesystem) Mount(ctx context.Context, source, target, fsType strin
 }
 
 func (m *MockFilesystem) Unmount(ctx context.Context, path string) error {
+	m.mountsMu.Lock()
+	delete(m.mounts, path)
+	m.mountsMu.Unlock()
 	m.log.Debugf("Mock Unmount(%s) -> nil", path)
 	return nil
 }
@@ -67,6 +122,16 @@ func (m *MockFilesystem) GetDeviceByID(ctx context.Context, id string) (string,
 	return dev, nil
 }
 
+func (m *MockFilesystem) GetDeviceByMount(ctx context.Context, target string) (string, error) {
+	if mounted, _ := m.IsMounted(ctx, target); !mounted {
+		m.log.Debugf("Mock GetDeviceByMount(%s) -> not mounted", target)
+		return "", fmt.Errorf("%s is not mounted", target)
+	}
+	dev := "/dev/vda"
+	m.log.Debugf("Mock GetDeviceByMount(%s) -> %s", target, dev)
+	return dev, nil
+}
+
 func (m *MockFilesystem) GetDeviceLastPartition(ctx context.Context, source string) (string, error) {
 	if strings.HasSuffix(source, "1") {
 		m.log.Debugf("Mock GetDeviceLastPartition(%s) -> %s", source, source)
@@ -75,3 +140,78 @@ func (m *MockFilesystem) GetDeviceLastPartition(ctx context.Context, source stri
 	m.log.Debugf("Mock GetDeviceLastPartition(%s) -> %s1", source, source)
 	return fmt.Sprintf("%s1", source), nil
 }
+
+func (m *MockFilesystem) Resize(ctx context.Context, source, target string) error {
+	m.log.Debugf("Mock Resize(%s, %s) -> nil", source, target)
+	return nil
+}
+
+func (m *MockFilesystem) LuksFormat(ctx context.Context, device, passphrase string) error {
+	m.luksDevicesMu.Lock()
+	defer m.luksDevicesMu.Unlock()
+	if _, ok := m.luksDevices[device]; !ok {
+		m.luksDevices[device] = passphrase
+	}
+	m.log.Debugf("Mock LuksFormat(%s) -> nil", device)
+	return nil
+}
+
+func (m *MockFilesystem) LuksOpen(ctx context.Context, device, name, passphrase string, readOnly bool) (string, error) {
+	m.luksDevicesMu.Lock()
+	defer m.luksDevicesMu.Unlock()
+	if p, ok := m.luksDevices[device]; !ok || p != passphrase {
+		m.log.Debugf("Mock LuksOpen(%s, %s, %t) -> %s", device, name, readOnly, filesystem.ErrInvalidPassphrase)
+		return "", filesystem.ErrInvalidPassphrase
+	}
+	mapping := filepath.Join("/dev/mapper", name)
+	m.log.Debugf("Mock LuksOpen(%s, %s, %t) -> %s, nil", device, name, readOnly, mapping)
+	return mapping, nil
+}
+
+func (m *MockFilesystem) LuksClose(ctx context.Context, name string) error {
+	m.log.Debugf("Mock LuksClose(%s) -> nil", name)
+	return nil
+}
+
+func (m *MockFilesystem) LuksChangeKey(ctx context.Context, device, passphrase, newPassphrase string) error {
+	m.luksDevicesMu.Lock()
+	defer m.luksDevicesMu.Unlock()
+	if p, ok := m.luksDevices[device]; !ok || p != passphrase {
+		m.log.Debugf("Mock LuksChangeKey(%s) -> %s", device, filesystem.ErrInvalidPassphrase)
+		return filesystem.ErrInvalidPassphrase
+	}
+	m.luksDevices[device] = newPassphrase
+	m.log.Debugf("Mock LuksChangeKey(%s) -> nil", device)
+	return nil
+}
+
+func (m *MockFilesystem) PartitionName(ctx context.Context, partition string) (string, error) {
+	m.partitionNamesMu.Lock()
+	defer m.partitionNamesMu.Unlock()
+	name := m.partitionNames[partition]
+	m.log.Debugf("Mock PartitionName(%s) -> %s, nil", partition, name)
+	return name, nil
+}
+
+func (m *MockFilesystem) SetPartitionName(ctx context.Context, source, partition, name string) error {
+	m.partitionNamesMu.Lock()
+	defer m.partitionNamesMu.Unlock()
+	m.partitionNames[partition] = name
+	m.log.Debugf("Mock SetPartitionName(%s, %s, %s) -> nil", source, partition, name)
+	return nil
+}
+
+func (m *MockFilesystem) RegenerateUUID(ctx context.Context, device string) error {
+	m.log.Debugf("Mock RegenerateUUID(%s) -> nil", device)
+	return nil
+}
+
+func (m *MockFilesystem) Check(ctx context.Context, device string) (filesystem.CheckResult, error) {
+	m.log.Debugf("Mock Check(%s) -> clean", device)
+	return filesystem.CheckResult{Message: "filesystem check found no errors"}, nil
+}
+
+func (m *MockFilesystem) Repair(ctx context.Context, device string) (filesystem.CheckResult, error) {
+	m.log.Debugf("Mock Repair(%s) -> clean", device)
+	return filesystem.CheckResult{Message: "filesystem repair found no errors"}, nil
+}
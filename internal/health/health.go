@@ -0,0 +1,97 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StatusOK          string = "ok"
+	StatusUnavailable string = "unavailable"
+
+	// checkTimeout specifies a time limit for running all the checks.
+	checkTimeout = 10 * time.Second
+	// defaultCacheTTL specifies how long check results are reused. Probes are called frequently and some of the
+	// checks call UpCloud API, so results are cached to keep API usage low.
+	defaultCacheTTL = 10 * time.Second
+)
+
+// Check is a named readiness check. Check returns an error describing the reason why plugin is not ready.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// Result is outcome of a single check.
+type Result struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Report is outcome of all the checks.
+type Report struct {
+	Status string   `json:"status"`
+	Checks []Result `json:"checks"`
+}
+
+// Ready reports whether every check passed.
+func (r Report) Ready() bool {
+	return r.Status == StatusOK
+}
+
+// Reason returns errors of failed checks.
+func (r Report) Reason() string {
+	reasons := make([]string, 0)
+	for _, c := range r.Checks {
+		if c.Status != StatusOK {
+			reasons = append(reasons, fmt.Sprintf("%s: %s", c.Name, c.Error))
+		}
+	}
+	return strings.Join(reasons, "; ")
+}
+
+// Checker runs readiness checks and caches the report.
+type Checker struct {
+	checks   []Check
+	cacheTTL time.Duration
+
+	mu        sync.Mutex
+	report    Report
+	checkedAt time.Time
+}
+
+func NewChecker(checks ...Check) *Checker {
+	return &Checker{checks: checks, cacheTTL: defaultCacheTTL}
+}
+
+// Check runs checks and returns report. Cached report is returned if checks were run recently.
+// Nil checker has no checks and is always ready.
+func (c *Checker) Check(ctx context.Context) Report {
+	if c == nil {
+		return Report{Status: StatusOK, Checks: []Result{}}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.checkedAt.IsZero() && time.Since(c.checkedAt) < c.cacheTTL {
+		return c.report
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	report := Report{Status: StatusOK, Checks: make([]Result, len(c.checks))}
+	for i, check := range c.checks {
+		report.Checks[i] = Result{Name: check.Name, Status: StatusOK}
+		if err := check.Run(ctx); err != nil {
+			report.Status = StatusUnavailable
+			report.Checks[i].Status = StatusUnavailable
+			report.Checks[i].Error = err.Error()
+		}
+	}
+	c.report = report
+	c.checkedAt = time.Now()
+	return report
+}
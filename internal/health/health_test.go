@@ -0,0 +1,52 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecker_Check(t *testing.T) {
+	t.Parallel()
+
+	calls := 0
+	apiErr := errors.New("invalid credentials")
+	c := NewChecker(
+		Check{Name: "tools", Run: func(context.Context) error { return nil }},
+		Check{Name: "api", Run: func(context.Context) error {
+			calls++
+			return apiErr
+		}},
+	)
+
+	r := c.Check(context.Background())
+	assert.False(t, r.Ready())
+	assert.Equal(t, StatusUnavailable, r.Status)
+	assert.Equal(t, []Result{
+		{Name: "tools", Status: StatusOK},
+		{Name: "api", Status: StatusUnavailable, Error: "invalid credentials"},
+	}, r.Checks)
+	assert.Equal(t, "api: invalid credentials", r.Reason())
+
+	// report is cached
+	apiErr = nil
+	assert.False(t, c.Check(context.Background()).Ready())
+	assert.Equal(t, 1, calls)
+
+	c.cacheTTL = 0
+	r = c.Check(context.Background())
+	assert.True(t, r.Ready())
+	assert.Equal(t, "", r.Reason())
+	assert.Equal(t, 2, calls)
+}
+
+func TestChecker_Nil(t *testing.T) {
+	t.Parallel()
+
+	var c *Checker
+	r := c.Check(context.Background())
+	assert.True(t, r.Ready())
+	assert.Empty(t, r.Checks)
+}
@@ -3,19 +3,24 @@ package identity
 import (
 	"context"
 
+	"github.com/UpCloudLtd/upcloud-csi/internal/health"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/protobuf/ptypes/wrappers"
 	"github.com/sirupsen/logrus"
 )
 
 type Identity struct {
+	csi.UnimplementedIdentityServer
+
 	driverName string
-	ready      bool
+	checker    *health.Checker
 	log        *logrus.Entry
 }
 
-func NewIdentity(driverName string, l *logrus.Entry) *Identity {
-	return &Identity{driverName: driverName, ready: true, log: l}
+// NewIdentity creates identity service. Plugin is reported ready once all the checker's checks pass, nil checker
+// is always ready.
+func NewIdentity(driverName string, checker *health.Checker, l *logrus.Entry) *Identity {
+	return &Identity{driverName: driverName, checker: checker, log: l}
 }
 
 // GetPluginInfo returns metadata of the plugin.
@@ -46,7 +51,7 @@ func (i *Identity) GetPluginCapabilities(ctx context.Context, req *csi.GetPlugin
 			{
 				Type: &csi.PluginCapability_VolumeExpansion_{
 					VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
-						Type: csi.PluginCapability_VolumeExpansion_OFFLINE,
+						Type: csi.PluginCapability_VolumeExpansion_ONLINE,
 					},
 				},
 			},
@@ -58,10 +63,13 @@ func (i *Identity) GetPluginCapabilities(ctx context.Context, req *csi.GetPlugin
 func (i *Identity) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
 	i.log.WithField("method", "probe").Info("check whether the plugin is ready")
 
+	report := i.checker.Check(ctx)
+	if !report.Ready() {
+		i.log.WithField("method", "probe").WithField("reason", report.Reason()).Warn("plugin is not ready")
+	}
 	return &csi.ProbeResponse{
 		Ready: &wrappers.BoolValue{
-			// TODO: should we check e.g. that network is available or that all the cli tools are available ?
-			Value: i.ready,
+			Value: report.Ready(),
 		},
 	}, nil
 }
@@ -2,33 +2,36 @@ package identity_test
 
 import (
 	"context"
+	"errors"
 	"testing"
 
+	"github.com/UpCloudLtd/upcloud-csi/internal/health"
 	"github.com/UpCloudLtd/upcloud-csi/internal/identity"
 	"github.com/UpCloudLtd/upcloud-csi/internal/logger"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestIdentity_GetPluginInfo(t *testing.T) {
 	t.Parallel()
 
-	l := logger.New("error")
-	id := identity.NewIdentity("test", l.WithField("package", "identity_test"))
-	want := csi.GetPluginInfoResponse{
+	l := logger.New("error", logger.FormatText)
+	id := identity.NewIdentity("test", nil, l.WithField("package", "identity_test"))
+	want := &csi.GetPluginInfoResponse{
 		Name: "test",
 	}
 	got, err := id.GetPluginInfo(context.TODO(), nil)
 	require.NoError(t, err)
-	require.Equal(t, want, *got)
+	require.True(t, proto.Equal(want, got), "want %v got %v", want, got)
 }
 
 func TestIdentity_GetPluginCapabilities(t *testing.T) {
 	t.Parallel()
 
-	l := logger.New("error")
-	id := identity.NewIdentity("test", l.WithField("package", "identity_test"))
-	want := csi.GetPluginCapabilitiesResponse{
+	l := logger.New("error", logger.FormatText)
+	id := identity.NewIdentity("test", nil, l.WithField("package", "identity_test"))
+	want := &csi.GetPluginCapabilitiesResponse{
 		Capabilities: []*csi.PluginCapability{
 			{
 				Type: &csi.PluginCapability_Service_{
@@ -47,7 +50,7 @@ func TestIdentity_GetPluginCapabilities(t *testing.T) {
 			{
 				Type: &csi.PluginCapability_VolumeExpansion_{
 					VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
-						Type: csi.PluginCapability_VolumeExpansion_OFFLINE,
+						Type: csi.PluginCapability_VolumeExpansion_ONLINE,
 					},
 				},
 			},
@@ -55,15 +58,25 @@ func TestIdentity_GetPluginCapabilities(t *testing.T) {
 	}
 	got, err := id.GetPluginCapabilities(context.TODO(), nil)
 	require.NoError(t, err)
-	require.Equal(t, want, *got)
+	require.True(t, proto.Equal(want, got), "want %v got %v", want, got)
 }
 
 func TestIdentity_Probe(t *testing.T) {
 	t.Parallel()
 
-	l := logger.New("error")
-	id := identity.NewIdentity("test", l.WithField("package", "identity_test"))
+	l := logger.New("error", logger.FormatText)
+	id := identity.NewIdentity("test", nil, l.WithField("package", "identity_test"))
 	got, err := id.Probe(context.TODO(), nil)
 	require.NoError(t, err)
 	require.True(t, got.Ready.Value)
+
+	id = identity.NewIdentity("test", health.NewChecker(health.Check{
+		Name: "api",
+		Run: func(context.Context) error {
+			return errors.New("invalid credentials")
+		},
+	}), l.WithField("package", "identity_test"))
+	got, err = id.Probe(context.TODO(), nil)
+	require.NoError(t, err)
+	require.False(t, got.Ready.Value)
 }
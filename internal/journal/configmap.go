@@ -0,0 +1,138 @@
+package journal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// configMapKey is the ConfigMap data key where pending operations are stored.
+const configMapKey = "operations.json"
+
+// ConfigMapJournal stores pending operations in a Kubernetes ConfigMap, so that the journal survives rescheduling
+// of the controller pod to another node. ConfigMap is updated using optimistic concurrency and update is retried
+// on conflict.
+type ConfigMapJournal struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	mu        sync.Mutex
+}
+
+// NewConfigMapJournal returns journal stored in ConfigMap referenced as `namespace/name`.
+// ConfigMap is created when the first operation is recorded.
+func NewConfigMapJournal(client kubernetes.Interface, ref string) (*ConfigMapJournal, error) {
+	namespace, name, ok := strings.Cut(ref, "/")
+	if !ok || namespace == "" || name == "" {
+		return nil, fmt.Errorf("invalid journal ConfigMap %q, expected format is namespace/name", ref)
+	}
+	if client == nil {
+		return nil, errors.New("kubernetes client is required")
+	}
+	return &ConfigMapJournal{client: client, namespace: namespace, name: name}, nil
+}
+
+func (j *ConfigMapJournal) Put(ctx context.Context, e Entry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.update(ctx, func(entries map[string]Entry) bool {
+		entries[e.Name] = e
+		return true
+	})
+}
+
+func (j *ConfigMapJournal) Complete(ctx context.Context, name string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.update(ctx, func(entries map[string]Entry) bool {
+		if _, ok := entries[name]; !ok {
+			return false
+		}
+		delete(entries, name)
+		return true
+	})
+}
+
+func (j *ConfigMapJournal) Get(ctx context.Context, name string) (Entry, bool, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, entries, err := j.read(ctx)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	e, ok := entries[name]
+	return e, ok, nil
+}
+
+func (j *ConfigMapJournal) Pending(ctx context.Context) ([]Entry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, entries, err := j.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return sortedEntries(entries), nil
+}
+
+// read returns journal ConfigMap and its entries. Returned ConfigMap is nil if it doesn't exist yet.
+func (j *ConfigMapJournal) read(ctx context.Context) (*corev1.ConfigMap, map[string]Entry, error) {
+	entries := make(map[string]Entry)
+	cm, err := j.client.CoreV1().ConfigMaps(j.namespace).Get(ctx, j.name, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, entries, nil
+		}
+		return nil, nil, fmt.Errorf("failed to read journal: %w", err)
+	}
+	if data := cm.Data[configMapKey]; data != "" {
+		if err := json.Unmarshal([]byte(data), &entries); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse journal %s/%s: %w", j.namespace, j.name, err)
+		}
+	}
+	return cm, entries, nil
+}
+
+// update applies change to the entries and writes them back if change reports that entries were modified.
+func (j *ConfigMapJournal) update(ctx context.Context, change func(map[string]Entry) bool) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, entries, err := j.read(ctx)
+		if err != nil {
+			return err
+		}
+		if !change(entries) {
+			return nil
+		}
+		b, err := json.Marshal(entries)
+		if err != nil {
+			return err
+		}
+		if cm == nil {
+			cm = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: j.namespace, Name: j.name}}
+			cm.Data = map[string]string{configMapKey: string(b)}
+			_, err = j.client.CoreV1().ConfigMaps(j.namespace).Create(ctx, cm, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				// created by another writer, retry using the latest version
+				return apierrors.NewConflict(corev1.Resource("configmaps"), j.name, err)
+			}
+		} else {
+			if cm.Data == nil {
+				cm.Data = make(map[string]string)
+			}
+			cm.Data[configMapKey] = string(b)
+			_, err = j.client.CoreV1().ConfigMaps(j.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+		}
+		if err != nil && !apierrors.IsConflict(err) {
+			return fmt.Errorf("failed to write journal: %w", err)
+		}
+		return err
+	})
+}
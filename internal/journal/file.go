@@ -0,0 +1,128 @@
+package journal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// FileJournal stores pending operations in a JSON file. File is replaced atomically on every change,
+// so it's never left partially written.
+type FileJournal struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileJournal(path string) (*FileJournal, error) {
+	if path == "" {
+		return nil, errors.New("journal file path is required")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory: %w", err)
+	}
+	return &FileJournal{path: path}, nil
+}
+
+func (j *FileJournal) Put(_ context.Context, e Entry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entries, err := j.read()
+	if err != nil {
+		return err
+	}
+	entries[e.Name] = e
+	return j.write(entries)
+}
+
+func (j *FileJournal) Complete(_ context.Context, name string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entries, err := j.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := entries[name]; !ok {
+		return nil
+	}
+	delete(entries, name)
+	return j.write(entries)
+}
+
+func (j *FileJournal) Get(_ context.Context, name string) (Entry, bool, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entries, err := j.read()
+	if err != nil {
+		return Entry{}, false, err
+	}
+	e, ok := entries[name]
+	return e, ok, nil
+}
+
+func (j *FileJournal) Pending(_ context.Context) ([]Entry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entries, err := j.read()
+	if err != nil {
+		return nil, err
+	}
+	return sortedEntries(entries), nil
+}
+
+func (j *FileJournal) read() (map[string]Entry, error) {
+	entries := make(map[string]Entry)
+	b, err := os.ReadFile(j.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return entries, nil
+		}
+		return nil, fmt.Errorf("failed to read journal: %w", err)
+	}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse journal %s: %w", j.path, err)
+	}
+	return entries, nil
+}
+
+func (j *FileJournal) write(entries map[string]Entry) error {
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(j.path), filepath.Base(j.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), j.path); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	return nil
+}
+
+func sortedEntries(entries map[string]Entry) []Entry {
+	r := make([]Entry, 0, len(entries))
+	for _, e := range entries {
+		r = append(r, e)
+	}
+	sort.Slice(r, func(i, k int) bool {
+		return r[i].Started.Before(r[k].Started)
+	})
+	return r
+}
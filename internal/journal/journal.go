@@ -0,0 +1,74 @@
+// Package journal records multi-step volume operations so that operations interrupted by controller restart
+// can be resumed or rolled back.
+package journal
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+)
+
+// Entry describes pending operation and the desired end state of the volume.
+type Entry struct {
+	// Name is the volume name, which is also used as storage title.
+	Name string `json:"name"`
+	// SourceID is the UUID of the storage or backup the volume is created from.
+	SourceID string `json:"source_id"`
+	// StorageUUID is set once the storage has been created.
+	StorageUUID string          `json:"storage_uuid,omitempty"`
+	Zone        string          `json:"zone"`
+	SizeGB      int             `json:"size_gb"`
+	Labels      []upcloud.Label `json:"labels,omitempty"`
+	Started     time.Time       `json:"started"`
+}
+
+// Journal stores pending operations.
+type Journal interface {
+	// Put adds or replaces pending operation of the volume.
+	Put(ctx context.Context, e Entry) error
+	// Complete removes pending operation of the volume.
+	Complete(ctx context.Context, name string) error
+	// Get returns pending operation of the volume.
+	Get(ctx context.Context, name string) (Entry, bool, error)
+	// Pending returns all pending operations.
+	Pending(ctx context.Context) ([]Entry, error)
+}
+
+// MemoryJournal keeps pending operations in memory. Operations are resumed only when CO retries the call.
+type MemoryJournal struct {
+	mu      sync.Mutex
+	entries map[string]Entry
+}
+
+func NewMemoryJournal() *MemoryJournal {
+	return &MemoryJournal{entries: make(map[string]Entry)}
+}
+
+func (j *MemoryJournal) Put(_ context.Context, e Entry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.entries[e.Name] = e
+	return nil
+}
+
+func (j *MemoryJournal) Complete(_ context.Context, name string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.entries, name)
+	return nil
+}
+
+func (j *MemoryJournal) Get(_ context.Context, name string) (Entry, bool, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e, ok := j.entries[name]
+	return e, ok, nil
+}
+
+func (j *MemoryJournal) Pending(_ context.Context) ([]Entry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return sortedEntries(j.entries), nil
+}
@@ -0,0 +1,115 @@
+package journal_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/UpCloudLtd/upcloud-csi/internal/journal"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestFileJournal(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "journal", "operations.json")
+	j, err := journal.NewFileJournal(path)
+	require.NoError(t, err)
+
+	pending, err := j.Pending(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+
+	started := time.Now().UTC().Truncate(time.Second)
+	want := journal.Entry{
+		Name:     "vol1",
+		SourceID: "src1",
+		Zone:     "fi-hel2",
+		SizeGB:   20,
+		Labels:   []upcloud.Label{{Key: "team", Value: "a"}},
+		Started:  started,
+	}
+	require.NoError(t, j.Put(ctx, want))
+	require.NoError(t, j.Put(ctx, journal.Entry{Name: "vol2", Started: started.Add(time.Second)}))
+	want.StorageUUID = "id1"
+	require.NoError(t, j.Put(ctx, want))
+
+	// entries are persisted across instances
+	j, err = journal.NewFileJournal(path)
+	require.NoError(t, err)
+	got, ok, err := j.Get(ctx, "vol1")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, want, got)
+
+	pending, err = j.Pending(ctx)
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+	assert.Equal(t, "vol1", pending[0].Name)
+
+	require.NoError(t, j.Complete(ctx, "vol1"))
+	require.NoError(t, j.Complete(ctx, "vol3"))
+	_, ok, err = j.Get(ctx, "vol1")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	pending, err = j.Pending(ctx)
+	require.NoError(t, err)
+	assert.Len(t, pending, 1)
+}
+
+func TestConfigMapJournal(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	j, err := journal.NewConfigMapJournal(client, "kube-system/csi-upcloud-journal")
+	require.NoError(t, err)
+
+	pending, err := j.Pending(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+
+	started := time.Now().UTC().Truncate(time.Second)
+	want := journal.Entry{
+		Name:     "vol1",
+		SourceID: "src1",
+		Zone:     "fi-hel2",
+		SizeGB:   20,
+		Labels:   []upcloud.Label{{Key: "team", Value: "a"}},
+		Started:  started,
+	}
+	require.NoError(t, j.Put(ctx, want))
+	require.NoError(t, j.Put(ctx, journal.Entry{Name: "vol2", Started: started.Add(time.Second)}))
+	want.StorageUUID = "id1"
+	require.NoError(t, j.Put(ctx, want))
+
+	// entries are persisted in the ConfigMap and read by a new instance
+	j, err = journal.NewConfigMapJournal(client, "kube-system/csi-upcloud-journal")
+	require.NoError(t, err)
+	got, ok, err := j.Get(ctx, "vol1")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, want, got)
+
+	pending, err = j.Pending(ctx)
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+	assert.Equal(t, "vol1", pending[0].Name)
+
+	require.NoError(t, j.Complete(ctx, "vol1"))
+	require.NoError(t, j.Complete(ctx, "vol3"))
+	_, ok, err = j.Get(ctx, "vol1")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	pending, err = j.Pending(ctx)
+	require.NoError(t, err)
+	assert.Len(t, pending, 1)
+
+	_, err = journal.NewConfigMapJournal(client, "csi-upcloud-journal")
+	require.Error(t, err)
+}
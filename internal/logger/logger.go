@@ -8,8 +8,11 @@ import (
 	"log"
 	"time"
 
+	"github.com/UpCloudLtd/upcloud-csi/internal/metrics"
+	"github.com/UpCloudLtd/upcloud-csi/internal/tracing"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/grpc"
 )
 
@@ -25,6 +28,7 @@ const (
 	ServiceURLKey        string = "service_url"
 	ServicePayloadKey    string = "service_payload"
 	CorrelationIDKey     string = "correlation_id"
+	TraceIDKey           string = "trace_id"
 	MethodKey            string = "method"
 	FilesystemTypeKey    string = "fs_type"
 	MountOptionsKey      string = "mount_options"
@@ -37,6 +41,13 @@ const (
 	ListStartingTokenKey string = "starting_token"
 	ListMaxEntriesKey    string = "max_entries"
 	ZoneKey              string = "zone"
+	LogLevelKey          string = "log_level"
+	TimeKey              string = "time"
+	LevelKey             string = "level"
+	MessageKey           string = "msg"
+
+	FormatText string = "text"
+	FormatJSON string = "json"
 
 	CtxCorrelationIDKey contextKey = "ctx_correlation_id"
 	CtxCalledMethodKey  contextKey = "ctx_called_method"
@@ -54,18 +65,23 @@ func WithServerContext(ctx context.Context, e *logrus.Entry) *logrus.Entry {
 	if v := ContextCorrelationID(ctx); v != "" {
 		e = e.WithField(CorrelationIDKey, v)
 	}
+	if v := tracing.TraceID(ctx); v != "" {
+		e = e.WithField(TraceIDKey, v)
+	}
 	if v, ok := ctx.Value(CtxCalledMethodKey).(string); ok {
 		e = e.WithField(MethodKey, v)
 	}
 	return e
 }
 
+// WithRequest adds request to the log entry. Secrets are redacted from the request.
 func WithRequest(e *logrus.Entry, r fmt.Stringer) *logrus.Entry {
-	return e.WithField(RequestKey, r.String())
+	return e.WithField(RequestKey, Redact(r))
 }
 
+// WithResponse adds response to the log entry. Secrets are redacted from the response.
 func WithResponse(e *logrus.Entry, r fmt.Stringer) *logrus.Entry {
-	return e.WithField(ResponseKey, r.String())
+	return e.WithField(ResponseKey, Redact(r))
 }
 
 func WithServiceRequest(e *logrus.Entry, r requestable) *logrus.Entry {
@@ -81,12 +97,15 @@ func NewMiddleware(log *logrus.Entry) grpc.UnaryServerInterceptor {
 		// Assign pre existing correlation ID from publish context or generate new one
 		if r, ok := req.(contextualPublisher); ok {
 			txID = contextualPublisherCorrelationID(r)
+			// continue the trace of controller publish
+			ctx = tracing.ExtractPublishContext(ctx, r.GetPublishContext())
 		}
 		if txID == "" {
 			txID = correlationID()
 		}
 		ctx = context.WithValue(ctx, CtxCorrelationIDKey, txID)
 		ctx = context.WithValue(ctx, CtxCalledMethodKey, info.FullMethod)
+		ctx, span := tracing.Start(ctx, info.FullMethod, attribute.String(CorrelationIDKey, txID))
 
 		// log requested method with correlation ID
 		log := WithServerContext(ctx, log)
@@ -94,7 +113,10 @@ func NewMiddleware(log *logrus.Entry) grpc.UnaryServerInterceptor {
 
 		now := time.Now()
 		resp, err := handler(ctx, req)
-		log = log.WithField("execution_time_ms", time.Since(now).Milliseconds())
+		executionTime := time.Since(now)
+		metrics.ObserveRPC(info.FullMethod, err, executionTime)
+		tracing.End(span, err)
+		log = log.WithField("execution_time_ms", executionTime.Milliseconds())
 
 		if err != nil {
 			if s, ok := req.(fmt.Stringer); ok && log.Logger.GetLevel() >= logrus.DebugLevel {
@@ -139,15 +161,47 @@ func correlationID() string {
 	return hex.EncodeToString(b)
 }
 
-func New(logLevel string) *logrus.Logger {
+// New creates logger using log level and log format, which is one of FormatText or FormatJSON.
+func New(logLevel, logFormat string) *logrus.Logger {
 	lv, err := logrus.ParseLevel(logLevel)
 	if err != nil {
 		log.Fatal(err)
 	}
 	logger := logrus.New()
 	logger.SetLevel(lv)
+	switch logFormat {
+	case FormatText, "":
+	case FormatJSON:
+		// JSON field names are part of the log format, so they are set explicitly instead of relying on defaults
+		logger.SetFormatter(&logrus.JSONFormatter{
+			TimestampFormat: time.RFC3339Nano,
+			FieldMap: logrus.FieldMap{
+				logrus.FieldKeyTime:  TimeKey,
+				logrus.FieldKeyLevel: LevelKey,
+				logrus.FieldKeyMsg:   MessageKey,
+			},
+		})
+	default:
+		log.Fatalf("unknown log format '%s'", logFormat)
+	}
 	if logger.GetLevel() > logrus.InfoLevel {
-		logger.WithField("level", logger.GetLevel().String()).Warn("using log level higher than INFO is not recommended in production")
+		logger.WithField(LogLevelKey, logger.GetLevel().String()).Warn("using log level higher than INFO is not recommended in production")
 	}
 	return logger
 }
+
+// IncreaseLevel makes logger more verbose by one level, e.g. from info to debug. Trace level is not exceeded.
+func IncreaseLevel(l *logrus.Logger) logrus.Level {
+	if lv := l.GetLevel(); lv < logrus.TraceLevel {
+		l.SetLevel(lv + 1)
+	}
+	return l.GetLevel()
+}
+
+// DecreaseLevel makes logger less verbose by one level, e.g. from debug to info. Errors are always logged.
+func DecreaseLevel(l *logrus.Logger) logrus.Level {
+	if lv := l.GetLevel(); lv > logrus.ErrorLevel {
+		l.SetLevel(lv - 1)
+	}
+	return l.GetLevel()
+}
@@ -0,0 +1,61 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew_JSONFormat(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	l := New("info", FormatJSON)
+	l.SetOutput(&buf)
+	l.WithField(VolumeIDKey, "vol-1").Info("volume created")
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "volume created", entry[MessageKey])
+	assert.Equal(t, "info", entry[LevelKey])
+	assert.Equal(t, "vol-1", entry[VolumeIDKey])
+	assert.Contains(t, entry, TimeKey)
+
+	// level field of the entry isn't overwritten by the logger's level
+	buf.Reset()
+	l.WithField(LogLevelKey, "debug").Warn("log level increased")
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "warning", entry[LevelKey])
+	assert.Equal(t, "debug", entry[LogLevelKey])
+}
+
+func TestChangeLevel(t *testing.T) {
+	t.Parallel()
+
+	l := New("info", FormatText)
+	assert.Equal(t, logrus.DebugLevel, IncreaseLevel(l))
+	assert.Equal(t, logrus.TraceLevel, IncreaseLevel(l))
+	assert.Equal(t, logrus.TraceLevel, IncreaseLevel(l))
+
+	l.SetLevel(logrus.WarnLevel)
+	assert.Equal(t, logrus.ErrorLevel, DecreaseLevel(l))
+	assert.Equal(t, logrus.ErrorLevel, DecreaseLevel(l))
+}
+
+func TestWithRequest_RedactsSecrets(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	l := New("debug", FormatJSON)
+	l.SetOutput(&buf)
+	WithRequest(logrus.NewEntry(l), &csi.DeleteVolumeRequest{
+		VolumeId: "vol-1",
+		Secrets:  map[string]string{"password": "hunter2"},
+	}).Debug("request")
+	assert.NotContains(t, buf.String(), "hunter2")
+}
@@ -0,0 +1,84 @@
+package logger
+
+import (
+	"fmt"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	protov1 "github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// redactedValue replaces values of secret fields.
+const redactedValue string = "***stripped***"
+
+// Redact returns string representation of the message where values of fields marked as secret in CSI spec
+// (e.g. secrets map of a request) are replaced. Values that are not protobuf messages are returned as is.
+func Redact(r fmt.Stringer) string {
+	m, ok := r.(protov1.Message)
+	if !ok {
+		return r.String()
+	}
+	m = protov1.Clone(m)
+	redactMessage(protov1.MessageReflect(m))
+	return m.String()
+}
+
+func redactMessage(m protoreflect.Message) {
+	secrets := make([]protoreflect.FieldDescriptor, 0)
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case isSecretField(fd):
+			secrets = append(secrets, fd)
+		case fd.IsMap():
+			if fd.MapValue().Message() != nil {
+				v.Map().Range(func(_ protoreflect.MapKey, v protoreflect.Value) bool {
+					redactMessage(v.Message())
+					return true
+				})
+			}
+		case fd.IsList():
+			if fd.Message() != nil {
+				for i := 0; i < v.List().Len(); i++ {
+					redactMessage(v.List().Get(i).Message())
+				}
+			}
+		case fd.Message() != nil:
+			redactMessage(v.Message())
+		}
+		return true
+	})
+	for _, fd := range secrets {
+		redactField(m, fd)
+	}
+}
+
+// redactField replaces string values of the field, keeping map keys visible, and clears values of other types.
+func redactField(m protoreflect.Message, fd protoreflect.FieldDescriptor) {
+	switch {
+	case fd.IsMap() && fd.MapValue().Kind() == protoreflect.StringKind:
+		secrets := m.Mutable(fd).Map()
+		keys := make([]protoreflect.MapKey, 0, secrets.Len())
+		secrets.Range(func(k protoreflect.MapKey, _ protoreflect.Value) bool {
+			keys = append(keys, k)
+			return true
+		})
+		for _, k := range keys {
+			secrets.Set(k, protoreflect.ValueOfString(redactedValue))
+		}
+	case !fd.IsList() && !fd.IsMap() && fd.Kind() == protoreflect.StringKind:
+		m.Set(fd, protoreflect.ValueOfString(redactedValue))
+	default:
+		m.Clear(fd)
+	}
+}
+
+func isSecretField(fd protoreflect.FieldDescriptor) bool {
+	opts, ok := fd.Options().(*descriptorpb.FieldOptions)
+	if !ok || opts == nil {
+		return false
+	}
+	secret, ok := proto.GetExtension(opts, csi.E_CsiSecret).(bool)
+	return ok && secret
+}
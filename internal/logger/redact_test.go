@@ -0,0 +1,31 @@
+package logger
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedact(t *testing.T) {
+	t.Parallel()
+
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol-1",
+		StagingTargetPath: "/staging",
+		Secrets:           map[string]string{"passphrase": "hunter2"},
+		PublishContext:    map[string]string{"ctx_correlation_id": "c0ffee"},
+	}
+	got := Redact(req)
+	assert.NotContains(t, got, "hunter2")
+	assert.Contains(t, got, "passphrase")
+	assert.Contains(t, got, redactedValue)
+	assert.Contains(t, got, "c0ffee")
+	assert.Contains(t, got, "vol-1")
+	// original request is not modified
+	assert.Equal(t, "hunter2", req.Secrets["passphrase"])
+
+	got = Redact(&csi.ListSnapshotsRequest{SourceVolumeId: "vol-1", Secrets: map[string]string{"token": "s3cr3t"}})
+	assert.NotContains(t, got, "s3cr3t")
+	assert.Contains(t, got, "token")
+}
@@ -0,0 +1,155 @@
+package metrics
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	namespace = "upcloud_csi"
+
+	MethodLabel    string = "method"
+	CodeLabel      string = "code"
+	EndpointLabel  string = "endpoint"
+	ResourceLabel  string = "resource"
+	OperationLabel string = "operation"
+
+	// ResourceStorage and ResourceServer are values of the resource label of state wait metrics.
+	ResourceStorage string = "storage"
+	ResourceServer  string = "server"
+
+	// OperationMkfs, OperationMount and OperationUdevWait are values of the operation label of node operation metrics.
+	OperationMkfs     string = "mkfs"
+	OperationMount    string = "mount"
+	OperationUdevWait string = "udev_wait"
+
+	// codeTransportError is used as response code of API requests that failed before response was received.
+	codeTransportError string = "error"
+)
+
+var (
+	// Registry holds driver metrics together with Go runtime and process metrics.
+	Registry = prometheus.NewRegistry()
+
+	rpcRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "grpc_requests_total",
+		Help:      "Number of CSI RPC calls by method and gRPC status code.",
+	}, []string{MethodLabel, CodeLabel})
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "grpc_request_duration_seconds",
+		Help:      "Latency of CSI RPC calls.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 16),
+	}, []string{MethodLabel})
+	apiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_requests_total",
+		Help:      "Number of UpCloud API requests by endpoint and HTTP status code.",
+	}, []string{EndpointLabel, CodeLabel})
+	apiDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "Latency of UpCloud API requests.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{EndpointLabel})
+	stateWaitDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "state_wait_duration_seconds",
+		Help:      "Time spent waiting storage or server to reach online state.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{ResourceLabel})
+	nodeLockWaitDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "node_lock_wait_duration_seconds",
+		Help:      "Time spent waiting per node lock before attaching or detaching storage.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 12),
+	})
+	nodeOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "node_operation_duration_seconds",
+		Help:      "Duration of node operations: creating filesystem, mounting and waiting device to appear.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{OperationLabel})
+
+	// apiVersionPath matches API version prefix of request path, e.g. /1.3.
+	apiVersionPath = regexp.MustCompile(`^/\d+\.\d+/`)
+	// uuidPath matches UUIDs in request path, so that endpoint label doesn't grow with the number of resources.
+	uuidPath = regexp.MustCompile(`/[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		rpcRequests,
+		rpcDuration,
+		apiRequests,
+		apiDuration,
+		stateWaitDuration,
+		nodeLockWaitDuration,
+		nodeOperationDuration,
+	)
+}
+
+// Handler returns HTTP handler that serves metrics in Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// ObserveRPC records CSI RPC call result and latency.
+func ObserveRPC(method string, err error, d time.Duration) {
+	rpcRequests.WithLabelValues(method, status.Code(err).String()).Inc()
+	rpcDuration.WithLabelValues(method).Observe(d.Seconds())
+}
+
+// ObserveStateWait records time spent waiting resource to reach desired state.
+func ObserveStateWait(resource string, d time.Duration) {
+	stateWaitDuration.WithLabelValues(resource).Observe(d.Seconds())
+}
+
+// ObserveNodeLockWait records time spent waiting per node lock.
+func ObserveNodeLockWait(d time.Duration) {
+	nodeLockWaitDuration.Observe(d.Seconds())
+}
+
+// ObserveNodeOperation records duration of node operation.
+func ObserveNodeOperation(operation string, d time.Duration) {
+	nodeOperationDuration.WithLabelValues(operation).Observe(d.Seconds())
+}
+
+// InstrumentRoundTripper returns round tripper that records UpCloud API request counts and latencies per endpoint.
+func InstrumentRoundTripper(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		endpoint := apiEndpoint(r)
+		now := time.Now()
+		res, err := next.RoundTrip(r)
+		apiDuration.WithLabelValues(endpoint).Observe(time.Since(now).Seconds())
+		code := codeTransportError
+		if err == nil {
+			code = strconv.Itoa(res.StatusCode)
+		}
+		apiRequests.WithLabelValues(endpoint, code).Inc()
+		return res, err
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// apiEndpoint returns request method and path without API version and resource UUIDs,
+// e.g. POST /1.3/storage/<uuid>/clone is returned as POST /storage/{uuid}/clone.
+func apiEndpoint(r *http.Request) string {
+	p := apiVersionPath.ReplaceAllString(r.URL.Path, "/")
+	return r.Method + " " + uuidPath.ReplaceAllString(p, "/{uuid}")
+}
@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAPIEndpoint(t *testing.T) {
+	t.Parallel()
+
+	for path, want := range map[string]string{
+		"/1.3/account":         "GET /account",
+		"/1.3/storage/private": "GET /storage/private",
+		"/1.3/storage/01b0f2f9-0b9b-4f4b-8f0f-6c8f0d2e7a11":               "GET /storage/{uuid}",
+		"/1.3/storage/01b0f2f9-0b9b-4f4b-8f0f-6c8f0d2e7a11/clone":         "GET /storage/{uuid}/clone",
+		"/1.3/server/00798b85-efdc-41ca-8021-f6ef457b8531/storage/attach": "GET /server/{uuid}/storage/attach",
+		"/storage/01b0f2f9-0b9b-4f4b-8f0f-6c8f0d2e7a11":                   "GET /storage/{uuid}",
+		"/1.3/storage/01B0F2F9-0B9B-4F4B-8F0F-6C8F0D2E7A11/resize":        "GET /storage/{uuid}/resize",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost", nil)
+		r.URL.Path = path
+		assert.Equal(t, want, apiEndpoint(r), path)
+	}
+}
+
+func TestInstrumentRoundTripper(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	c := &http.Client{Transport: InstrumentRoundTripper(http.DefaultTransport)}
+	get := apiRequests.WithLabelValues("GET /server/{uuid}", "200")
+	del := apiRequests.WithLabelValues("DELETE /server/{uuid}", "404")
+	getCount, delCount := testutil.ToFloat64(get), testutil.ToFloat64(del)
+
+	for _, method := range []string{http.MethodGet, http.MethodGet, http.MethodDelete} {
+		req, err := http.NewRequestWithContext(context.Background(), method, srv.URL+"/1.3/server/00798b85-efdc-41ca-8021-f6ef457b8531", nil)
+		require.NoError(t, err)
+		res, err := c.Do(req)
+		require.NoError(t, err)
+		res.Body.Close()
+	}
+	assert.Equal(t, getCount+2, testutil.ToFloat64(get))
+	assert.Equal(t, delCount+1, testutil.ToFloat64(del))
+
+	// requests that fail before response is received are counted using error code
+	c = &http.Client{Transport: InstrumentRoundTripper(roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	}))}
+	failed := apiRequests.WithLabelValues("GET /account", codeTransportError)
+	failedCount := testutil.ToFloat64(failed)
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL+"/1.3/account", nil)
+	require.NoError(t, err)
+	_, err = c.Do(req) //nolint:bodyclose // request fails
+	require.Error(t, err)
+	assert.Equal(t, failedCount+1, testutil.ToFloat64(failed))
+}
+
+func TestObserveRPC(t *testing.T) {
+	t.Parallel()
+
+	const method = "/csi.v1.Controller/TestObserveRPC"
+	ObserveRPC(method, nil, time.Second)
+	ObserveRPC(method, status.Error(codes.NotFound, "volume not found"), time.Millisecond)
+	ObserveRPC(method, errors.New("unknown error"), time.Millisecond)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(rpcRequests.WithLabelValues(method, codes.OK.String())))
+	assert.Equal(t, 1.0, testutil.ToFloat64(rpcRequests.WithLabelValues(method, codes.NotFound.String())))
+	assert.Equal(t, 1.0, testutil.ToFloat64(rpcRequests.WithLabelValues(method, codes.Unknown.String())))
+	assert.Equal(t, 1, testutil.CollectAndCount(rpcDuration, namespace+"_grpc_request_duration_seconds"))
+}
@@ -4,9 +4,14 @@ import (
 	"context"
 	"errors"
 	"os"
+	"sync"
+	"time"
 
+	"github.com/UpCloudLtd/upcloud-csi/internal/accessmode"
 	"github.com/UpCloudLtd/upcloud-csi/internal/filesystem"
 	"github.com/UpCloudLtd/upcloud-csi/internal/logger"
+	"github.com/UpCloudLtd/upcloud-csi/internal/topology"
+	"github.com/UpCloudLtd/upcloud-csi/internal/volumecontext"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc/codes"
@@ -15,32 +20,85 @@ import (
 
 const (
 	fileSystemExt4 = "ext4"
+	fileSystemExt3 = "ext3"
+	fileSystemXFS  = "xfs"
+
+	// secretLuksPassphrase is the node stage secret key of LUKS passphrase.
+	secretLuksPassphrase = "passphrase"
+	// secretLuksPreviousPassphrase is the node stage secret key of LUKS passphrase that is being rotated.
+	secretLuksPreviousPassphrase = "previousPassphrase"
+	// luksMappingPrefix is the prefix of LUKS mapping names created by the driver.
+	luksMappingPrefix = "upcloud-csi-"
+	// fsCheckResultTTL is how long result of finished filesystem check is kept waiting for the retried call to pick it up.
+	fsCheckResultTTL = 10 * time.Minute
 )
 
+// fsCheck is filesystem check running in background.
+type fsCheck struct {
+	done     chan struct{}
+	finished time.Time
+	result   filesystem.CheckResult
+	err      error
+	timedOut bool
+}
+
 type Node struct {
+	csi.UnimplementedNodeServer
+
 	name string
 	zone string
 
 	maxVolumesPerNode int64
+	// fsckTimeout limits the duration of read-only filesystem check, zero means no limit. Repair is never interrupted.
+	fsckTimeout time.Duration
 
 	fs  filesystem.Filesystem
 	log *logrus.Entry
+
+	// singleWriterMu serializes publishing of volumes with single writer access mode, so that the mount table
+	// can't change between checking existing mounts and mounting the target path.
+	singleWriterMu sync.Mutex
+
+	// fsChecks contains filesystem checks that are running or whose result hasn't been picked up yet, keyed by volume ID.
+	fsChecks   map[string]*fsCheck
+	fsChecksMu sync.Mutex
+
+	// volumeConditions contains the result of the latest filesystem check, keyed by volume ID.
+	volumeConditions   map[string]*csi.VolumeCondition
+	volumeConditionsMu sync.Mutex
+}
+
+// Option configures optional settings of the node.
+type Option func(*Node)
+
+// WithFsckTimeout limits the duration of read-only filesystem check. Repair that follows the check is not limited, as
+// interrupted repair may leave the filesystem in a state that needs manual repair. Zero timeout (default) means no limit.
+func WithFsckTimeout(timeout time.Duration) Option {
+	return func(n *Node) {
+		n.fsckTimeout = timeout
+	}
 }
 
-func NewNode(name, zone string, maxVolumesPerNode int64, fs filesystem.Filesystem, l *logrus.Entry) (*Node, error) {
+func NewNode(name, zone string, maxVolumesPerNode int64, fs filesystem.Filesystem, l *logrus.Entry, opts ...Option) (*Node, error) {
 	if name == "" {
 		return nil, errors.New("node name is required field")
 	}
 	if zone == "" {
 		return nil, errors.New("node zone is required field")
 	}
-	return &Node{
+	n := &Node{
 		name:              name,
 		zone:              zone,
 		maxVolumesPerNode: maxVolumesPerNode,
 		fs:                fs,
 		log:               l,
-	}, nil
+		fsChecks:          make(map[string]*fsCheck),
+		volumeConditions:  make(map[string]*csi.VolumeCondition),
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+	return n, nil
 }
 
 // NodeStageVolume mounts the volume to a staging path on the node. This is
@@ -64,6 +122,9 @@ func (n *Node) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequ
 	log = log.WithField(logger.MountTargetKey, target)
 	// No need to stage raw block device.
 	if _, ok := req.VolumeCapability.GetAccessType().(*csi.VolumeCapability_Block); ok {
+		if volumecontext.LUKS(req.GetVolumeContext()) {
+			return nil, status.Error(codes.InvalidArgument, "LUKS encryption is not supported with block access type")
+		}
 		log.Info("raw block device requested")
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
@@ -75,17 +136,53 @@ func (n *Node) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequ
 	if mnt.FsType != "" {
 		fsType = mnt.FsType
 	}
+	mkfsArgs, err := volumecontext.MkfsArgs(fsType, req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	fsCheck, err := volumecontext.FsCheck(req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
 	log.Info("getting disk source for volume ID")
-	source, err := n.fs.GetDeviceByID(ctx, req.GetVolumeId())
+	source, err := n.fs.GetDeviceByID(ctx, volumecontext.StorageUUID(req.GetVolumeId(), req.GetPublishContext()))
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
-	log = log.WithFields(logrus.Fields{logger.MountSourceKey: source, "fs_type": fsType, "mount_options": options})
+	readOnly := accessmode.ReadOnly(req.GetVolumeCapability().GetAccessMode())
+	if readOnly {
+		options = append(options, readOnlyMountOptions(fsType)...)
+	}
+	log = log.WithFields(logrus.Fields{logger.MountSourceKey: source, "fs_type": fsType, "mount_options": options, "mkfs_args": mkfsArgs})
 
-	log.Info("formatting the source volume for staging")
-	if err := n.fs.Format(ctx, source, fsType, []string{}); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	// device is the block device mounted to the target, last partition of the source is used if device is not set.
+	var device string
+	switch {
+	case volumecontext.LUKS(req.GetVolumeContext()):
+		if device, err = n.openLuksVolume(ctx, log, req.GetVolumeId(), source, req.GetSecrets(), readOnly); err != nil {
+			return nil, err
+		}
+		log = log.WithField("luks_mapping", device)
+		if readOnly {
+			log.Info("skipping format of read-only volume")
+		} else {
+			log.Info("formatting the LUKS mapping for staging")
+			if err := n.fs.CreateFilesystem(ctx, device, fsType, mkfsArgs); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		}
+	case readOnly:
+		// Read-only volume is expected to contain data (e.g. restored from snapshot) so it's never formatted.
+		log.Info("skipping format of read-only volume")
+	default:
+		log.Info("formatting the source volume for staging")
+		if err := n.fs.Format(ctx, source, fsType, mkfsArgs); err != nil {
+			if errors.Is(err, filesystem.ErrLuksDevice) {
+				return nil, status.Error(codes.FailedPrecondition, err.Error())
+			}
+			return nil, status.Error(codes.Internal, err.Error())
+		}
 	}
 
 	log.Info("check if target is already mounted")
@@ -95,12 +192,26 @@ func (n *Node) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequ
 	}
 
 	if !mounted {
-		partition, err := n.fs.GetDeviceLastPartition(ctx, source)
-		if err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
+		if device == "" {
+			if device, err = n.fs.GetDeviceLastPartition(ctx, source); err != nil {
+				if readOnly {
+					return nil, status.Errorf(codes.FailedPrecondition, "read-only volume needs to be created from a data source: %s", err.Error())
+				}
+				return nil, status.Error(codes.Internal, err.Error())
+			}
 		}
-		log.WithField("partition", partition).Info("mounting partition for staging")
-		if err := n.fs.Mount(ctx, partition, target, fsType, options...); err != nil {
+		if fsCheck && !readOnly {
+			if err := n.checkFilesystem(ctx, log, req.GetVolumeId(), device); err != nil {
+				return nil, err
+			}
+		}
+		if volumecontext.FromContentSource(req.GetVolumeContext()) && !readOnly {
+			if err := n.regenerateFilesystemUUID(ctx, log, req.GetVolumeId(), source, device); err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		}
+		log.WithField("device", device).Info("mounting device for staging")
+		if err := n.fs.Mount(ctx, device, target, fsType, options...); err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	} else {
@@ -126,6 +237,9 @@ func (n *Node) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolume
 	}
 
 	log = log.WithField(logger.MountTargetKey, req.GetStagingTargetPath())
+	if err := n.discardFilesystemCheck(req.GetVolumeId()); err != nil {
+		return nil, err
+	}
 
 	log.Info("check if target is already mounted")
 	mounted, err := n.fs.IsMounted(ctx, req.GetStagingTargetPath())
@@ -150,9 +264,208 @@ func (n *Node) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolume
 			return nil, status.Errorf(codes.Internal, err.Error())
 		}
 	}
+
+	// Unstage request doesn't have volume context, so mapping is closed if one is open.
+	if err := n.fs.LuksClose(ctx, luksMappingName(req.GetVolumeId())); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	n.setVolumeCondition(req.GetVolumeId(), nil)
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
+// checkFilesystem checks and repairs the filesystem of the device before it's mounted and stores the result as the
+// volume condition. Filesystem that can't be repaired automatically is not mounted.
+// Check runs in background, so that repair is not interrupted when CO gives up waiting and cancels the call. Retried
+// call returns codes.Aborted until the check is finished and picks up the result once it's available.
+// Volume condition is kept in memory, so it's lost if the plugin is restarted before the volume is unstaged.
+func (n *Node) checkFilesystem(ctx context.Context, log *logrus.Entry, volumeID, device string) error {
+	log = log.WithField("device", device)
+	n.fsChecksMu.Lock()
+	n.purgeFilesystemChecks()
+	c, ok := n.fsChecks[volumeID]
+	if ok {
+		select {
+		case <-c.done:
+		default:
+			n.fsChecksMu.Unlock()
+			return status.Errorf(codes.Aborted, "filesystem check of volume %s is in progress", volumeID)
+		}
+	} else {
+		c = &fsCheck{done: make(chan struct{})}
+		n.fsChecks[volumeID] = c
+		go n.runFilesystemCheck(context.WithoutCancel(ctx), log, c, device)
+	}
+	n.fsChecksMu.Unlock()
+
+	select {
+	case <-c.done:
+		n.fsChecksMu.Lock()
+		if n.fsChecks[volumeID] == c {
+			delete(n.fsChecks, volumeID)
+		}
+		n.fsChecksMu.Unlock()
+	case <-ctx.Done():
+		return status.Errorf(codes.Aborted, "filesystem check of volume %s is in progress: %s", volumeID, ctx.Err())
+	}
+	switch {
+	case errors.Is(c.err, filesystem.ErrFilesystemCorrupted):
+		return status.Errorf(codes.DataLoss, "refusing to mount corrupted filesystem: %s", c.err.Error())
+	case c.err != nil && c.timedOut:
+		return status.Errorf(codes.DeadlineExceeded, "filesystem check didn't finish in %s: %s", n.fsckTimeout, c.err.Error())
+	case c.err != nil:
+		return status.Error(codes.Internal, c.err.Error())
+	}
+	log.WithField("repaired", c.result.Repaired).Info(c.result.Message)
+	n.setVolumeCondition(volumeID, &csi.VolumeCondition{Abnormal: c.result.Repaired, Message: c.result.Message})
+	return nil
+}
+
+// runFilesystemCheck runs the filesystem check, repairs the filesystem if errors were found and stores the result to c.
+// Read-only check is limited by fsckTimeout, repair runs until it's finished.
+func (n *Node) runFilesystemCheck(ctx context.Context, log *logrus.Entry, c *fsCheck, device string) {
+	checkCtx := ctx
+	if n.fsckTimeout > 0 {
+		var cancel context.CancelFunc
+		checkCtx, cancel = context.WithTimeout(ctx, n.fsckTimeout)
+		defer cancel()
+	}
+	log.Info("checking filesystem")
+	result, err := n.fs.Check(checkCtx, device)
+	timedOut := errors.Is(checkCtx.Err(), context.DeadlineExceeded)
+	if err == nil && result.NeedsRepair {
+		log.WithField("reason", result.Message).Warn("repairing filesystem")
+		result, err = n.fs.Repair(ctx, device)
+	}
+	n.fsChecksMu.Lock()
+	defer n.fsChecksMu.Unlock()
+	c.result, c.err, c.finished, c.timedOut = result, err, time.Now(), timedOut
+	close(c.done)
+}
+
+// discardFilesystemCheck discards result of the finished filesystem check of the volume. Check that is still
+// running can't be discarded, as the device is in use until the check has finished.
+func (n *Node) discardFilesystemCheck(volumeID string) error {
+	n.fsChecksMu.Lock()
+	defer n.fsChecksMu.Unlock()
+	if c, ok := n.fsChecks[volumeID]; ok {
+		select {
+		case <-c.done:
+			delete(n.fsChecks, volumeID)
+		default:
+			return status.Errorf(codes.Aborted, "filesystem check of volume %s is in progress", volumeID)
+		}
+	}
+	return nil
+}
+
+// purgeFilesystemChecks removes results that were not picked up in time, so that stale result isn't used when
+// the volume is staged later. Caller must hold the lock.
+func (n *Node) purgeFilesystemChecks() {
+	for volumeID, c := range n.fsChecks {
+		select {
+		case <-c.done:
+			if time.Since(c.finished) > fsCheckResultTTL {
+				delete(n.fsChecks, volumeID)
+			}
+		default:
+		}
+	}
+}
+
+// setVolumeCondition stores the condition of the volume, nil condition removes the stored condition.
+func (n *Node) setVolumeCondition(volumeID string, condition *csi.VolumeCondition) {
+	n.volumeConditionsMu.Lock()
+	defer n.volumeConditionsMu.Unlock()
+
+	if condition == nil {
+		delete(n.volumeConditions, volumeID)
+		return
+	}
+	n.volumeConditions[volumeID] = condition
+}
+
+// volumeCondition returns the stored condition of the volume, or normal condition if volume hasn't been checked.
+func (n *Node) volumeCondition(volumeID string) *csi.VolumeCondition {
+	n.volumeConditionsMu.Lock()
+	defer n.volumeConditionsMu.Unlock()
+
+	if condition, ok := n.volumeConditions[volumeID]; ok {
+		return condition
+	}
+	return &csi.VolumeCondition{Abnormal: false, Message: "volume is mounted"}
+}
+
+// regenerateFilesystemUUID gives the filesystem of a volume copied from a snapshot or another volume a new UUID, so that
+// the copy can be mounted alongside its source. Partition is named after the volume once UUID has been changed, so that
+// UUID is changed only on the first stage and copies of this volume are recognized as copies. GPT partition name is
+// used as the marker, as it's stored on the volume outside the filesystem, so the existing partition name is overwritten.
+func (n *Node) regenerateFilesystemUUID(ctx context.Context, log *logrus.Entry, volumeID, source, device string) error {
+	partition, err := n.fs.GetDeviceLastPartition(ctx, source)
+	if err != nil {
+		return err
+	}
+	name, err := n.fs.PartitionName(ctx, partition)
+	if err != nil {
+		return err
+	}
+	if name == volumeID {
+		log.Debug("filesystem UUID of the volume copy is already regenerated")
+		return nil
+	}
+	log.WithField("device", device).Info("regenerating filesystem UUID of the volume copy")
+	if err := n.fs.RegenerateUUID(ctx, device); err != nil {
+		return err
+	}
+	return n.fs.SetPartitionName(ctx, source, partition, volumeID)
+}
+
+// openLuksVolume opens LUKS encrypted partition of the source device and returns the path of the mapped device.
+// Writable volume is partitioned and formatted as LUKS device if needed. If passphrase doesn't unlock the device,
+// previous passphrase is replaced with the current passphrase, or used to open the device if volume is read-only.
+func (n *Node) openLuksVolume(ctx context.Context, log *logrus.Entry, volumeID, source string, secrets map[string]string, readOnly bool) (string, error) {
+	passphrase := secrets[secretLuksPassphrase]
+	if passphrase == "" {
+		return "", status.Errorf(codes.InvalidArgument, "node stage secret %q is required by LUKS encrypted volume", secretLuksPassphrase)
+	}
+	var partition string
+	var err error
+	if readOnly {
+		if partition, err = n.fs.GetDeviceLastPartition(ctx, source); err != nil {
+			return "", status.Errorf(codes.FailedPrecondition, "read-only volume needs to be created from a data source: %s", err.Error())
+		}
+	} else {
+		if partition, err = n.fs.Partition(ctx, source); err != nil {
+			return "", status.Error(codes.Internal, err.Error())
+		}
+		log.WithField("partition", partition).Info("formatting the partition as LUKS device")
+		if err := n.fs.LuksFormat(ctx, partition, passphrase); err != nil {
+			return "", status.Error(codes.Internal, err.Error())
+		}
+	}
+	name := luksMappingName(volumeID)
+	log = log.WithField("partition", partition)
+	log.Info("opening LUKS device")
+	device, err := n.fs.LuksOpen(ctx, partition, name, passphrase, readOnly)
+	if previous := secrets[secretLuksPreviousPassphrase]; previous != "" && errors.Is(err, filesystem.ErrInvalidPassphrase) {
+		if readOnly {
+			log.Info("opening LUKS device using previous passphrase")
+			device, err = n.fs.LuksOpen(ctx, partition, name, previous, readOnly)
+		} else {
+			log.Info("replacing previous LUKS passphrase")
+			if err = n.fs.LuksChangeKey(ctx, partition, previous, passphrase); err == nil {
+				device, err = n.fs.LuksOpen(ctx, partition, name, passphrase, readOnly)
+			}
+		}
+	}
+	if err != nil {
+		if errors.Is(err, filesystem.ErrInvalidPassphrase) {
+			return "", status.Errorf(codes.PermissionDenied, "unable to unlock LUKS encrypted volume using node stage secrets: %s", err.Error())
+		}
+		return "", status.Error(codes.Internal, err.Error())
+	}
+	return device, nil
+}
+
 // NodePublishVolume mounts the volume mounted to the staging path to the target path.
 func (n *Node) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	if err := validateNodePublishVolumeRequest(req); err != nil {
@@ -166,14 +479,14 @@ func (n *Node) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolume
 	log = log.WithFields(logrus.Fields{logger.MountSourceKey: source, logger.MountTargetKey: target})
 
 	options := []string{"bind"}
-	if req.GetReadonly() {
+	if req.GetReadonly() || accessmode.ReadOnly(req.GetVolumeCapability().GetAccessMode()) {
 		options = append(options, "ro")
 	}
 	fsType := ""
 	switch req.GetVolumeCapability().GetAccessType().(type) {
 	case *csi.VolumeCapability_Block:
 		// raw block device requested, ignore filesystem and mount flags
-		if source, err = n.fs.GetDeviceByID(ctx, req.GetVolumeId()); err != nil {
+		if source, err = n.fs.GetDeviceByID(ctx, volumecontext.StorageUUID(req.GetVolumeId(), req.GetPublishContext())); err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 
@@ -191,19 +504,31 @@ func (n *Node) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolume
 
 	log = log.WithFields(logrus.Fields{logger.FilesystemTypeKey: fsType, logger.MountOptionsKey: options})
 
+	singleWriter := req.GetVolumeCapability().GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER
+	if singleWriter {
+		n.singleWriterMu.Lock()
+		defer n.singleWriterMu.Unlock()
+	}
+
 	log.Info("check if target is already mounted")
 	mounted, err := n.fs.IsMounted(ctx, target)
 	if err != nil {
 		return nil, err
 	}
+	if mounted {
+		log.Info("volume is already mounted")
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
 
-	if !mounted {
-		log.Info("mounting the volume")
-		if err := n.fs.Mount(ctx, source, target, fsType, options...); err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
+	if singleWriter {
+		if err := n.checkSingleWriter(ctx, req.GetVolumeId(), source, target); err != nil {
+			return nil, err
 		}
-	} else {
-		log.Info("volume is already mounted")
+	}
+
+	log.Info("mounting the volume")
+	if err := n.fs.Mount(ctx, source, target, fsType, options...); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
 	}
 
 	return &csi.NodePublishVolumeResponse{}, nil
@@ -248,6 +573,21 @@ func (n *Node) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVo
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
+// checkSingleWriter returns an error if volume with single writer access mode is already published to another target path.
+// Published target paths are read from the mount table, so that they survive plugin restarts.
+func (n *Node) checkSingleWriter(ctx context.Context, volumeID, source, target string) error {
+	targets, err := n.fs.MountTargets(ctx, source)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to list mounts of %s: %s", source, err.Error())
+	}
+	for _, t := range targets {
+		if t != source && t != target {
+			return status.Errorf(codes.FailedPrecondition, "volume %s with single writer access mode is already published to %s", volumeID, t)
+		}
+	}
+	return nil
+}
+
 // NodeGetCapabilities returns the supported capabilities of the node server.
 func (n *Node) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
 	log := logger.WithServerContext(ctx, n.log)
@@ -266,6 +606,27 @@ func (n *Node) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabili
 				},
 			},
 		},
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+				},
+			},
+		},
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+				},
+			},
+		},
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+				},
+			},
+		},
 	}
 
 	log.WithField("capabilities", caps).Info("supported capabilities")
@@ -284,9 +645,7 @@ func (n *Node) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*c
 
 		// make sure that the driver works on this particular region only
 		AccessibleTopology: &csi.Topology{
-			Segments: map[string]string{
-				"region": n.zone,
-			},
+			Segments: topology.Segments(n.zone),
 		},
 	}, nil
 }
@@ -337,11 +696,65 @@ func (n *Node) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeSta
 				Unit:      csi.VolumeUsage_INODES,
 			},
 		},
+		VolumeCondition: n.volumeCondition(req.GetVolumeId()),
 	}, nil
 }
 
+// NodeExpandVolume expands partition and filesystem of the published volume to fill the storage device resized by the controller.
 func (n *Node) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "method NodeExpandVolume not implemented")
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID must be provided")
+	}
+	volumePath := req.GetVolumePath()
+	if volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume path must be provided")
+	}
+	log := logger.WithServerContext(ctx, n.log).WithField(logger.VolumeIDKey, req.GetVolumeId()).WithField("volume_path", volumePath)
+
+	if _, ok := req.GetVolumeCapability().GetAccessType().(*csi.VolumeCapability_Block); ok {
+		log.Info("raw block device doesn't require node expansion")
+		return &csi.NodeExpandVolumeResponse{CapacityBytes: req.GetCapacityRange().GetRequiredBytes()}, nil
+	}
+
+	log.Info("check if volume path is mounted")
+	mounted, err := n.fs.IsMounted(ctx, volumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check if volume path %q is mounted: %s", volumePath, err)
+	}
+	if !mounted {
+		return nil, status.Errorf(codes.NotFound, "volume path %s is not mounted", volumePath)
+	}
+
+	// device is looked up using the mount, as storage UUID, which device ID is derived from, isn't passed to expansion
+	log.Info("getting disk source for volume path")
+	source, err := n.fs.GetDeviceByMount(ctx, volumePath)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	log.WithField(logger.MountSourceKey, source).Info("expanding volume")
+	if err := n.fs.Resize(ctx, source, volumePath); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: req.GetCapacityRange().GetRequiredBytes()}, nil
+}
+
+// luksMappingName returns name of the LUKS mapping of the volume.
+func luksMappingName(volumeID string) string {
+	return luksMappingPrefix + volumeID
+}
+
+// readOnlyMountOptions returns mount options that mount filesystem read-only without replaying the journal,
+// which would otherwise write to the device.
+func readOnlyMountOptions(fsType string) []string {
+	switch fsType {
+	case fileSystemExt3, fileSystemExt4:
+		return []string{"ro", "noload"}
+	case fileSystemXFS:
+		return []string{"ro", "norecovery"}
+	default:
+		return []string{"ro"}
+	}
 }
 
 func validateNodePublishVolumeRequest(r *csi.NodePublishVolumeRequest) error {
@@ -2,18 +2,368 @@ package node_test
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/UpCloudLtd/upcloud-csi/internal/filesystem"
 	"github.com/UpCloudLtd/upcloud-csi/internal/filesystem/mock"
 	"github.com/UpCloudLtd/upcloud-csi/internal/node"
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestNode_ExpandVolume(t *testing.T) {
 	t.Parallel()
 	logger := logrus.New()
 	d, _ := node.NewNode("test-node", "fi-hel1", 10, mock.NewFilesystem(logger), logger.WithField("package", "node_test"))
-	if _, err := d.NodeExpandVolume(context.TODO(), nil); err == nil {
-		t.Error("NodeExpandVolume should return error. Only offline volume expansion is supported and it's handled by controller.")
+	if _, err := d.NodeExpandVolume(context.TODO(), &csi.NodeExpandVolumeRequest{}); err == nil {
+		t.Error("NodeExpandVolume should return error if volume ID is not set")
 	}
+
+	volumePath := t.TempDir()
+	resp, err := d.NodeExpandVolume(context.TODO(), &csi.NodeExpandVolumeRequest{
+		VolumeId:      "test-vol",
+		VolumePath:    volumePath,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 30},
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(1<<30), resp.GetCapacityBytes())
+
+	require.NoError(t, os.RemoveAll(volumePath))
+	_, err = d.NodeExpandVolume(context.TODO(), &csi.NodeExpandVolumeRequest{
+		VolumeId:   "test-vol",
+		VolumePath: volumePath,
+	})
+	require.Error(t, err, "NodeExpandVolume should return error if volume path is not mounted")
+}
+
+func TestNode_StageVolume_ReadOnly(t *testing.T) {
+	t.Parallel()
+	logger := logrus.New()
+	d, _ := node.NewNode("test-node", "fi-hel1", 10, mock.NewFilesystem(logger), logger.WithField("package", "node_test"))
+	_, err := d.NodeStageVolume(context.TODO(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "test-vol",
+		StagingTargetPath: filepath.Join(t.TempDir(), "staging"),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{FsType: "xfs"},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+			},
+		},
+	})
+	require.NoError(t, err)
+}
+
+func TestNode_StageVolume_LUKS(t *testing.T) {
+	t.Parallel()
+	logger := logrus.New()
+	d, _ := node.NewNode("test-node", "fi-hel1", 10, mock.NewFilesystem(logger), logger.WithField("package", "node_test"))
+	staging := filepath.Join(t.TempDir(), "staging")
+	newRequest := func(secrets map[string]string) *csi.NodeStageVolumeRequest {
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          "test-vol",
+			StagingTargetPath: staging,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+			VolumeContext: map[string]string{"encryption": "luks"},
+			Secrets:       secrets,
+		}
+	}
+	stage := func(secrets map[string]string) error {
+		_, err := d.NodeStageVolume(context.TODO(), newRequest(secrets))
+		if err == nil {
+			_, err = d.NodeUnstageVolume(context.TODO(), &csi.NodeUnstageVolumeRequest{VolumeId: "test-vol", StagingTargetPath: staging})
+		}
+		return err
+	}
+
+	require.Equal(t, codes.InvalidArgument, status.Code(stage(nil)), "passphrase is required")
+	require.NoError(t, stage(map[string]string{"passphrase": "key-1"}))
+	require.NoError(t, stage(map[string]string{"passphrase": "key-1"}))
+	require.Equal(t, codes.PermissionDenied, status.Code(stage(map[string]string{"passphrase": "key-2"})))
+
+	// rotate passphrase
+	require.NoError(t, stage(map[string]string{"passphrase": "key-2", "previousPassphrase": "key-1"}))
+	require.NoError(t, stage(map[string]string{"passphrase": "key-2"}))
+	require.Equal(t, codes.PermissionDenied, status.Code(stage(map[string]string{"passphrase": "key-1"})))
+
+	req := newRequest(map[string]string{"passphrase": "key-2"})
+	req.VolumeCapability.AccessType = &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}
+	_, err := d.NodeStageVolume(context.TODO(), req)
+	require.Equal(t, codes.InvalidArgument, status.Code(err), "LUKS is not supported with block access type")
+
+	// LUKS partition is not formatted when volume is staged without encryption
+	req = newRequest(nil)
+	req.VolumeContext = nil
+	_, err = d.NodeStageVolume(context.TODO(), req)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err), "LUKS partition should not be formatted")
+}
+
+func TestNode_StageVolume_MkfsOptions(t *testing.T) {
+	t.Parallel()
+	logger := logrus.New()
+	d, _ := node.NewNode("test-node", "fi-hel1", 10, mock.NewFilesystem(logger), logger.WithField("package", "node_test"))
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          "test-vol",
+		StagingTargetPath: filepath.Join(t.TempDir(), "staging"),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+		VolumeContext: map[string]string{"ext4.inodeRatio": "16384", "fsLabel": "pgdata"},
+	}
+	_, err := d.NodeStageVolume(context.TODO(), req)
+	require.NoError(t, err)
+
+	req.VolumeContext["mkfsOptions"] = "-F"
+	_, err = d.NodeStageVolume(context.TODO(), req)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// regenerateUUIDCounter counts filesystem UUID regenerations.
+type regenerateUUIDCounter struct {
+	filesystem.Filesystem
+	calls atomic.Int32
+}
+
+func (r *regenerateUUIDCounter) RegenerateUUID(ctx context.Context, device string) error {
+	r.calls.Add(1)
+	return r.Filesystem.RegenerateUUID(ctx, device)
+}
+
+func TestNode_StageVolume_RegenerateUUID(t *testing.T) {
+	t.Parallel()
+	logger := logrus.New()
+	fs := &regenerateUUIDCounter{Filesystem: mock.NewFilesystem(logger)}
+	d, _ := node.NewNode("test-node", "fi-hel1", 10, fs, logger.WithField("package", "node_test"))
+	staging := filepath.Join(t.TempDir(), "staging")
+	stage := func(volumeContext map[string]string, mode csi.VolumeCapability_AccessMode_Mode) {
+		_, err := d.NodeStageVolume(context.TODO(), &csi.NodeStageVolumeRequest{
+			VolumeId:          "test-vol",
+			StagingTargetPath: staging,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "xfs"}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+			},
+			VolumeContext: volumeContext,
+		})
+		require.NoError(t, err)
+		_, err = d.NodeUnstageVolume(context.TODO(), &csi.NodeUnstageVolumeRequest{VolumeId: "test-vol", StagingTargetPath: staging})
+		require.NoError(t, err)
+	}
+
+	stage(nil, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+	require.Equal(t, int32(0), fs.calls.Load(), "volume without content source keeps its UUID")
+	stage(map[string]string{"contentSource": "snapshot"}, csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY)
+	require.Equal(t, int32(0), fs.calls.Load(), "read-only volume keeps its UUID")
+	stage(map[string]string{"contentSource": "snapshot"}, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+	require.Equal(t, int32(1), fs.calls.Load())
+	stage(map[string]string{"contentSource": "snapshot"}, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)
+	require.Equal(t, int32(1), fs.calls.Load(), "UUID is regenerated only on the first stage")
+}
+
+// checkResult finds filesystem errors and returns the given filesystem repair result.
+type checkResult struct {
+	filesystem.Filesystem
+	result filesystem.CheckResult
+	err    error
+}
+
+func (c *checkResult) Check(ctx context.Context, device string) (filesystem.CheckResult, error) {
+	return filesystem.CheckResult{NeedsRepair: true, Message: "e2fsck found errors"}, nil
+}
+
+func (c *checkResult) Repair(ctx context.Context, device string) (filesystem.CheckResult, error) {
+	return c.result, c.err
+}
+
+// blockingRepair finds filesystem errors and blocks filesystem repair until release is closed and records the error
+// of the repair context.
+type blockingRepair struct {
+	filesystem.Filesystem
+	release chan struct{}
+	ctxErr  chan error
+}
+
+func (c *blockingRepair) Check(ctx context.Context, device string) (filesystem.CheckResult, error) {
+	return filesystem.CheckResult{NeedsRepair: true, Message: "xfs_repair found errors"}, nil
+}
+
+func (c *blockingRepair) Repair(ctx context.Context, device string) (filesystem.CheckResult, error) {
+	<-c.release
+	c.ctxErr <- ctx.Err()
+	return filesystem.CheckResult{Repaired: true, Message: "xfs_repair repaired filesystem errors"}, nil
+}
+
+// slowCheck blocks filesystem check until the check context is done.
+type slowCheck struct {
+	filesystem.Filesystem
+}
+
+func (c *slowCheck) Check(ctx context.Context, device string) (filesystem.CheckResult, error) {
+	<-ctx.Done()
+	return filesystem.CheckResult{}, ctx.Err()
+}
+
+func TestNode_StageVolume_FsCheckInBackground(t *testing.T) {
+	t.Parallel()
+	logger := logrus.New()
+	fs := &blockingRepair{Filesystem: mock.NewFilesystem(logger), release: make(chan struct{}), ctxErr: make(chan error, 1)}
+	d, _ := node.NewNode("test-node", "fi-hel1", 10, fs, logger.WithField("package", "node_test"), node.WithFsckTimeout(time.Millisecond))
+	staging := filepath.Join(t.TempDir(), "staging")
+	stageRequest := &csi.NodeStageVolumeRequest{
+		VolumeId:          "test-vol",
+		StagingTargetPath: staging,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+		VolumeContext: map[string]string{"fsCheck": "true"},
+	}
+
+	// CO gives up waiting while the check is running
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+	defer cancel()
+	_, err := d.NodeStageVolume(ctx, stageRequest)
+	require.Equal(t, codes.Aborted, status.Code(err), err)
+	_, err = d.NodeStageVolume(context.TODO(), stageRequest)
+	require.Equal(t, codes.Aborted, status.Code(err), err)
+	_, err = d.NodeUnstageVolume(context.TODO(), &csi.NodeUnstageVolumeRequest{VolumeId: "test-vol", StagingTargetPath: staging})
+	require.Equal(t, codes.Aborted, status.Code(err), err)
+	_, err = os.Stat(staging)
+	require.True(t, os.IsNotExist(err), "volume is not mounted while the check is running")
+
+	// repair is not canceled with the call or by the check timeout and retried call picks up the result
+	time.Sleep(10 * time.Millisecond)
+	close(fs.release)
+	require.NoError(t, <-fs.ctxErr)
+	require.Eventually(t, func() bool {
+		_, err = d.NodeStageVolume(context.TODO(), stageRequest)
+		return status.Code(err) != codes.Aborted
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, err)
+	stats, err := d.NodeGetVolumeStats(context.TODO(), &csi.NodeGetVolumeStatsRequest{VolumeId: "test-vol", VolumePath: staging})
+	require.NoError(t, err)
+	require.True(t, stats.GetVolumeCondition().GetAbnormal())
+}
+
+func TestNode_StageVolume_FsCheckTimeout(t *testing.T) {
+	t.Parallel()
+	logger := logrus.New()
+	fs := &slowCheck{Filesystem: mock.NewFilesystem(logger)}
+	d, _ := node.NewNode("test-node", "fi-hel1", 10, fs, logger.WithField("package", "node_test"), node.WithFsckTimeout(10*time.Millisecond))
+	stageRequest := &csi.NodeStageVolumeRequest{
+		VolumeId:          "test-vol",
+		StagingTargetPath: filepath.Join(t.TempDir(), "staging"),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+		VolumeContext: map[string]string{"fsCheck": "true"},
+	}
+
+	_, err := d.NodeStageVolume(context.TODO(), stageRequest)
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err), err)
+}
+
+func TestNode_StageVolume_FsCheck(t *testing.T) {
+	t.Parallel()
+	logger := logrus.New()
+	fs := &checkResult{Filesystem: mock.NewFilesystem(logger)}
+	d, _ := node.NewNode("test-node", "fi-hel1", 10, fs, logger.WithField("package", "node_test"), node.WithFsckTimeout(time.Minute))
+	staging := filepath.Join(t.TempDir(), "staging")
+	stageRequest := &csi.NodeStageVolumeRequest{
+		VolumeId:          "test-vol",
+		StagingTargetPath: staging,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+		VolumeContext: map[string]string{"fsCheck": "true"},
+	}
+
+	fs.err = fmt.Errorf("e2fsck found errors; %w", filesystem.ErrFilesystemCorrupted)
+	_, err := d.NodeStageVolume(context.TODO(), stageRequest)
+	require.Equal(t, codes.DataLoss, status.Code(err), err)
+	_, err = os.Stat(staging)
+	require.True(t, os.IsNotExist(err), "corrupted filesystem is not mounted")
+
+	fs.err = nil
+	fs.result = filesystem.CheckResult{Repaired: true, Message: "e2fsck repaired filesystem errors"}
+	_, err = d.NodeStageVolume(context.TODO(), stageRequest)
+	require.NoError(t, err)
+	stats, err := d.NodeGetVolumeStats(context.TODO(), &csi.NodeGetVolumeStatsRequest{VolumeId: "test-vol", VolumePath: staging})
+	require.NoError(t, err)
+	require.True(t, stats.GetVolumeCondition().GetAbnormal())
+	require.Equal(t, fs.result.Message, stats.GetVolumeCondition().GetMessage())
+
+	_, err = d.NodeUnstageVolume(context.TODO(), &csi.NodeUnstageVolumeRequest{VolumeId: "test-vol", StagingTargetPath: staging})
+	require.NoError(t, err)
+	stageRequest.VolumeContext = nil
+	_, err = d.NodeStageVolume(context.TODO(), stageRequest)
+	require.NoError(t, err)
+	stats, err = d.NodeGetVolumeStats(context.TODO(), &csi.NodeGetVolumeStatsRequest{VolumeId: "test-vol", VolumePath: staging})
+	require.NoError(t, err)
+	require.False(t, stats.GetVolumeCondition().GetAbnormal(), "condition is reset when volume is unstaged")
+}
+
+func TestNode_PublishVolume_SingleWriter(t *testing.T) {
+	t.Parallel()
+	logger := logrus.New()
+	fs := mock.NewFilesystem(logger)
+	d, _ := node.NewNode("test-node", "fi-hel1", 10, fs, logger.WithField("package", "node_test"))
+	newRequest := func(target string, mode csi.VolumeCapability_AccessMode_Mode) *csi.NodePublishVolumeRequest {
+		return &csi.NodePublishVolumeRequest{
+			VolumeId:          "test-vol",
+			StagingTargetPath: "/staging",
+			TargetPath:        target,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+			},
+		}
+	}
+	dir := t.TempDir()
+	target1 := filepath.Join(dir, "target1")
+	target2 := filepath.Join(dir, "target2")
+
+	_, err := d.NodePublishVolume(context.TODO(), newRequest(target1, csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER))
+	require.NoError(t, err)
+	_, err = d.NodePublishVolume(context.TODO(), newRequest(target1, csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER))
+	require.NoError(t, err, "publishing volume to the same target path should be idempotent")
+	_, err = d.NodePublishVolume(context.TODO(), newRequest(target2, csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER))
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// published targets are read from the mount table, so restarted plugin still refuses the second target
+	restarted, _ := node.NewNode("test-node", "fi-hel1", 10, fs, logger.WithField("package", "node_test"))
+	_, err = restarted.NodePublishVolume(context.TODO(), newRequest(target2, csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER))
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = d.NodeUnpublishVolume(context.TODO(), &csi.NodeUnpublishVolumeRequest{VolumeId: "test-vol", TargetPath: target1})
+	require.NoError(t, err)
+	_, err = d.NodePublishVolume(context.TODO(), newRequest(target2, csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER))
+	require.NoError(t, err)
+	_, err = d.NodePublishVolume(context.TODO(), newRequest(target1, csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER))
+	require.NoError(t, err)
 }
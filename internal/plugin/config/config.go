@@ -1,8 +1,11 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/UpCloudLtd/upcloud-csi/internal/filesystem"
 	"github.com/spf13/pflag"
@@ -16,6 +19,8 @@ const (
 	// DefaultAddress is the default address that the csi plugin will serve its
 	// http handler on.
 	DefaultHealtServerAddress string = "tcp://127.0.0.1:13071"
+	// DefaultKubeletDir is the default root directory of kubelet.
+	DefaultKubeletDir string = "/var/lib/kubelet"
 	// DefaultPluginServerAddress is the default endpoint that the csi plugin will serve its
 	// GRPC handlers on.
 	DefaultPluginServerAddress string = "unix:///var/lib/kubelet/plugins/" + DefaultDriverName + "/csi.sock"
@@ -34,16 +39,48 @@ const (
 )
 
 type Config struct {
-	NodeHost        string
-	Zone            string
+	NodeHost string
+	Zone     string
+	// Zones contains additional zones served by the controller.
+	Zones           []string
 	Username        string
 	Password        string
 	DriverName      string
 	PrintVersion    bool
 	Mode            string
 	LogLevel        string
+	LogFormat       string
 	Labels          []string
 	FilesystemTypes []string
+	// StorageCacheTTL sets how long storage listing is cached.
+	StorageCacheTTL time.Duration
+	// APIRateLimit limits UpCloud API calls per second, zero disables rate limiting.
+	APIRateLimit float64
+	// APIRateBurst is the maximum burst of UpCloud API calls.
+	APIRateBurst int
+	// APIMaxRetries is the maximum number of retries of UpCloud API calls that failed with a transient error.
+	APIMaxRetries int
+	// APIURL is the base URL of UpCloud API, default API URL is used if not set.
+	APIURL string
+	// StatePollInterval sets how often storage and server state is polled while waiting for a state change.
+	StatePollInterval time.Duration
+	// JournalPath is the path of the file where pending volume operations are recorded.
+	JournalPath string
+	// JournalConfigMap is the `namespace/name` of the ConfigMap where pending volume operations are recorded.
+	JournalConfigMap string
+	// CapacityTracking enables GetCapacity RPC that reports remaining storage quota of the account.
+	CapacityTracking bool
+
+	// KubeletDir is kubelet's root directory which is required to have shared mount propagation.
+	KubeletDir string
+	// FsckTimeout limits the duration of read-only filesystem check before volume is staged, zero means no limit.
+	FsckTimeout time.Duration
+	// OTLPEndpoint is the OTLP gRPC endpoint where traces are exported, tracing is disabled if not set.
+	OTLPEndpoint string
+	// OTLPInsecure disables TLS of the OTLP exporter.
+	OTLPInsecure bool
+	// TraceSampleRatio is the ratio of sampled traces.
+	TraceSampleRatio float64
 
 	PluginServerAddress string
 	HealtServerAddress  string
@@ -57,20 +94,44 @@ func Parse(osArgs []string) (Config, error) {
 	flagSet.StringVar(&c.PluginServerAddress, "endpoint", DefaultPluginServerAddress, "CSI endpoint")
 	flagSet.StringVar(&c.NodeHost, "nodehost", "", "Node's hostname. This should match server's `hostname` in the hub.upcloud.com.")
 	flagSet.StringVar(&c.Zone, "zone", "", "The zone in which the driver will be hosted, e.g. de-fra1. Defaults to `nodeHost` zone.")
+	flagSet.StringSliceVar(&c.Zones, "zones", nil, "Additional zones served by the controller, e.g. --zones=fi-hel1,fi-hel2. Volumes are created in the zone set using --zone unless topology requirements specify otherwise.")
 	flagSet.StringVar(&c.Username, "username", "", "UpCloud username")
 	flagSet.StringVar(&c.Password, "password", "", "UpCloud password")
 	flagSet.StringVar(&c.DriverName, "driver-name", DefaultDriverName, "Name for the driver")
 	flagSet.StringVar(&c.HealtServerAddress, "address", DefaultHealtServerAddress, "Address to serve on")
 	flagSet.BoolVar(&c.PrintVersion, "version", false, "Print the version and exit.")
 	flagSet.StringVar(&c.Mode, "mode", DefaultDriverMode, "Driver mode, one of node, controller, or monolith.")
-	flagSet.StringVar(&c.LogLevel, "log-level", "info", "Logging level: panic, fatal, error, warn, warning, info, debug or trace")
+	flagSet.StringVar(&c.LogLevel, "log-level", "info", "Logging level: panic, fatal, error, warn, warning, info, debug or trace. Level is raised at runtime using SIGUSR1 and lowered using SIGUSR2 signal.")
+	flagSet.StringVar(&c.LogFormat, "log-format", "text", "Logging format: text or json")
 	flagSet.StringSliceVar(&c.Labels, "label", nil, "Apply default labels to all storage devices created by CSI driver, e.g. --label=color=green --label=size=xl")
+	flagSet.BoolVar(&c.CapacityTracking, "capacity-tracking", false, "Report available storage capacity using account's storage quota. Requires that external-provisioner is started with --enable-capacity flag.")
+	flagSet.DurationVar(&c.StorageCacheTTL, "storage-cache-ttl", time.Minute, "How long storage listing is cached before it's refreshed, zero disables caching.")
+	flagSet.Float64Var(&c.APIRateLimit, "api-rate-limit", 5, "Maximum number of UpCloud API calls per second, zero disables rate limiting.")
+	flagSet.IntVar(&c.APIRateBurst, "api-rate-burst", 10, "Maximum burst of UpCloud API calls.")
+	flagSet.IntVar(&c.APIMaxRetries, "api-max-retries", 4, "Maximum number of retries of UpCloud API calls that failed with a transient error, e.g. rate limit or server in maintenance state.")
+	flagSet.StringVar(&c.APIURL, "api-url", "", "Base URL of UpCloud API, e.g. URL of local API stand-in used in tests. Defaults to https://api.upcloud.com.")
+	flagSet.DurationVar(&c.StatePollInterval, "state-poll-interval", 5*time.Second, "How often storage and server state is polled while waiting for an operation to finish.")
+	flagSet.StringVar(&c.JournalPath, "journal-path", "", "Path of the file where pending volume operations are recorded so that they can be resumed after controller restart. Operations are kept in memory if path is not set.")
+	flagSet.StringVar(&c.JournalConfigMap, "journal-configmap", "", "ConfigMap, in namespace/name format, where pending volume operations are recorded so that they can be resumed after controller is restarted or rescheduled. Requires in-cluster Kubernetes API access. Can't be used together with --journal-path.")
+	flagSet.StringVar(&c.KubeletDir, "kubelet-dir", DefaultKubeletDir, "Kubelet's root directory, node is ready only if directory has shared mount propagation. Empty value disables the check.")
+	flagSet.DurationVar(&c.FsckTimeout, "fsck-timeout", 10*time.Minute, "Maximum duration of read-only filesystem check of volumes using 'fsCheck' storage class parameter, zero disables the timeout. Repair of errors found by the check is not limited. Check runs in background and is not bound to the deadline of the staging call.")
+	flagSet.StringVar(&c.OTLPEndpoint, "otlp-endpoint", "", "OTLP gRPC endpoint where traces are exported, e.g. otel-collector:4317. Tracing is disabled if not set.")
+	flagSet.BoolVar(&c.OTLPInsecure, "otlp-insecure", false, "Export traces without TLS.")
+	flagSet.Float64Var(&c.TraceSampleRatio, "trace-sample-ratio", 1, "Ratio of traces that are sampled, between 0 and 1.")
 	flagSet.StringSliceVar(&c.FilesystemTypes, "fs-types", []string{"ext3", "ext4", "xfs"}, "Filesystem types supported by the system")
 
 	if err := flagSet.Parse(osArgs); err != nil {
 		return c, err
 	}
 
+	if c.TraceSampleRatio < 0 || c.TraceSampleRatio > 1 {
+		return c, fmt.Errorf("--trace-sample-ratio must be between 0 and 1, got %g", c.TraceSampleRatio)
+	}
+
+	if c.JournalPath != "" && c.JournalConfigMap != "" {
+		return c, errors.New("--journal-path and --journal-configmap can't be used together")
+	}
+
 	if len(c.Labels) == 0 {
 		c.Labels = strings.Split(os.Getenv(envStorageLabels), ",")
 	}
@@ -0,0 +1,22 @@
+package config_test
+
+import (
+	"testing"
+
+	"github.com/UpCloudLtd/upcloud-csi/internal/plugin/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse_TraceSampleRatio(t *testing.T) {
+	t.Parallel()
+
+	c, err := config.Parse([]string{"--trace-sample-ratio=0.25"})
+	require.NoError(t, err)
+	assert.InDelta(t, 0.25, c.TraceSampleRatio, 0)
+
+	for _, ratio := range []string{"-0.1", "1.5"} {
+		_, err := config.Parse([]string{"--trace-sample-ratio=" + ratio})
+		require.Error(t, err, ratio)
+	}
+}
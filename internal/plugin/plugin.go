@@ -9,122 +9,225 @@ import (
 
 	"github.com/UpCloudLtd/upcloud-csi/internal/controller"
 	"github.com/UpCloudLtd/upcloud-csi/internal/filesystem"
+	"github.com/UpCloudLtd/upcloud-csi/internal/health"
 	"github.com/UpCloudLtd/upcloud-csi/internal/identity"
+	"github.com/UpCloudLtd/upcloud-csi/internal/journal"
 	"github.com/UpCloudLtd/upcloud-csi/internal/logger"
 	"github.com/UpCloudLtd/upcloud-csi/internal/node"
 	"github.com/UpCloudLtd/upcloud-csi/internal/plugin/config"
 	"github.com/UpCloudLtd/upcloud-csi/internal/server"
 	"github.com/UpCloudLtd/upcloud-csi/internal/service"
+	"github.com/UpCloudLtd/upcloud-csi/internal/tracing"
 	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 func Run(c config.Config) error {
-	l := logger.New(c.LogLevel).WithField(logger.HostKey, hostname())
-	healthServer, err := server.NewHealthServer(c.HealtServerAddress, l)
+	l := logger.New(c.LogLevel, c.LogFormat).WithField(logger.HostKey, hostname())
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		Endpoint:       c.OTLPEndpoint,
+		Insecure:       c.OTLPInsecure,
+		SampleRatio:    c.TraceSampleRatio,
+		ServiceName:    "upcloud-csi-" + c.Mode,
+		ServiceVersion: GetVersion(),
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			l.WithError(err).Error("failed to flush traces")
+		}
+	}()
+
+	pluginServer, checker, err := newPluginServer(c, l)
 	if err != nil {
 		return err
 	}
 
-	pluginServer, err := newPluginServer(c, l)
+	healthServer, err := server.NewHealthServer(c.HealtServerAddress, checker, l)
 	if err != nil {
 		return err
 	}
-	return server.Run(pluginServer, healthServer)
+	return server.Run(l, pluginServer, healthServer)
 }
 
-func newPluginServer(c config.Config, l *logrus.Entry) (*server.PluginServer, error) {
+// newPluginServer creates plugin server and checker of plugin's readiness.
+func newPluginServer(c config.Config, l *logrus.Entry) (*server.PluginServer, *health.Checker, error) {
 	var srv *server.PluginServer
+	var checker *health.Checker
 	var err error
 	if c.Filesystem == nil {
 		c.Filesystem, err = filesystem.NewLinuxFilesystem(c.FilesystemTypes, l)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
 	switch c.Mode {
 	case config.DriverModeController:
 		if err := validateControllerConfig(c); err != nil {
-			return srv, err
+			return srv, checker, err
 		}
-		if srv, err = newControllerPluginServer(c, l); err != nil {
-			return srv, err
+		if srv, checker, err = newControllerPluginServer(c, l); err != nil {
+			return srv, checker, err
 		}
 	case config.DriverModeNode:
-		if srv, err = newNodePluginServer(c, l); err != nil {
-			return srv, err
+		if srv, checker, err = newNodePluginServer(c, l); err != nil {
+			return srv, checker, err
 		}
 	case config.DriverModeMonolith:
 		if err := validateControllerConfig(c); err != nil {
-			return srv, err
+			return srv, checker, err
 		}
-		if srv, err = newMonolithPluginServer(c, l); err != nil {
-			return srv, err
+		if srv, checker, err = newMonolithPluginServer(c, l); err != nil {
+			return srv, checker, err
 		}
 	default:
-		return srv, fmt.Errorf("unknow driver mode '%s'", c.Mode)
+		return srv, checker, fmt.Errorf("unknow driver mode '%s'", c.Mode)
 	}
-	return srv, nil
+	return srv, checker, nil
 }
 
-func newNodePluginServer(c config.Config, l *logrus.Entry) (*server.PluginServer, error) {
+func newNodePluginServer(c config.Config, l *logrus.Entry) (*server.PluginServer, *health.Checker, error) {
 	l = l.WithField(logger.NodeIDKey, c.NodeHost)
 	if c.Zone != "" {
 		l = l.WithField(logger.ZoneKey, c.Zone)
 	}
 
-	csiNode, err := node.NewNode(c.NodeHost, c.Zone, int64(config.MaxVolumesPerNode), c.Filesystem, l)
+	csiNode, err := node.NewNode(c.NodeHost, c.Zone, int64(config.MaxVolumesPerNode), c.Filesystem, l, node.WithFsckTimeout(c.FsckTimeout))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	identity := identity.NewIdentity(c.DriverName, l)
+	checker := health.NewChecker(nodeReadinessChecks(c)...)
+	identity := identity.NewIdentity(c.DriverName, checker, l)
 	pluginServer, err := server.NewNodePluginServer(c.PluginServerAddress, csiNode, identity, l)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return pluginServer, nil
+	return pluginServer, checker, nil
 }
 
-func newControllerPluginServer(c config.Config, l *logrus.Entry) (*server.PluginServer, error) {
-	svc, err := service.NewUpCloudServiceFromCredentials(c.Username, c.Password)
+func newControllerPluginServer(c config.Config, l *logrus.Entry) (*server.PluginServer, *health.Checker, error) {
+	svc, err := service.NewUpCloudServiceFromCredentials(c.Username, c.Password, serviceOptions(c)...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	autoConfigureZone(svc, &c)
 	l = l.WithField(logger.ZoneKey, c.Zone)
-	csiController, err := controller.NewController(svc, c.Zone, config.MaxVolumesPerNode, l, c.Labels...)
+	csiController, err := newController(c, svc, l)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	identity := identity.NewIdentity(c.DriverName, l)
+	checker := health.NewChecker(controllerReadinessChecks(c, svc)...)
+	identity := identity.NewIdentity(c.DriverName, checker, l)
 	pluginServer, err := server.NewControllerPluginServer(c.PluginServerAddress, csiController, identity, l)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return pluginServer, nil
+	return pluginServer, checker, nil
 }
 
-func newMonolithPluginServer(c config.Config, l *logrus.Entry) (*server.PluginServer, error) {
-	svc, err := service.NewUpCloudServiceFromCredentials(c.Username, c.Password)
+func newMonolithPluginServer(c config.Config, l *logrus.Entry) (*server.PluginServer, *health.Checker, error) {
+	svc, err := service.NewUpCloudServiceFromCredentials(c.Username, c.Password, serviceOptions(c)...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	autoConfigureZone(svc, &c)
 	l = l.WithField(logger.NodeIDKey, c.NodeHost).WithField(logger.ZoneKey, c.Zone)
-	csiController, err := controller.NewController(svc, c.Zone, config.MaxVolumesPerNode, l, c.Labels...)
+	csiController, err := newController(c, svc, l)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	csiNode, err := node.NewNode(c.NodeHost, c.Zone, int64(config.MaxVolumesPerNode), c.Filesystem, l)
+	csiNode, err := node.NewNode(c.NodeHost, c.Zone, int64(config.MaxVolumesPerNode), c.Filesystem, l, node.WithFsckTimeout(c.FsckTimeout))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	identity := identity.NewIdentity(c.DriverName, l)
+	checker := health.NewChecker(append(controllerReadinessChecks(c, svc), nodeReadinessChecks(c)...)...)
+	identity := identity.NewIdentity(c.DriverName, checker, l)
 	pluginServer, err := server.NewPluginServer(c.PluginServerAddress, csiController, csiNode, identity, l)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pluginServer, checker, nil
+}
+
+// controllerReadinessChecks returns checks that UpCloud API credentials work and that controller's zone is resolved.
+func controllerReadinessChecks(c config.Config, svc service.Service) []health.Check {
+	return []health.Check{
+		{Name: "upcloud-api", Run: func(ctx context.Context) error {
+			// fetching account requires valid credentials
+			_, err := svc.GetAccount(ctx)
+			return err
+		}},
+		{Name: "zone", Run: func(context.Context) error {
+			if c.Zone == "" {
+				return fmt.Errorf("zone is not set and it couldn't be resolved using node host '%s'", c.NodeHost)
+			}
+			return nil
+		}},
+	}
+}
+
+// readinessChecker is implemented by filesystems that are able to check node's readiness.
+type readinessChecker interface {
+	ReadinessChecks(kubeletDir string) []health.Check
+}
+
+// nodeReadinessChecks returns checks of the node's filesystem.
+func nodeReadinessChecks(c config.Config) []health.Check {
+	if fs, ok := c.Filesystem.(readinessChecker); ok {
+		return fs.ReadinessChecks(c.KubeletDir)
+	}
+	return nil
+}
+
+// newJournal returns journal configured using either journal file or ConfigMap. Nil journal means that
+// controller keeps pending operations in memory.
+func newJournal(c config.Config) (journal.Journal, error) {
+	switch {
+	case c.JournalPath != "":
+		return journal.NewFileJournal(c.JournalPath)
+	case c.JournalConfigMap != "":
+		restConfig, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure Kubernetes client for journal: %w", err)
+		}
+		client, err := kubernetes.NewForConfig(restConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Kubernetes client for journal: %w", err)
+		}
+		return journal.NewConfigMapJournal(client, c.JournalConfigMap)
+	}
+	return nil, nil
+}
+
+// newController creates controller and resumes operations that were interrupted by previous controller instance.
+func newController(c config.Config, svc service.Service, l *logrus.Entry) (*controller.Controller, error) {
+	if c.OTLPEndpoint != "" {
+		svc = service.NewTracingService(svc)
+	}
+	j, err := newJournal(c)
 	if err != nil {
 		return nil, err
 	}
-	return pluginServer, nil
+	csiController, err := controller.NewController(svc, controllerZones(c), config.MaxVolumesPerNode, l,
+		controller.WithCapacityTracking(c.CapacityTracking),
+		controller.WithJournal(j),
+		controller.WithLabels(c.Labels...),
+	)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		if err := csiController.ResumeOperations(context.Background()); err != nil {
+			l.WithError(err).Error("failed to resume pending operations")
+		}
+	}()
+	return csiController, nil
 }
 
 func autoConfigureZone(svc *service.UpCloudService, c *config.Config) {
@@ -138,6 +241,30 @@ func autoConfigureZone(svc *service.UpCloudService, c *config.Config) {
 	}
 }
 
+// controllerZones returns zones served by the controller, default zone being the first one.
+func controllerZones(c config.Config) []string {
+	zones := []string{c.Zone}
+	for _, zone := range c.Zones {
+		if zone != "" && zone != c.Zone {
+			zones = append(zones, zone)
+		}
+	}
+	return zones
+}
+
+// serviceOptions returns UpCloud service options set in the config.
+func serviceOptions(c config.Config) []service.Option {
+	policy := service.DefaultRetryPolicy
+	policy.MaxAttempts = c.APIMaxRetries + 1
+	return []service.Option{
+		service.WithStorageCacheTTL(c.StorageCacheTTL),
+		service.WithRetryPolicy(policy),
+		service.WithRateLimit(c.APIRateLimit, c.APIRateBurst),
+		service.WithAPIURL(c.APIURL),
+		service.WithStatePollInterval(c.StatePollInterval),
+	}
+}
+
 func hostname() string {
 	if n, err := os.Hostname(); err == nil {
 		return n
@@ -1,18 +1,21 @@
 package plugin
 
 import (
+	"context"
+	"errors"
 	"testing"
 
 	"github.com/UpCloudLtd/upcloud-csi/internal/filesystem/mock"
 	"github.com/UpCloudLtd/upcloud-csi/internal/logger"
 	"github.com/UpCloudLtd/upcloud-csi/internal/plugin/config"
+	svcmock "github.com/UpCloudLtd/upcloud-csi/internal/service/mock"
 	"github.com/stretchr/testify/require"
 )
 
 func TestNewPluginServer(t *testing.T) {
 	t.Parallel()
 
-	l := logger.New("error")
+	l := logger.New("error", logger.FormatText)
 	cfg := config.Config{
 		Username:            "test-user",
 		Password:            "test-password",
@@ -22,7 +25,7 @@ func TestNewPluginServer(t *testing.T) {
 		PluginServerAddress: config.DefaultPluginServerAddress,
 		Filesystem:          &mock.MockFilesystem{},
 	}
-	srv, err := newPluginServer(cfg, l.WithField("package", "plugin"))
+	srv, _, err := newPluginServer(cfg, l.WithField("package", "plugin"))
 	require.NoError(t, err)
 	require.Contains(t, srv.GetServiceInfo(), "csi.v1.Controller")
 	require.Contains(t, srv.GetServiceInfo(), "csi.v1.Identity")
@@ -35,7 +38,7 @@ func TestNewPluginServer(t *testing.T) {
 		Zone:                "fi-hel2",
 		Filesystem:          &mock.MockFilesystem{},
 	}
-	srv, err = newPluginServer(cfg, l.WithField("package", "plugin"))
+	srv, _, err = newPluginServer(cfg, l.WithField("package", "plugin"))
 	require.NoError(t, err)
 	require.Contains(t, srv.GetServiceInfo(), "csi.v1.Node")
 	require.Contains(t, srv.GetServiceInfo(), "csi.v1.Identity")
@@ -50,9 +53,38 @@ func TestNewPluginServer(t *testing.T) {
 		Zone:                "fi-hel2",
 		Filesystem:          &mock.MockFilesystem{},
 	}
-	srv, err = newPluginServer(cfg, l.WithField("package", "plugin"))
+	srv, _, err = newPluginServer(cfg, l.WithField("package", "plugin"))
 	require.NoError(t, err)
 	require.Contains(t, srv.GetServiceInfo(), "csi.v1.Node")
 	require.Contains(t, srv.GetServiceInfo(), "csi.v1.Identity")
 	require.Contains(t, srv.GetServiceInfo(), "csi.v1.Controller")
 }
+
+func TestReadinessChecks(t *testing.T) {
+	t.Parallel()
+
+	cfg := config.Config{NodeHost: "missing-node", Filesystem: &mock.MockFilesystem{}}
+	require.Empty(t, nodeReadinessChecks(cfg))
+
+	checks := controllerReadinessChecks(cfg, nil)
+	require.Len(t, checks, 2)
+	require.Equal(t, "zone", checks[1].Name)
+	require.EqualError(t, checks[1].Run(context.Background()), "zone is not set and it couldn't be resolved using node host 'missing-node'")
+
+	cfg.Zone = "fi-hel2"
+	require.NoError(t, controllerReadinessChecks(cfg, nil)[1].Run(context.Background()))
+}
+
+func TestControllerReadinessChecks(t *testing.T) {
+	t.Parallel()
+
+	svc := svcmock.NewFakeService()
+	checks := controllerReadinessChecks(config.Config{Zone: "fi-hel2"}, svc)
+	require.Equal(t, "upcloud-api", checks[0].Name)
+	require.NoError(t, checks[0].Run(context.Background()))
+
+	// credentials are checked by fetching the account
+	svc.InjectFault("GetAccount", errors.New("invalid credentials"))
+	require.Error(t, checks[0].Run(context.Background()))
+	require.NoError(t, checks[0].Run(context.Background()))
+}
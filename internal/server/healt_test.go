@@ -1,12 +1,17 @@
 package server_test
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/UpCloudLtd/upcloud-csi/internal/health"
 	"github.com/UpCloudLtd/upcloud-csi/internal/logger"
 	"github.com/UpCloudLtd/upcloud-csi/internal/plugin/config"
 	"github.com/UpCloudLtd/upcloud-csi/internal/server"
@@ -16,11 +21,11 @@ import (
 func TestHealthServer(t *testing.T) {
 	t.Parallel()
 
-	l := logger.New("info").WithField("package", "server_test")
+	l := logger.New("info", logger.FormatText).WithField("package", "server_test")
 
 	const addr string = config.DefaultHealtServerAddress
 
-	srv, err := server.NewHealthServer(addr, l)
+	srv, err := server.NewHealthServer(addr, nil, l)
 	require.NoError(t, err)
 	go func() {
 		t.Logf("starting HTTP Health server at %s", addr)
@@ -32,5 +37,57 @@ func TestHealthServer(t *testing.T) {
 	res, err := http.Get(fmt.Sprintf("http%s/health", strings.TrimPrefix(addr, "tcp")))
 	require.NoError(t, err)
 	require.Equal(t, http.StatusOK, res.StatusCode)
+	res.Body.Close()
+
+	res, err = http.Get(fmt.Sprintf("http%s/metrics", strings.TrimPrefix(addr, "tcp")))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), "go_goroutines")
 	srv.Stop(nil)
 }
+
+func TestHealthServer_Readiness(t *testing.T) {
+	t.Parallel()
+
+	l := logger.New("info", logger.FormatText).WithField("package", "server_test")
+
+	const addr string = "tcp://127.0.0.1:13072"
+
+	checker := health.NewChecker(health.Check{
+		Name: "upcloud-api",
+		Run: func(context.Context) error {
+			return errors.New("invalid credentials")
+		},
+	})
+	srv, err := server.NewHealthServer(addr, checker, l)
+	require.NoError(t, err)
+	go func() {
+		t.Logf("starting HTTP Health server at %s", addr)
+		if err := srv.Run(); err != nil {
+			t.Log(err)
+		}
+	}()
+	defer srv.Stop(nil)
+	time.Sleep(2 * time.Second)
+
+	for _, path := range []string{"/readyz", "/health"} {
+		res, err := http.Get(fmt.Sprintf("http%s%s", strings.TrimPrefix(addr, "tcp"), path))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+		var report health.Report
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&report))
+		res.Body.Close()
+		require.Equal(t, health.Report{
+			Status: health.StatusUnavailable,
+			Checks: []health.Result{{Name: "upcloud-api", Status: health.StatusUnavailable, Error: "invalid credentials"}},
+		}, report)
+	}
+
+	res, err := http.Get(fmt.Sprintf("http%s/livez", strings.TrimPrefix(addr, "tcp")))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+}
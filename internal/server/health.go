@@ -1,6 +1,7 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
@@ -8,6 +9,8 @@ import (
 	"os"
 	"time"
 
+	"github.com/UpCloudLtd/upcloud-csi/internal/health"
+	"github.com/UpCloudLtd/upcloud-csi/internal/metrics"
 	"github.com/sirupsen/logrus"
 )
 
@@ -22,13 +25,18 @@ type HealthServer struct {
 	listen *url.URL
 }
 
-func NewHealthServer(addr string, l *logrus.Entry) (*HealthServer, error) {
+// NewHealthServer creates HTTP server that serves liveness (/livez), readiness (/readyz and /health) and metrics (/metrics).
+// Readiness is reported using checker, nil checker is always ready.
+func NewHealthServer(addr string, checker *health.Checker, l *logrus.Entry) (*HealthServer, error) {
 	listen, err := url.Parse(addr)
 	if err != nil {
 		return nil, err
 	}
 	mux := http.NewServeMux()
-	mux.HandleFunc("/health", healthHandlerFn(l))
+	mux.HandleFunc("/health", readyHandlerFn(checker, l))
+	mux.HandleFunc("/readyz", readyHandlerFn(checker, l))
+	mux.HandleFunc("/livez", liveHandlerFn(l))
+	mux.Handle("/metrics", metrics.Handler())
 	return &HealthServer{
 		listen: listen,
 		log:    l,
@@ -41,8 +49,9 @@ func NewHealthServer(addr string, l *logrus.Entry) (*HealthServer, error) {
 
 func (s *HealthServer) Run() error {
 	s.log.WithFields(logrus.Fields{
-		"listen":     s.listen.String(),
-		"health_url": fmt.Sprintf("http://%s/health", s.listen.Host),
+		"listen":      s.listen.String(),
+		"health_url":  fmt.Sprintf("http://%s/health", s.listen.Host),
+		"metrics_url": fmt.Sprintf("http://%s/metrics", s.listen.Host),
 	}).Info("starting HTTP server")
 
 	listener, err := net.Listen(s.listen.Scheme, s.listen.Host)
@@ -61,9 +70,31 @@ func (s *HealthServer) Stop(sig os.Signal) {
 	}
 }
 
-func healthHandlerFn(l *logrus.Entry) func(w http.ResponseWriter, r *http.Request) {
+// liveHandlerFn reports that the process is able to serve requests.
+func liveHandlerFn(l *logrus.Entry) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		l.Infof("%s %s %s [%s]", r.Method, r.Host, r.URL.String(), r.UserAgent())
-		w.WriteHeader(http.StatusOK)
+		writeJSON(w, http.StatusOK, health.Report{Status: health.StatusOK, Checks: []health.Result{}}, l)
+	}
+}
+
+// readyHandlerFn reports result of readiness checks. Service unavailable status is returned until all the checks pass.
+func readyHandlerFn(checker *health.Checker, l *logrus.Entry) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l.Infof("%s %s %s [%s]", r.Method, r.Host, r.URL.String(), r.UserAgent())
+		report := checker.Check(r.Context())
+		code := http.StatusOK
+		if !report.Ready() {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, report, l)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}, l *logrus.Entry) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		l.WithError(err).Error("failed to write response")
 	}
 }
@@ -21,14 +21,14 @@ import (
 func TestPluginServer(t *testing.T) {
 	t.Parallel()
 
-	l := logger.New("info").WithField("package", "server_test")
+	l := logger.New("info", logger.FormatText).WithField("package", "server_test")
 	tmpSocket := path.Join(os.TempDir(), fmt.Sprintf("test-plugin-server-%d.sock", time.Now().Unix()))
 	addr := fmt.Sprintf("unix://%s", tmpSocket)
 	defer func() {
 		os.Remove(tmpSocket)
 	}()
 
-	srv, err := server.NewPluginServer(addr, nil, nil, identity.NewIdentity(config.DefaultDriverName, l), l)
+	srv, err := server.NewPluginServer(addr, nil, nil, identity.NewIdentity(config.DefaultDriverName, nil, l), l)
 	require.NoError(t, err)
 
 	go func() {
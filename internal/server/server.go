@@ -5,6 +5,8 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/UpCloudLtd/upcloud-csi/internal/logger"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -13,7 +15,9 @@ type Server interface {
 	Stop(os.Signal)
 }
 
-func Run(servers ...Server) error {
+// Run runs servers until one of them fails or process receives termination signal.
+// Log level of l is raised using SIGUSR1 and lowered using SIGUSR2 signal.
+func Run(l *logrus.Entry, servers ...Server) error {
 	var eg errgroup.Group
 	for i := range servers {
 		server := servers[i]
@@ -22,18 +26,27 @@ func Run(servers ...Server) error {
 		})
 	}
 
-	go listenSyscalls(servers...)
+	go listenSyscalls(l, servers...)
 	return eg.Wait()
 }
 
-func listenSyscalls(servers ...Server) {
-	// Listen for syscall signals for process to interrupt/quit
+func listenSyscalls(l *logrus.Entry, servers ...Server) {
+	// Listen for syscall signals for process to interrupt/quit or to change log level
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-	sig := <-sigCh
-	signal.Stop(sigCh)
-	for i := range servers {
-		servers[i].Stop(sig)
+	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
+	for sig := range sigCh {
+		switch sig {
+		case syscall.SIGUSR1:
+			l.WithField(logger.LogLevelKey, logger.IncreaseLevel(l.Logger).String()).Warn("log level increased")
+			continue
+		case syscall.SIGUSR2:
+			l.WithField(logger.LogLevelKey, logger.DecreaseLevel(l.Logger).String()).Warn("log level decreased")
+			continue
+		}
+		signal.Stop(sigCh)
+		for i := range servers {
+			servers[i].Stop(sig)
+		}
+		close(sigCh)
 	}
-	close(sigCh)
 }
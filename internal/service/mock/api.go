@@ -0,0 +1,405 @@
+package mock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/UpCloudLtd/upcloud-csi/internal/service"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/client"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/request"
+)
+
+// unlimitedQuota is storage limit reported by the API for tiers without quota.
+const unlimitedQuota = 1 << 20
+
+// quota returns storage limit of the tier the same way as the API reports it. Lock must be held by the caller.
+func (f *FakeService) quota(tier string) int {
+	if limit, ok := f.Quota[tier]; ok {
+		return limit
+	}
+	return unlimitedQuota
+}
+
+// apiFunc handles API request and returns HTTP status code and response body. Lock is held while it's called.
+type apiFunc func(r *http.Request) (int, any, error)
+
+// APIHandler returns HTTP handler serving the subset of UpCloud REST API used by the CSI driver.
+// Handler uses the same state as service methods, so that the driver can be run against local API stand-in,
+// e.g. using httptest.NewServer(f.APIHandler()).
+//
+// Unlike service methods, API calls don't wait for storage operations to finish. Storages are returned in
+// transitional state, and client needs to poll storage state the same way as with the real API.
+// Faults are injected using names of the API client methods, e.g. "GetStorageDetails" or "AttachStorage".
+func (f *FakeService) APIHandler() http.Handler {
+	prefix := "/" + client.APIVersion
+	mux := http.NewServeMux()
+	mux.Handle("GET "+prefix+"/account", f.api("GetAccount", f.apiGetAccount))
+	mux.Handle("GET "+prefix+"/server", f.api("GetServers", f.apiGetServers))
+	mux.Handle("GET "+prefix+"/server/{uuid}", f.api("GetServerDetails", f.apiGetServerDetails))
+	mux.Handle("POST "+prefix+"/server/{uuid}/storage/attach", f.api("AttachStorage", f.apiAttachStorage))
+	mux.Handle("POST "+prefix+"/server/{uuid}/storage/detach", f.api("DetachStorage", f.apiDetachStorage))
+	mux.Handle("GET "+prefix+"/storage/private", f.api("GetStorages", f.apiGetStorages))
+	mux.Handle("POST "+prefix+"/storage", f.api("CreateStorage", f.apiCreateStorage))
+	mux.Handle("GET "+prefix+"/storage/{uuid}", f.api("GetStorageDetails", f.apiGetStorageDetails))
+	mux.Handle("PUT "+prefix+"/storage/{uuid}", f.api("ModifyStorage", f.apiModifyStorage))
+	mux.Handle("DELETE "+prefix+"/storage/{uuid}", f.api("DeleteStorage", f.apiDeleteStorage))
+	mux.Handle("POST "+prefix+"/storage/{uuid}/clone", f.api("CloneStorage", f.apiCloneStorage))
+	mux.Handle("POST "+prefix+"/storage/{uuid}/backup", f.api("CreateBackup", f.apiCreateBackup))
+	mux.Handle("POST "+prefix+"/storage/{uuid}/resize", f.api("ResizeStorageFilesystem", f.apiResizeStorageFilesystem))
+	return mux
+}
+
+func (f *FakeService) api(op string, fn apiFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := f.fault(op); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		f.mu.Lock()
+		f.advance()
+		code, body, err := fn(r)
+		f.mu.Unlock()
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		if body == nil {
+			w.WriteHeader(code)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(body)
+	})
+}
+
+func (f *FakeService) apiGetAccount(_ *http.Request) (int, any, error) {
+	return http.StatusOK, map[string]any{
+		"account": map[string]any{
+			"username": "fake",
+			"resource_limits": map[string]int{
+				"storage_maxiops": f.quota(upcloud.StorageTierMaxIOPS),
+				"storage_ssd":     f.quota(upcloud.StorageTierStandard),
+				"storage_hdd":     f.quota(upcloud.StorageTierHDD),
+			},
+		},
+	}, nil
+}
+
+func (f *FakeService) apiGetServers(_ *http.Request) (int, any, error) {
+	servers := make([]apiServer, 0, len(f.servers))
+	for _, s := range f.servers {
+		servers = append(servers, newAPIServer(s, false))
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].UUID < servers[j].UUID })
+	return http.StatusOK, map[string]any{"servers": map[string]any{"server": servers}}, nil
+}
+
+func (f *FakeService) apiGetServerDetails(r *http.Request) (int, any, error) {
+	s, ok := f.servers[r.PathValue("uuid")]
+	if !ok {
+		return 0, nil, service.ErrServerNotFound
+	}
+	return http.StatusOK, map[string]any{"server": newAPIServer(s, true)}, nil
+}
+
+func (f *FakeService) apiAttachStorage(r *http.Request) (int, any, error) {
+	var req struct {
+		StorageDevice request.AttachStorageRequest `json:"storage_device"`
+	}
+	if err := decodeAPIRequest(r, &req); err != nil {
+		return 0, nil, err
+	}
+	serverUUID := r.PathValue("uuid")
+	if err := f.attachStorage(req.StorageDevice.StorageUUID, serverUUID); err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, map[string]any{"server": newAPIServer(f.servers[serverUUID], true)}, nil
+}
+
+func (f *FakeService) apiDetachStorage(r *http.Request) (int, any, error) {
+	var req struct {
+		StorageDevice request.DetachStorageRequest `json:"storage_device"`
+	}
+	if err := decodeAPIRequest(r, &req); err != nil {
+		return 0, nil, err
+	}
+	server, ok := f.servers[r.PathValue("uuid")]
+	if !ok {
+		return 0, nil, service.ErrServerNotFound
+	}
+	for _, d := range server.StorageDevices {
+		if d.Address != req.StorageDevice.Address {
+			continue
+		}
+		if err := f.detachStorage(d.UUID, server.UUID); err != nil {
+			return 0, nil, err
+		}
+		return http.StatusOK, map[string]any{"server": newAPIServer(server, true)}, nil
+	}
+	return 0, nil, &upcloud.Problem{
+		Type:   upcloud.ErrCodeStorageDeviceInvalid,
+		Title:  fmt.Sprintf("no storage device at address %s", req.StorageDevice.Address),
+		Status: http.StatusBadRequest,
+	}
+}
+
+func (f *FakeService) apiGetStorages(_ *http.Request) (int, any, error) {
+	storages := make([]apiStorage, 0, len(f.storages))
+	for _, s := range f.storages {
+		storages = append(storages, newAPIStorage(s, false))
+	}
+	sort.Slice(storages, func(i, j int) bool { return storages[i].UUID < storages[j].UUID })
+	return http.StatusOK, map[string]any{"storages": map[string]any{"storage": storages}}, nil
+}
+
+func (f *FakeService) apiCreateStorage(r *http.Request) (int, any, error) {
+	var req struct {
+		Storage request.CreateStorageRequest `json:"storage"`
+	}
+	if err := decodeAPIRequest(r, &req); err != nil {
+		return 0, nil, err
+	}
+	if req.Storage.Tier == "" {
+		req.Storage.Tier = upcloud.StorageTierMaxIOPS
+	}
+	if err := f.checkQuota(req.Storage.Tier, req.Storage.Size); err != nil {
+		return 0, nil, err
+	}
+	s := f.newStorage(req.Storage.Title, req.Storage.Zone, req.Storage.Size, upcloud.StorageTypeNormal)
+	s.Tier = req.Storage.Tier
+	s.Encrypted = req.Storage.Encrypted
+	s.Labels = append([]upcloud.Label{}, req.Storage.Labels...)
+	f.startTransition(s, upcloud.StorageStateMaintenance)
+	return http.StatusCreated, map[string]any{"storage": newAPIStorage(s, true)}, nil
+}
+
+func (f *FakeService) apiGetStorageDetails(r *http.Request) (int, any, error) {
+	s, ok := f.storages[r.PathValue("uuid")]
+	if !ok {
+		return 0, nil, service.ErrStorageNotFound
+	}
+	return http.StatusOK, map[string]any{"storage": newAPIStorage(s, true)}, nil
+}
+
+func (f *FakeService) apiModifyStorage(r *http.Request) (int, any, error) {
+	var req struct {
+		Storage request.ModifyStorageRequest `json:"storage"`
+	}
+	if err := decodeAPIRequest(r, &req); err != nil {
+		return 0, nil, err
+	}
+	uuid := r.PathValue("uuid")
+	s, ok := f.storages[uuid]
+	if !ok {
+		return 0, nil, service.ErrStorageNotFound
+	}
+	if req.Storage.Size > 0 && req.Storage.Size != s.Size {
+		if _, err := f.resize(uuid, req.Storage.Size); err != nil {
+			return 0, nil, err
+		}
+		s.Size = req.Storage.Size
+	}
+	if req.Storage.Title != "" {
+		s.Title = req.Storage.Title
+	}
+	if req.Storage.Labels != nil {
+		s.Labels = append([]upcloud.Label{}, *req.Storage.Labels...)
+	}
+	return http.StatusOK, map[string]any{"storage": newAPIStorage(s, true)}, nil
+}
+
+func (f *FakeService) apiDeleteStorage(r *http.Request) (int, any, error) {
+	if err := f.deleteStorage(r.PathValue("uuid")); err != nil {
+		return 0, nil, err
+	}
+	return http.StatusNoContent, nil, nil
+}
+
+func (f *FakeService) apiCloneStorage(r *http.Request) (int, any, error) {
+	var req struct {
+		Storage request.CloneStorageRequest `json:"storage"`
+	}
+	if err := decodeAPIRequest(r, &req); err != nil {
+		return 0, nil, err
+	}
+	req.Storage.UUID = r.PathValue("uuid")
+	s, err := f.clone(&req.Storage)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusCreated, map[string]any{"storage": newAPIStorage(f.storages[s.UUID], true)}, nil
+}
+
+func (f *FakeService) apiCreateBackup(r *http.Request) (int, any, error) {
+	var req struct {
+		Storage request.CreateBackupRequest `json:"storage"`
+	}
+	if err := decodeAPIRequest(r, &req); err != nil {
+		return 0, nil, err
+	}
+	s, ok := f.storages[r.PathValue("uuid")]
+	if !ok {
+		return 0, nil, service.ErrStorageNotFound
+	}
+	b, err := f.createBackup(s, req.Storage.Title)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusCreated, map[string]any{"storage": newAPIStorage(f.storages[b.UUID], true)}, nil
+}
+
+func (f *FakeService) apiResizeStorageFilesystem(r *http.Request) (int, any, error) {
+	s, ok := f.storages[r.PathValue("uuid")]
+	if !ok {
+		return 0, nil, service.ErrStorageNotFound
+	}
+	if err := requireState(s, upcloud.StorageStateOnline); err != nil {
+		return 0, nil, err
+	}
+	if len(s.ServerUUIDs) > 0 {
+		return 0, nil, problem(http.StatusConflict, upcloud.ErrCodeStorageAttached, "filesystem can't be resized while storage is attached")
+	}
+	b := f.newBackup(s, fmt.Sprintf("Resize backup of %s", s.Title))
+	f.startTransition(s, upcloud.StorageStateMaintenance)
+	return http.StatusOK, map[string]any{"resize_backup": newAPIStorage(b, false)}, nil
+}
+
+// apiStorage is storage in the format used by the API.
+type apiStorage struct {
+	Access    string          `json:"access"`
+	Encrypted string          `json:"encrypted"`
+	Size      int             `json:"size"`
+	State     string          `json:"state"`
+	Tier      string          `json:"tier"`
+	Title     string          `json:"title"`
+	Type      string          `json:"type"`
+	UUID      string          `json:"uuid"`
+	Zone      string          `json:"zone"`
+	Origin    string          `json:"origin,omitempty"`
+	Created   time.Time       `json:"created"`
+	Labels    []upcloud.Label `json:"labels"`
+	Backups   *apiBackups     `json:"backups,omitempty"`
+	Servers   *apiServers     `json:"servers,omitempty"`
+}
+
+type apiBackups struct {
+	Backup []string `json:"backup"`
+}
+
+type apiServers struct {
+	Server []string `json:"server"`
+}
+
+func newAPIStorage(s *upcloud.StorageDetails, details bool) apiStorage {
+	r := apiStorage{
+		Access:    s.Access,
+		Encrypted: apiBoolean(s.Encrypted.Bool()),
+		Size:      s.Size,
+		State:     s.State,
+		Tier:      s.Tier,
+		Title:     s.Title,
+		Type:      s.Type,
+		UUID:      s.UUID,
+		Zone:      s.Zone,
+		Origin:    s.Origin,
+		Created:   s.Created,
+		Labels:    append([]upcloud.Label{}, s.Labels...),
+	}
+	if details {
+		r.Backups = &apiBackups{Backup: append([]string{}, s.BackupUUIDs...)}
+		r.Servers = &apiServers{Server: append([]string{}, s.ServerUUIDs...)}
+	}
+	return r
+}
+
+// apiServer is server in the format used by the API.
+type apiServer struct {
+	Hostname       string             `json:"hostname"`
+	State          string             `json:"state"`
+	Title          string             `json:"title"`
+	UUID           string             `json:"uuid"`
+	Zone           string             `json:"zone"`
+	StorageDevices *apiStorageDevices `json:"storage_devices,omitempty"`
+}
+
+type apiStorageDevices struct {
+	StorageDevice []apiStorageDevice `json:"storage_device"`
+}
+
+type apiStorageDevice struct {
+	Address   string `json:"address"`
+	Encrypted string `json:"storage_encrypted"`
+	UUID      string `json:"storage"`
+	Size      int    `json:"storage_size"`
+	Tier      string `json:"storage_tier"`
+	Title     string `json:"storage_title"`
+	Type      string `json:"type"`
+	BootDisk  string `json:"boot_disk"`
+}
+
+func newAPIServer(s *upcloud.ServerDetails, details bool) apiServer {
+	r := apiServer{
+		Hostname: s.Hostname,
+		State:    s.State,
+		Title:    s.Title,
+		UUID:     s.UUID,
+		Zone:     s.Zone,
+	}
+	if details {
+		r.StorageDevices = &apiStorageDevices{StorageDevice: make([]apiStorageDevice, 0, len(s.StorageDevices))}
+		for i, d := range s.StorageDevices {
+			bootDisk := "0"
+			if i == 0 {
+				bootDisk = "1"
+			}
+			r.StorageDevices.StorageDevice = append(r.StorageDevices.StorageDevice, apiStorageDevice{
+				Address:   d.Address,
+				Encrypted: apiBoolean(d.Encrypted.Bool()),
+				UUID:      d.UUID,
+				Size:      d.Size,
+				Tier:      d.Tier,
+				Title:     d.Title,
+				Type:      d.Type,
+				BootDisk:  bootDisk,
+			})
+		}
+	}
+	return r
+}
+
+func apiBoolean(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func decodeAPIRequest(r *http.Request, v any) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return &upcloud.Problem{Type: "INVALID_REQUEST", Title: err.Error(), Status: http.StatusBadRequest}
+	}
+	return nil
+}
+
+// writeAPIError writes error as JSON problem. Errors that are not API errors are converted to matching API errors.
+func writeAPIError(w http.ResponseWriter, err error) {
+	var prob *upcloud.Problem
+	switch {
+	case errors.As(err, &prob):
+	case errors.Is(err, service.ErrStorageNotFound):
+		prob = &upcloud.Problem{Type: upcloud.ErrCodeStorageNotFound, Title: err.Error(), Status: http.StatusNotFound}
+	case errors.Is(err, service.ErrServerNotFound):
+		prob = &upcloud.Problem{Type: upcloud.ErrCodeServerNotFound, Title: err.Error(), Status: http.StatusNotFound}
+	default:
+		prob = &upcloud.Problem{Type: "INTERNAL_ERROR", Title: err.Error(), Status: http.StatusInternalServerError}
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(prob.Status)
+	_ = json.NewEncoder(w).Encode(prob)
+}
@@ -0,0 +1,782 @@
+package mock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/UpCloudLtd/upcloud-csi/internal/service"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/request"
+	"github.com/google/uuid"
+)
+
+// defaultMaxStorageDevices is the default number of storage devices that can be attached to a server.
+const defaultMaxStorageDevices = 16
+
+// FakeService is a stateful in-memory implementation of service.Service. It models storages, backups, servers
+// and attachments the same way UpCloud API does: storages go through transitional states (maintenance, cloning,
+// backuping) before they are online, attachments are limited per server and storages can be attached only
+// to servers in the same zone.
+//
+// Faults and delays can be injected using Fault hook, InjectFault and TransitionDelay.
+type FakeService struct {
+	// TransitionDelay is how long storage stays in transitional state, e.g. maintenance after creation.
+	TransitionDelay time.Duration
+	// Quota contains account's storage limit per tier in gigabytes. Tiers without quota are unlimited.
+	Quota map[string]int
+	// Fault is called at the beginning of each operation with operation name (e.g. "AttachStorage").
+	// Error returned by the hook is returned by the operation.
+	Fault func(op string) error
+
+	mu                sync.Mutex
+	maxStorageDevices int
+	storages          map[string]*upcloud.StorageDetails
+	servers           map[string]*upcloud.ServerDetails
+	transitions       []transition
+	faults            map[string][]error
+}
+
+// transition changes storage state back to online when storage operation is finished.
+type transition struct {
+	uuid string
+	at   time.Time
+}
+
+func NewFakeService() *FakeService {
+	return &FakeService{
+		maxStorageDevices: defaultMaxStorageDevices,
+		Quota:             make(map[string]int),
+		storages:          make(map[string]*upcloud.StorageDetails),
+		servers:           make(map[string]*upcloud.ServerDetails),
+		faults:            make(map[string][]error),
+	}
+}
+
+// AddServer adds started server with root disk to the zone.
+func (f *FakeService) AddServer(hostname, zone string) *upcloud.ServerDetails {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := &upcloud.ServerDetails{
+		Server: upcloud.Server{
+			UUID:     "00" + uuid.NewString()[2:],
+			Hostname: hostname,
+			Zone:     zone,
+			State:    upcloud.ServerStateStarted,
+		},
+	}
+	root := f.newStorage(hostname+"-root", zone, 10, upcloud.StorageTypeDisk)
+	f.attach(root, s)
+	f.servers[s.UUID] = s
+	return copyServer(s)
+}
+
+// AddStorage adds online storage, e.g. storage created outside of the CSI driver.
+func (f *FakeService) AddStorage(title, zone string, size int) *upcloud.StorageDetails {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return copyStorage(f.newStorage(title, zone, size, upcloud.StorageTypeNormal))
+}
+
+// SetStorageState sets storage state, e.g. to simulate storage failure.
+func (f *FakeService) SetStorageState(uuid, state string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s, ok := f.storages[uuid]; ok {
+		s.State = state
+	}
+}
+
+// SetMaxStorageDevices sets the maximum number of storage devices attached to a server, root disk included.
+func (f *FakeService) SetMaxStorageDevices(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.maxStorageDevices = n
+}
+
+// InjectFault makes the next call of the operation fail with the error.
+func (f *FakeService) InjectFault(op string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults[op] = append(f.faults[op], err)
+}
+
+// Storages returns all storages including backups and server root disks.
+func (f *FakeService) Storages() []upcloud.StorageDetails {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.advance()
+	r := make([]upcloud.StorageDetails, 0, len(f.storages))
+	for _, s := range f.storages {
+		r = append(r, *copyStorage(s))
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].UUID < r[j].UUID })
+	return r
+}
+
+func (f *FakeService) GetServerByHostname(_ context.Context, hostname string) (*upcloud.ServerDetails, error) {
+	if err := f.fault("GetServerByHostname"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, s := range f.servers {
+		if s.Hostname == hostname {
+			return copyServer(s), nil
+		}
+	}
+	return nil, service.ErrServerNotFound
+}
+
+func (f *FakeService) GetServerByUUID(_ context.Context, uuid string) (*upcloud.ServerDetails, error) {
+	if err := f.fault("GetServerByUUID"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s, ok := f.servers[uuid]; ok {
+		return copyServer(s), nil
+	}
+	return nil, service.ErrServerNotFound
+}
+
+func (f *FakeService) GetStorageByUUID(_ context.Context, uuid string) (*upcloud.StorageDetails, error) {
+	if err := f.fault("GetStorageByUUID"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.advance()
+	if s, ok := f.storages[uuid]; ok {
+		return copyStorage(s), nil
+	}
+	return nil, service.ErrStorageNotFound
+}
+
+func (f *FakeService) GetStorageByName(_ context.Context, name string) ([]*upcloud.StorageDetails, error) {
+	if err := f.fault("GetStorageByName"); err != nil {
+		return nil, err
+	}
+	return f.find(func(s *upcloud.StorageDetails) bool {
+		return s.Title == name
+	}), nil
+}
+
+func (f *FakeService) ListStorage(_ context.Context, zone string) ([]upcloud.Storage, error) {
+	if err := f.fault("ListStorage"); err != nil {
+		return nil, err
+	}
+	return storageList(f.find(func(s *upcloud.StorageDetails) bool {
+		return s.Zone == zone && s.Type == upcloud.StorageTypeNormal
+	})), nil
+}
+
+func (f *FakeService) GetStorageBackupByName(_ context.Context, name string) (*upcloud.Storage, error) {
+	if err := f.fault("GetStorageBackupByName"); err != nil {
+		return nil, err
+	}
+	backups := f.find(func(s *upcloud.StorageDetails) bool {
+		return s.Title == name && s.Type == upcloud.StorageTypeBackup
+	})
+	if len(backups) == 0 {
+		return nil, service.ErrStorageNotFound
+	}
+	return &backups[0].Storage, nil
+}
+
+func (f *FakeService) ListStorageBackups(_ context.Context, uuid string) ([]upcloud.Storage, error) {
+	if err := f.fault("ListStorageBackups"); err != nil {
+		return nil, err
+	}
+	return storageList(f.find(func(s *upcloud.StorageDetails) bool {
+		return s.Type == upcloud.StorageTypeBackup && s.Origin != "" && (uuid == "" || s.Origin == uuid)
+	})), nil
+}
+
+func (f *FakeService) RequireStorageOnline(ctx context.Context, s *upcloud.Storage) error {
+	if err := f.fault("RequireStorageOnline"); err != nil {
+		return err
+	}
+	_, err := f.waitForStorageOnline(ctx, s.UUID)
+	return err
+}
+
+func (f *FakeService) CreateStorage(ctx context.Context, r *request.CreateStorageRequest) (*upcloud.StorageDetails, error) {
+	if err := f.fault("CreateStorage"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	if err := f.checkQuota(r.Tier, r.Size); err != nil {
+		f.mu.Unlock()
+		return nil, err
+	}
+	s := f.newStorage(r.Title, r.Zone, r.Size, upcloud.StorageTypeNormal)
+	s.Tier = r.Tier
+	s.Encrypted = r.Encrypted
+	s.Labels = append([]upcloud.Label{}, r.Labels...)
+	f.startTransition(s, upcloud.StorageStateMaintenance)
+	f.mu.Unlock()
+	return f.waitForStorageOnline(ctx, s.UUID)
+}
+
+func (f *FakeService) CloneStorage(ctx context.Context, r *request.CloneStorageRequest, labels ...upcloud.Label) (*upcloud.StorageDetails, error) {
+	if err := f.fault("CloneStorage"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	s, err := f.clone(r)
+	f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.waitForStorageOnline(ctx, s.UUID); err != nil {
+		return nil, err
+	}
+	if len(labels) > 0 {
+		return f.SetStorageLabels(ctx, s.UUID, labels)
+	}
+	return f.GetStorageByUUID(ctx, s.UUID)
+}
+
+func (f *FakeService) StartCloneStorage(_ context.Context, r *request.CloneStorageRequest) (*upcloud.StorageDetails, error) {
+	if err := f.fault("StartCloneStorage"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.clone(r)
+}
+
+func (f *FakeService) DeleteStorage(_ context.Context, uuid string) error {
+	if err := f.fault("DeleteStorage"); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.advance()
+	if s, ok := f.storages[uuid]; ok {
+		if err := requireIdle(s); err != nil {
+			return err
+		}
+	}
+	return f.deleteStorage(uuid)
+}
+
+func (f *FakeService) AttachStorage(_ context.Context, storageUUID, serverUUID string) error {
+	if err := f.fault("AttachStorage"); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.attachStorage(storageUUID, serverUUID)
+}
+
+func (f *FakeService) DetachStorage(_ context.Context, storageUUID, serverUUID string) error {
+	if err := f.fault("DetachStorage"); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.detachStorage(storageUUID, serverUUID)
+}
+
+func (f *FakeService) ResizeStorage(ctx context.Context, uuid string, newSize int, deleteBackup bool) (*upcloud.StorageDetails, error) {
+	if err := f.fault("ResizeStorage"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	s, err := f.resize(uuid, newSize)
+	if err != nil {
+		f.mu.Unlock()
+		return nil, err
+	}
+	if len(s.ServerUUIDs) > 0 {
+		f.mu.Unlock()
+		return nil, problem(http.StatusConflict, upcloud.ErrCodeStorageAttached, "filesystem can't be resized while storage is attached")
+	}
+	if !deleteBackup {
+		// filesystem resize takes backup of the storage before resizing
+		f.newBackup(s, fmt.Sprintf("Resize backup of %s", s.Title))
+	}
+	s.Size = newSize
+	f.startTransition(s, upcloud.StorageStateMaintenance)
+	f.mu.Unlock()
+	return f.waitForStorageOnline(ctx, uuid)
+}
+
+func (f *FakeService) ResizeBlockDevice(ctx context.Context, uuid string, newSize int) (*upcloud.StorageDetails, error) {
+	if err := f.fault("ResizeBlockDevice"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	s, err := f.resize(uuid, newSize)
+	if err != nil {
+		f.mu.Unlock()
+		return nil, err
+	}
+	s.Size = newSize
+	f.startTransition(s, upcloud.StorageStateMaintenance)
+	f.mu.Unlock()
+	return f.waitForStorageOnline(ctx, uuid)
+}
+
+func (f *FakeService) CreateStorageBackup(_ context.Context, uuid, title string) (*upcloud.StorageDetails, error) {
+	if err := f.fault("CreateStorageBackup"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.advance()
+	s, ok := f.storages[uuid]
+	if !ok {
+		return nil, service.ErrStorageNotFound
+	}
+	if s.State == upcloud.StorageStateBackuping {
+		return nil, service.ErrBackupInProgress
+	}
+	return f.createBackup(s, title)
+}
+
+func (f *FakeService) DeleteStorageBackup(_ context.Context, uuid string) error {
+	if err := f.fault("DeleteStorageBackup"); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.advance()
+	b, ok := f.storages[uuid]
+	if !ok {
+		return problem(http.StatusNotFound, upcloud.ErrCodeStorageNotFound, "storage not found")
+	}
+	if b.Type != upcloud.StorageTypeBackup {
+		return fmt.Errorf("unable to delete storage backup '%s' (%s) has invalid type '%s'", b.Title, b.UUID, b.Type)
+	}
+	if err := requireIdle(b); err != nil {
+		return err
+	}
+	delete(f.storages, uuid)
+	if origin, ok := f.storages[b.Origin]; ok {
+		origin.BackupUUIDs = removeString(origin.BackupUUIDs, uuid)
+	}
+	return nil
+}
+
+func (f *FakeService) GetAccount(_ context.Context) (*upcloud.Account, error) {
+	if err := f.fault("GetAccount"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &upcloud.Account{
+		UserName: "fake",
+		ResourceLimits: upcloud.ResourceLimits{
+			StorageMaxIOPS: f.quota(upcloud.StorageTierMaxIOPS),
+			StorageSSD:     f.quota(upcloud.StorageTierStandard),
+			StorageHDD:     f.quota(upcloud.StorageTierHDD),
+		},
+	}, nil
+}
+
+func (f *FakeService) GetStorageQuota(_ context.Context, tier string) (int, error) {
+	if err := f.fault("GetStorageQuota"); err != nil {
+		return 0, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	limit, ok := f.Quota[tier]
+	if !ok {
+		return 0, fmt.Errorf("unknown storage tier '%s'", tier)
+	}
+	if used := f.used(tier); used < limit {
+		return limit - used, nil
+	}
+	return 0, nil
+}
+
+func (f *FakeService) SetStorageLabels(_ context.Context, uuid string, labels []upcloud.Label) (*upcloud.StorageDetails, error) {
+	if err := f.fault("SetStorageLabels"); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.advance()
+	s, ok := f.storages[uuid]
+	if !ok {
+		return nil, service.ErrStorageNotFound
+	}
+	s.Labels = append([]upcloud.Label{}, labels...)
+	return copyStorage(s), nil
+}
+
+func (f *FakeService) fault(op string) error {
+	f.mu.Lock()
+	if errs := f.faults[op]; len(errs) > 0 {
+		f.faults[op] = errs[1:]
+		f.mu.Unlock()
+		return errs[0]
+	}
+	f.mu.Unlock()
+	if f.Fault != nil {
+		return f.Fault(op)
+	}
+	return nil
+}
+
+func (f *FakeService) find(match func(*upcloud.StorageDetails) bool) []*upcloud.StorageDetails {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.advance()
+	r := make([]*upcloud.StorageDetails, 0)
+	for _, s := range f.storages {
+		if match(s) {
+			r = append(r, copyStorage(s))
+		}
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].UUID < r[j].UUID })
+	return r
+}
+
+// clone starts cloning storage. Caller must hold the lock.
+func (f *FakeService) clone(r *request.CloneStorageRequest) (*upcloud.StorageDetails, error) {
+	f.advance()
+	src, ok := f.storages[r.UUID]
+	if !ok {
+		return nil, service.ErrStorageNotFound
+	}
+	if err := requireState(src, upcloud.StorageStateOnline); err != nil {
+		return nil, err
+	}
+	tier := r.Tier
+	if tier == "" {
+		tier = src.Tier
+	}
+	if err := f.checkQuota(tier, src.Size); err != nil {
+		return nil, err
+	}
+	zone := r.Zone
+	if zone == "" {
+		zone = src.Zone
+	}
+	s := f.newStorage(r.Title, zone, src.Size, upcloud.StorageTypeNormal)
+	s.Tier = tier
+	// clone of encrypted storage is always encrypted
+	s.Encrypted = upcloud.FromBool(src.Encrypted.Bool() || r.Encrypted.Bool())
+	f.startTransition(s, upcloud.StorageStateMaintenance)
+	if src.Type == upcloud.StorageTypeNormal {
+		f.startTransition(src, upcloud.StorageStateCloning)
+	}
+	return copyStorage(s), nil
+}
+
+// deleteStorage deletes storage or backup. Caller must hold the lock.
+func (f *FakeService) deleteStorage(uuid string) error {
+	f.advance()
+	s, ok := f.storages[uuid]
+	if !ok {
+		return service.ErrStorageNotFound
+	}
+	if len(s.ServerUUIDs) > 0 {
+		return problem(http.StatusConflict, upcloud.ErrCodeStorageAttached, "storage is attached to a server")
+	}
+	if err := requireState(s, upcloud.StorageStateOnline, upcloud.StorageStateError); err != nil {
+		return err
+	}
+	delete(f.storages, uuid)
+	if origin, ok := f.storages[s.Origin]; ok {
+		origin.BackupUUIDs = removeString(origin.BackupUUIDs, uuid)
+	}
+	return nil
+}
+
+// attachStorage validates attach request and attaches storage to the server. Caller must hold the lock.
+func (f *FakeService) attachStorage(storageUUID, serverUUID string) error {
+	f.advance()
+	s, ok := f.storages[storageUUID]
+	if !ok {
+		return service.ErrStorageNotFound
+	}
+	server, ok := f.servers[serverUUID]
+	if !ok {
+		return problem(http.StatusNotFound, upcloud.ErrCodeServerNotFound, "server not found")
+	}
+	if server.State != upcloud.ServerStateStarted {
+		return problem(http.StatusConflict, upcloud.ErrCodeServerStateIllegal, "server is in state "+server.State)
+	}
+	if err := requireState(s, upcloud.StorageStateOnline); err != nil {
+		return err
+	}
+	if len(s.ServerUUIDs) > 0 {
+		return problem(http.StatusConflict, upcloud.ErrCodeStorageAttached, "storage is already attached to a server")
+	}
+	if s.Zone != server.Zone {
+		return problem(http.StatusBadRequest, upcloud.ErrCodeStorageDeviceInvalid, "storage and server are in different zones")
+	}
+	if len(server.StorageDevices) >= f.maxStorageDevices {
+		return problem(http.StatusBadRequest, upcloud.ErrCodeStorageDeviceLimitReached, "storage device limit reached")
+	}
+	f.attach(s, server)
+	return nil
+}
+
+// detachStorage detaches storage from the server. Caller must hold the lock.
+func (f *FakeService) detachStorage(storageUUID, serverUUID string) error {
+	server, ok := f.servers[serverUUID]
+	if !ok {
+		return problem(http.StatusNotFound, upcloud.ErrCodeServerNotFound, "server not found")
+	}
+	for i, d := range server.StorageDevices {
+		if d.UUID != storageUUID {
+			continue
+		}
+		server.StorageDevices = append(server.StorageDevices[:i], server.StorageDevices[i+1:]...)
+		if s, ok := f.storages[storageUUID]; ok {
+			s.ServerUUIDs = removeString(s.ServerUUIDs, serverUUID)
+		}
+		return nil
+	}
+	return service.ErrServerStorageNotFound
+}
+
+// createBackup starts creating backup of the storage. Caller must hold the lock.
+func (f *FakeService) createBackup(s *upcloud.StorageDetails, title string) (*upcloud.StorageDetails, error) {
+	if err := requireState(s, upcloud.StorageStateOnline); err != nil {
+		return nil, err
+	}
+	b := f.newBackup(s, title)
+	f.startTransition(b, upcloud.StorageStateMaintenance)
+	f.startTransition(s, upcloud.StorageStateBackuping)
+	return copyStorage(b), nil
+}
+
+// resize validates storage resize request. Caller must hold the lock.
+func (f *FakeService) resize(uuid string, newSize int) (*upcloud.StorageDetails, error) {
+	f.advance()
+	s, ok := f.storages[uuid]
+	if !ok {
+		return nil, service.ErrStorageNotFound
+	}
+	if err := requireState(s, upcloud.StorageStateOnline); err != nil {
+		return nil, err
+	}
+	if newSize < s.Size {
+		return nil, problem(http.StatusBadRequest, upcloud.ErrCodeSizeInvalid, "storage size can't be decreased")
+	}
+	if err := f.checkQuota(s.Tier, newSize-s.Size); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// waitForStorageOnline blocks until the storage is online the same way service waits for storage state.
+func (f *FakeService) waitForStorageOnline(ctx context.Context, uuid string) (*upcloud.StorageDetails, error) {
+	for {
+		f.mu.Lock()
+		f.advance()
+		s, ok := f.storages[uuid]
+		if !ok {
+			f.mu.Unlock()
+			return nil, service.ErrStorageNotFound
+		}
+		if s.State == upcloud.StorageStateOnline {
+			defer f.mu.Unlock()
+			return copyStorage(s), nil
+		}
+		if s.State == upcloud.StorageStateError {
+			f.mu.Unlock()
+			return nil, fmt.Errorf("storage %s is in state %s", uuid, s.State)
+		}
+		wait := f.nextTransition(uuid)
+		f.mu.Unlock()
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// startTransition sets storage to transitional state which ends after TransitionDelay. Caller must hold the lock.
+func (f *FakeService) startTransition(s *upcloud.StorageDetails, state string) {
+	s.State = state
+	f.transitions = append(f.transitions, transition{uuid: s.UUID, at: time.Now().Add(f.TransitionDelay)})
+}
+
+// advance finishes transitions that are due. Caller must hold the lock.
+func (f *FakeService) advance() {
+	now := time.Now()
+	pending := make([]transition, 0, len(f.transitions))
+	due := make([]transition, 0)
+	for _, t := range f.transitions {
+		if t.at.After(now) {
+			pending = append(pending, t)
+		} else {
+			due = append(due, t)
+		}
+	}
+	f.transitions = pending
+	for _, t := range due {
+		if s, ok := f.storages[t.uuid]; ok && s.State != upcloud.StorageStateError && !f.inTransition(t.uuid) {
+			s.State = upcloud.StorageStateOnline
+		}
+	}
+}
+
+func (f *FakeService) inTransition(uuid string) bool {
+	for _, t := range f.transitions {
+		if t.uuid == uuid {
+			return true
+		}
+	}
+	return false
+}
+
+// nextTransition returns time until storage's next transition. Caller must hold the lock.
+func (f *FakeService) nextTransition(uuid string) time.Duration {
+	wait := time.Millisecond
+	for _, t := range f.transitions {
+		if d := time.Until(t.at); t.uuid == uuid && d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// newStorage adds online storage. Caller must hold the lock.
+func (f *FakeService) newStorage(title, zone string, size int, storageType string) *upcloud.StorageDetails {
+	s := &upcloud.StorageDetails{
+		Storage: upcloud.Storage{
+			UUID:    "01" + uuid.NewString()[2:],
+			Title:   title,
+			Zone:    zone,
+			Size:    size,
+			Type:    storageType,
+			Tier:    upcloud.StorageTierMaxIOPS,
+			Access:  upcloud.StorageAccessPrivate,
+			State:   upcloud.StorageStateOnline,
+			Created: time.Now(),
+		},
+		ServerUUIDs: make(upcloud.ServerUUIDSlice, 0),
+		BackupUUIDs: make(upcloud.BackupUUIDSlice, 0),
+	}
+	f.storages[s.UUID] = s
+	return s
+}
+
+// newBackup adds online backup of the storage. Caller must hold the lock.
+func (f *FakeService) newBackup(s *upcloud.StorageDetails, title string) *upcloud.StorageDetails {
+	b := f.newStorage(title, s.Zone, s.Size, upcloud.StorageTypeBackup)
+	b.Origin = s.UUID
+	b.Tier = s.Tier
+	b.Encrypted = s.Encrypted
+	s.BackupUUIDs = append(s.BackupUUIDs, b.UUID)
+	return b
+}
+
+// attach attaches storage to the server using the first free device address. Caller must hold the lock.
+func (f *FakeService) attach(s *upcloud.StorageDetails, server *upcloud.ServerDetails) {
+	address := ""
+	for i := 0; address == ""; i++ {
+		address = fmt.Sprintf("virtio:%d", i)
+		for _, d := range server.StorageDevices {
+			if d.Address == address {
+				address = ""
+				break
+			}
+		}
+	}
+	server.StorageDevices = append(server.StorageDevices, upcloud.ServerStorageDevice{
+		Address: address,
+		UUID:    s.UUID,
+		Size:    s.Size,
+		Title:   s.Title,
+		Type:    upcloud.StorageTypeDisk,
+	})
+	s.ServerUUIDs = append(s.ServerUUIDs, server.UUID)
+}
+
+// checkQuota checks that storage of the size fits into the quota. Caller must hold the lock.
+func (f *FakeService) checkQuota(tier string, size int) error {
+	limit, ok := f.Quota[tier]
+	if !ok || f.used(tier)+size <= limit {
+		return nil
+	}
+	if tier == upcloud.StorageTierMaxIOPS {
+		return problem(http.StatusConflict, upcloud.ErrCodeMaxiOpsStorageLimitReached, "storage limit reached")
+	}
+	return problem(http.StatusConflict, fmt.Sprintf("%s_STORAGE_LIMIT_REACHED", tier), "storage limit reached")
+}
+
+func (f *FakeService) used(tier string) int {
+	used := 0
+	for _, s := range f.storages {
+		if s.Tier == tier && s.Type != upcloud.StorageTypeBackup {
+			used += s.Size
+		}
+	}
+	return used
+}
+
+func requireState(s *upcloud.StorageDetails, states ...string) error {
+	for _, state := range states {
+		if s.State == state {
+			return nil
+		}
+	}
+	return problem(http.StatusConflict, upcloud.ErrCodeStorageStateIllegal, "storage is in state "+s.State)
+}
+
+// requireIdle returns service.ErrStorageBusy if storage is in transitional state, the same way service does before
+// deleting storage.
+func requireIdle(s *upcloud.StorageDetails) error {
+	if s.State == upcloud.StorageStateOnline || s.State == upcloud.StorageStateError {
+		return nil
+	}
+	return fmt.Errorf("%w: storage %s is in state %s", service.ErrStorageBusy, s.UUID, s.State)
+}
+
+func problem(status int, code, title string) error {
+	return &upcloud.Problem{Type: code, Title: title, Status: status}
+}
+
+func copyStorage(s *upcloud.StorageDetails) *upcloud.StorageDetails {
+	c := *s
+	c.Labels = append([]upcloud.Label(nil), s.Labels...)
+	c.ServerUUIDs = append(upcloud.ServerUUIDSlice{}, s.ServerUUIDs...)
+	c.BackupUUIDs = append(upcloud.BackupUUIDSlice{}, s.BackupUUIDs...)
+	return &c
+}
+
+func copyServer(s *upcloud.ServerDetails) *upcloud.ServerDetails {
+	c := *s
+	c.StorageDevices = append(upcloud.ServerStorageDeviceSlice{}, s.StorageDevices...)
+	return &c
+}
+
+func storageList(storages []*upcloud.StorageDetails) []upcloud.Storage {
+	r := make([]upcloud.Storage, 0, len(storages))
+	for _, s := range storages {
+		r = append(r, s.Storage)
+	}
+	return r
+}
+
+func removeString[T ~[]string](s T, v string) T {
+	r := make(T, 0, len(s))
+	for _, i := range s {
+		if i != v {
+			r = append(r, i)
+		}
+	}
+	return r
+}
+
+var _ service.Service = (*FakeService)(nil)
+
+// ErrFault can be used as injected error when the error itself doesn't matter.
+var ErrFault = errors.New("injected fault")
@@ -15,6 +15,22 @@ type UpCloudServiceMock struct {
 	CloneStorageSize int
 	StorageSize      int
 	StorageBackingUp bool
+	BackupNotFound   bool
+	StorageState     string
+	ServerUUIDs      []string
+	ServerNotFound   bool
+	StorageQuota     int
+	StorageTier      string
+	StorageLabels    []upcloud.Label
+	StorageZone      string
+	ServerZone       string
+
+	// DetachedServerUUIDs contains UUIDs of the servers that storage was detached from.
+	DetachedServerUUIDs []string
+	// DeletedStorageUUIDs contains UUIDs of the deleted storages.
+	DeletedStorageUUIDs []string
+	// ResizedStorageSize is the size of the last storage resize.
+	ResizedStorageSize int
 
 	SourceVolumeID string
 }
@@ -43,8 +59,14 @@ func (m *UpCloudServiceMock) GetStorageByUUID(ctx context.Context, storageUUID s
 	}
 
 	s := &upcloud.StorageDetails{
-		Storage: *newMockStorage(m.StorageSize),
+		Storage:     *newMockStorage(m.StorageSize),
+		ServerUUIDs: m.ServerUUIDs,
 	}
+	s.UUID = storageUUID
+	s.State = m.StorageState
+	s.Tier = m.StorageTier
+	s.Labels = m.StorageLabels
+	s.Zone = m.StorageZone
 	return s, nil
 }
 
@@ -53,9 +75,12 @@ func (m *UpCloudServiceMock) GetStorageByName(ctx context.Context, storageName s
 		return nil, nil
 	}
 
+	storage := newMockStorage(m.StorageSize, m.StorageLabels...)
+	storage.State = m.StorageState
+	storage.Zone = m.StorageZone
 	s := []*upcloud.StorageDetails{
 		{
-			Storage: *newMockStorage(m.StorageSize),
+			Storage: *storage,
 		},
 	}
 	return s, nil
@@ -65,6 +90,7 @@ func (m *UpCloudServiceMock) CreateStorage(ctx context.Context, csr *request.Cre
 	id, _ := uuid.NewUUID()
 	storage := newMockStorage(m.StorageSize)
 	storage.Encrypted = csr.Encrypted
+	storage.Zone = csr.Zone
 	s := &upcloud.StorageDetails{
 		Storage:     *storage,
 		ServerUUIDs: upcloud.ServerUUIDSlice{id.String()}, // TODO change UUID prefix
@@ -77,6 +103,7 @@ func (m *UpCloudServiceMock) CloneStorage(ctx context.Context, csr *request.Clon
 	id, _ := uuid.NewUUID()
 	storage := newMockStorage(m.CloneStorageSize, label...)
 	storage.Encrypted = csr.Encrypted
+	storage.Zone = csr.Zone
 	s := &upcloud.StorageDetails{
 		Storage:     *storage,
 		ServerUUIDs: upcloud.ServerUUIDSlice{id.String()}, // TODO change UUID prefix
@@ -85,7 +112,20 @@ func (m *UpCloudServiceMock) CloneStorage(ctx context.Context, csr *request.Clon
 	return s, nil
 }
 
+func (m *UpCloudServiceMock) StartCloneStorage(ctx context.Context, csr *request.CloneStorageRequest) (*upcloud.StorageDetails, error) {
+	storage := newMockStorage(m.CloneStorageSize)
+	storage.Encrypted = csr.Encrypted
+	storage.Zone = csr.Zone
+	storage.Title = csr.Title
+	storage.State = upcloud.StorageStateMaintenance
+	return &upcloud.StorageDetails{Storage: *storage}, nil
+}
+
 func (m *UpCloudServiceMock) DeleteStorage(ctx context.Context, storageUUID string) error {
+	if m.StorageBackingUp {
+		return service.ErrStorageBusy
+	}
+	m.DeletedStorageUUIDs = append(m.DeletedStorageUUIDs, storageUUID)
 	return nil
 }
 
@@ -94,6 +134,7 @@ func (m *UpCloudServiceMock) AttachStorage(ctx context.Context, storageUUID, ser
 }
 
 func (m *UpCloudServiceMock) DetachStorage(ctx context.Context, storageUUID, serverUUID string) error {
+	m.DetachedServerUUIDs = append(m.DetachedServerUUIDs, serverUUID)
 	return nil
 }
 
@@ -109,11 +150,25 @@ func (m *UpCloudServiceMock) GetServerByHostname(ctx context.Context, hostname s
 	return &upcloud.ServerDetails{
 		Server: upcloud.Server{
 			UUID: id.String(),
+			Zone: m.ServerZone,
+		},
+	}, nil
+}
+
+func (m *UpCloudServiceMock) GetServerByUUID(ctx context.Context, uuid string) (*upcloud.ServerDetails, error) {
+	if m.ServerNotFound {
+		return nil, service.ErrServerNotFound
+	}
+	return &upcloud.ServerDetails{
+		Server: upcloud.Server{
+			UUID:     uuid,
+			Hostname: "node-" + uuid,
 		},
 	}, nil
 }
 
 func (m *UpCloudServiceMock) ResizeStorage(ctx context.Context, _ string, newSize int, deleteBackup bool) (*upcloud.StorageDetails, error) {
+	m.ResizedStorageSize = newSize
 	id, _ := uuid.NewUUID()
 	return &upcloud.StorageDetails{Storage: upcloud.Storage{UUID: id.String(), Size: newSize}}, nil
 }
@@ -144,12 +199,15 @@ func (m *UpCloudServiceMock) ListStorageBackups(ctx context.Context, uuid string
 }
 
 func (m *UpCloudServiceMock) DeleteStorageBackup(ctx context.Context, uuid string) error {
+	if m.StorageBackingUp {
+		return service.ErrStorageBusy
+	}
 	return nil
 }
 
 func (m *UpCloudServiceMock) GetStorageBackupByName(ctx context.Context, name string) (*upcloud.Storage, error) {
 	var s *upcloud.Storage
-	if !m.VolumeUUIDExists || name == "" {
+	if !m.VolumeUUIDExists || m.BackupNotFound || name == "" {
 		return nil, service.ErrStorageNotFound
 	}
 	s = newMockBackupStorage(newMockStorage(m.StorageSize))
@@ -163,3 +221,18 @@ func (m *UpCloudServiceMock) GetStorageBackupByName(ctx context.Context, name st
 func (m *UpCloudServiceMock) RequireStorageOnline(ctx context.Context, s *upcloud.Storage) error {
 	return nil
 }
+
+func (m *UpCloudServiceMock) GetAccount(ctx context.Context) (*upcloud.Account, error) {
+	return &upcloud.Account{UserName: "test"}, nil
+}
+
+func (m *UpCloudServiceMock) GetStorageQuota(ctx context.Context, tier string) (int, error) {
+	return m.StorageQuota, nil
+}
+
+func (m *UpCloudServiceMock) SetStorageLabels(ctx context.Context, uuid string, labels []upcloud.Label) (*upcloud.StorageDetails, error) {
+	m.StorageLabels = labels
+	s := newMockStorage(m.StorageSize, labels...)
+	s.UUID = uuid
+	return &upcloud.StorageDetails{Storage: *s}, nil
+}
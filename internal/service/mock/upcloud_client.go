@@ -30,13 +30,6 @@ func (u *UpCloudClient) getServer(id string) *upcloud.ServerDetails {
 	return nil
 }
 
-func (u *UpCloudClient) WaitForServerState(ctx context.Context, r *request.WaitForServerStateRequest) (*upcloud.ServerDetails, error) {
-	s, _ := u.GetServerDetails(ctx, &request.GetServerDetailsRequest{
-		UUID: r.UUID,
-	})
-	return s, nil
-}
-
 func (u *UpCloudClient) GetServers(ctx context.Context) (*upcloud.Servers, error) {
 	s := []upcloud.Server{}
 	u.servers.Range(func(key, value any) bool {
@@ -55,6 +48,16 @@ func (u *UpCloudClient) GetServerDetails(ctx context.Context, r *request.GetServ
 	return nil, fmt.Errorf("server '%s' not found", r.UUID)
 }
 
+func (u *UpCloudClient) GetAccount(ctx context.Context) (*upcloud.Account, error) {
+	return &upcloud.Account{
+		ResourceLimits: upcloud.ResourceLimits{
+			StorageHDD:     10240,
+			StorageMaxIOPS: 10240,
+			StorageSSD:     10240,
+		},
+	}, nil
+}
+
 func (u *UpCloudClient) AttachStorage(ctx context.Context, r *request.AttachStorageRequest) (*upcloud.ServerDetails, error) {
 	server := u.getServer(r.ServerUUID)
 	if server == nil {
@@ -0,0 +1,231 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/request"
+	"golang.org/x/time/rate"
+)
+
+// RetryPolicy defines how failed UpCloud API calls are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts per call including the first one.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry. Delay is doubled after each attempt.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between attempts.
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy is used when retries are enabled without explicit policy.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    30 * time.Second,
+}
+
+// transientErrorCodes are API error codes of requests that were rejected because the target was temporarily busy,
+// e.g. server is in maintenance state while another storage is being attached.
+var transientErrorCodes = map[string]struct{}{
+	upcloud.ErrCodeServerStateIllegal:  {},
+	upcloud.ErrCodeStorageStateIllegal: {},
+}
+
+// retryClient wraps UpCloud API client with rate limiter that is shared by all the calls and retries calls that
+// failed with a transient error.
+//
+// Calls are divided into three groups:
+//   - idempotent calls (reads and modifications that set absolute values) are retried on all transient errors.
+//   - calls that create new storage are retried only after it's checked that storage with the same title doesn't exist.
+//   - other calls are retried only if API rejected the request (rate limited or target busy), because it's not known
+//     whether the request was executed when request fails with server error.
+type retryClient struct {
+	client  upCloudClient
+	policy  RetryPolicy
+	limiter *rate.Limiter
+}
+
+func newRetryClient(client upCloudClient, policy RetryPolicy, limiter *rate.Limiter) *retryClient {
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+	if limiter == nil {
+		limiter = rate.NewLimiter(rate.Inf, 0)
+	}
+	return &retryClient{client: client, policy: policy, limiter: limiter}
+}
+
+type callKind int
+
+const (
+	callIdempotent callKind = iota
+	callCreate
+	callUnsafe
+)
+
+// do calls fn until it succeeds, fails with an error that can't be retried or until attempts are exhausted.
+// Calls of kind callCreate are retried only if exists reports that the storage wasn't created.
+func do[T any](ctx context.Context, c *retryClient, kind callKind, fn func() (T, error), exists func() (T, bool, error)) (T, error) {
+	var res T
+	var err error
+	for attempt := 0; attempt < c.policy.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			if err := sleep(ctx, c.backoff(attempt)); err != nil {
+				return res, err
+			}
+			if kind == callCreate && exists != nil {
+				found, ok, existsErr := exists()
+				if existsErr != nil {
+					// storage might have been created, so return the original error instead of retrying
+					return res, err
+				}
+				if ok {
+					return found, nil
+				}
+			}
+		}
+		if err := c.limiter.Wait(ctx); err != nil {
+			return res, err
+		}
+		res, err = fn()
+		if err == nil || !isRetryable(err, kind) {
+			return res, err
+		}
+	}
+	return res, err
+}
+
+// backoff returns exponential backoff delay with full jitter.
+func (c *retryClient) backoff(attempt int) time.Duration {
+	d := c.policy.BaseDelay << (attempt - 1)
+	if d <= 0 || d > c.policy.MaxDelay {
+		d = c.policy.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)) + 1) //nolint:gosec // jitter doesn't need secure random numbers.
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// isRetryable checks if call of the kind can be retried after the error.
+func isRetryable(err error, kind callKind) bool {
+	var problem *upcloud.Problem
+	if errors.As(err, &problem) {
+		if problem.Status == http.StatusTooManyRequests {
+			return true
+		}
+		if _, ok := transientErrorCodes[problem.ErrorCode()]; ok {
+			return true
+		}
+		return kind != callUnsafe && problem.Status >= http.StatusInternalServerError
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	return kind != callUnsafe && errors.As(err, &netErr)
+}
+
+// storageByTitle returns details of the storage with the title, if it exists.
+func (c *retryClient) storageByTitle(ctx context.Context, title string, match func(upcloud.Storage) bool) (*upcloud.StorageDetails, bool, error) {
+	storages, err := do(ctx, c, callIdempotent, func() (*upcloud.Storages, error) {
+		return c.client.GetStorages(ctx, &request.GetStoragesRequest{Access: upcloud.StorageAccessPrivate})
+	}, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, s := range storages.Storages {
+		if s.Title == title && match(s) {
+			details, err := c.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: s.UUID})
+			return details, err == nil, err
+		}
+	}
+	return nil, false, nil
+}
+
+func (c *retryClient) GetStorages(ctx context.Context, r *request.GetStoragesRequest) (*upcloud.Storages, error) {
+	return do(ctx, c, callIdempotent, func() (*upcloud.Storages, error) { return c.client.GetStorages(ctx, r) }, nil)
+}
+
+func (c *retryClient) GetStorageDetails(ctx context.Context, r *request.GetStorageDetailsRequest) (*upcloud.StorageDetails, error) {
+	return do(ctx, c, callIdempotent, func() (*upcloud.StorageDetails, error) { return c.client.GetStorageDetails(ctx, r) }, nil)
+}
+
+func (c *retryClient) CreateStorage(ctx context.Context, r *request.CreateStorageRequest) (*upcloud.StorageDetails, error) {
+	return do(ctx, c, callCreate, func() (*upcloud.StorageDetails, error) { return c.client.CreateStorage(ctx, r) },
+		func() (*upcloud.StorageDetails, bool, error) {
+			return c.storageByTitle(ctx, r.Title, func(s upcloud.Storage) bool {
+				return s.Type == upcloud.StorageTypeNormal && s.Zone == r.Zone
+			})
+		})
+}
+
+func (c *retryClient) ModifyStorage(ctx context.Context, r *request.ModifyStorageRequest) (*upcloud.StorageDetails, error) {
+	return do(ctx, c, callIdempotent, func() (*upcloud.StorageDetails, error) { return c.client.ModifyStorage(ctx, r) }, nil)
+}
+
+func (c *retryClient) AttachStorage(ctx context.Context, r *request.AttachStorageRequest) (*upcloud.ServerDetails, error) {
+	return do(ctx, c, callUnsafe, func() (*upcloud.ServerDetails, error) { return c.client.AttachStorage(ctx, r) }, nil)
+}
+
+func (c *retryClient) DetachStorage(ctx context.Context, r *request.DetachStorageRequest) (*upcloud.ServerDetails, error) {
+	return do(ctx, c, callUnsafe, func() (*upcloud.ServerDetails, error) { return c.client.DetachStorage(ctx, r) }, nil)
+}
+
+func (c *retryClient) CloneStorage(ctx context.Context, r *request.CloneStorageRequest) (*upcloud.StorageDetails, error) {
+	return do(ctx, c, callCreate, func() (*upcloud.StorageDetails, error) { return c.client.CloneStorage(ctx, r) },
+		func() (*upcloud.StorageDetails, bool, error) {
+			return c.storageByTitle(ctx, r.Title, func(s upcloud.Storage) bool {
+				return s.Type == upcloud.StorageTypeNormal && (r.Zone == "" || s.Zone == r.Zone)
+			})
+		})
+}
+
+func (c *retryClient) CreateBackup(ctx context.Context, r *request.CreateBackupRequest) (*upcloud.StorageDetails, error) {
+	return do(ctx, c, callCreate, func() (*upcloud.StorageDetails, error) { return c.client.CreateBackup(ctx, r) },
+		func() (*upcloud.StorageDetails, bool, error) {
+			return c.storageByTitle(ctx, r.Title, func(s upcloud.Storage) bool {
+				return s.Type == upcloud.StorageTypeBackup && s.Origin == r.UUID
+			})
+		})
+}
+
+func (c *retryClient) DeleteStorage(ctx context.Context, r *request.DeleteStorageRequest) error {
+	_, err := do(ctx, c, callUnsafe, func() (struct{}, error) { return struct{}{}, c.client.DeleteStorage(ctx, r) }, nil)
+	return err
+}
+
+func (c *retryClient) ResizeStorageFilesystem(ctx context.Context, r *request.ResizeStorageFilesystemRequest) (*upcloud.ResizeStorageFilesystemBackup, error) {
+	return do(ctx, c, callUnsafe, func() (*upcloud.ResizeStorageFilesystemBackup, error) {
+		return c.client.ResizeStorageFilesystem(ctx, r)
+	}, nil)
+}
+
+func (c *retryClient) GetServers(ctx context.Context) (*upcloud.Servers, error) {
+	return do(ctx, c, callIdempotent, func() (*upcloud.Servers, error) { return c.client.GetServers(ctx) }, nil)
+}
+
+func (c *retryClient) GetServerDetails(ctx context.Context, r *request.GetServerDetailsRequest) (*upcloud.ServerDetails, error) {
+	return do(ctx, c, callIdempotent, func() (*upcloud.ServerDetails, error) { return c.client.GetServerDetails(ctx, r) }, nil)
+}
+
+func (c *retryClient) GetAccount(ctx context.Context) (*upcloud.Account, error) {
+	return do(ctx, c, callIdempotent, func() (*upcloud.Account, error) { return c.client.GetAccount(ctx) }, nil)
+}
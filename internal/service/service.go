@@ -13,10 +13,12 @@ var (
 	ErrServerNotFound        = errors.New("upcloud: server not found")
 	ErrServerStorageNotFound = errors.New("upcloud: server storage not found")
 	ErrBackupInProgress      = errors.New("upcloud: cannot take snapshot while storage is in state backup")
+	ErrStorageBusy           = errors.New("upcloud: storage operation is in progress")
 )
 
 type Service interface { //nolint:interfacebloat // Split this to smaller piece when it makes sense code wise
 	GetServerByHostname(context.Context, string) (*upcloud.ServerDetails, error)
+	GetServerByUUID(context.Context, string) (*upcloud.ServerDetails, error)
 	GetStorageByUUID(context.Context, string) (*upcloud.StorageDetails, error)
 	GetStorageByName(context.Context, string) ([]*upcloud.StorageDetails, error)
 	ListStorage(context.Context, string) ([]upcloud.Storage, error)
@@ -25,6 +27,7 @@ type Service interface { //nolint:interfacebloat // Split this to smaller piece
 	RequireStorageOnline(ctx context.Context, s *upcloud.Storage) error
 	CreateStorage(context.Context, *request.CreateStorageRequest) (*upcloud.StorageDetails, error)
 	CloneStorage(context.Context, *request.CloneStorageRequest, ...upcloud.Label) (*upcloud.StorageDetails, error)
+	StartCloneStorage(context.Context, *request.CloneStorageRequest) (*upcloud.StorageDetails, error)
 	DeleteStorage(context.Context, string) error
 	AttachStorage(context.Context, string, string) error
 	DetachStorage(context.Context, string, string) error
@@ -32,4 +35,7 @@ type Service interface { //nolint:interfacebloat // Split this to smaller piece
 	ResizeBlockDevice(ctx context.Context, uuid string, newSize int) (*upcloud.StorageDetails, error)
 	CreateStorageBackup(ctx context.Context, uuid, title string) (*upcloud.StorageDetails, error)
 	DeleteStorageBackup(ctx context.Context, uuid string) error
+	GetAccount(ctx context.Context) (*upcloud.Account, error)
+	GetStorageQuota(ctx context.Context, tier string) (int, error)
+	SetStorageLabels(ctx context.Context, uuid string, labels []upcloud.Label) (*upcloud.StorageDetails, error)
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -17,6 +18,11 @@ import (
 	upsvc "github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/service"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func TestUpCloudService_ListStorage(t *testing.T) {
@@ -174,6 +180,251 @@ func TestUpCloudService_ListStorageBackups(t *testing.T) {
 	assert.Len(t, storages, 3)
 }
 
+func TestUpCloudService_GetStorageQuota(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/account") {
+			fmt.Fprint(w, `
+			{
+				"account": {
+					"credits": 10000,
+					"username": "test",
+					"resource_limits": {
+						"storage_hdd": 1000,
+						"storage_maxiops": 500,
+						"storage_ssd": 100
+					}
+				}
+			}
+			`)
+			return
+		}
+		fmt.Fprint(w, `
+		{
+			"storages" : {
+			   "storage" : [
+					{
+						"size": 100,
+						"tier": "maxiops",
+						"type": "normal",
+						"uuid": "id1",
+						"zone": "fi-hel2"
+					},
+					{
+						"size": 50,
+						"tier": "maxiops",
+						"type": "normal",
+						"uuid": "id2",
+						"zone": "fi-hel1"
+					},
+					{
+						"size": 100,
+						"tier": "maxiops",
+						"type": "backup",
+						"uuid": "id3",
+						"zone": "fi-hel2"
+					},
+					{
+						"size": 200,
+						"tier": "hdd",
+						"type": "normal",
+						"uuid": "id4",
+						"zone": "fi-hel2"
+					}
+			   ]
+			}
+		 }
+		`)
+	}))
+	defer srv.Close()
+
+	c := service.NewUpCloudService(upsvc.New(client.New("", "", client.WithBaseURL(srv.URL))))
+	quota, err := c.GetStorageQuota(context.Background(), upcloud.StorageTierMaxIOPS)
+	require.NoError(t, err)
+	assert.Equal(t, 350, quota)
+
+	quota, err = c.GetStorageQuota(context.Background(), upcloud.StorageTierHDD)
+	require.NoError(t, err)
+	assert.Equal(t, 800, quota)
+
+	quota, err = c.GetStorageQuota(context.Background(), upcloud.StorageTierStandard)
+	require.NoError(t, err)
+	assert.Equal(t, 100, quota)
+}
+
+func TestIsValidUUID(t *testing.T) {
+	t.Parallel()
+
+	assert.False(t, service.IsValidUUID(""))
+	assert.False(t, service.IsValidUUID("0160ffc3-58ec-4670-bdc9"))
+	assert.False(t, service.IsValidUUID("{0160ffc3-58ec-4670-bdc9-27fe385d281d}"))
+	assert.True(t, service.IsValidUUID("0160ffc3-58ec-4670-bdc9-27fe385d281d"))
+}
+
+func TestUpCloudService_StorageCache(t *testing.T) {
+	t.Parallel()
+	var listCount int
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/storage/private"):
+			listCount++
+			fmt.Fprint(w, `{"storages": {"storage": [
+				{"access": "private", "state": "online", "type": "normal", "uuid": "00000000-0000-0000-0000-000000000001", "title": "vol1", "zone": "fi-hel2"}
+			]}}`)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/storage"):
+			fmt.Fprint(w, `{"storage": {"access": "private", "state": "maintenance", "type": "normal", "uuid": "00000000-0000-0000-0000-000000000002", "title": "vol2", "zone": "fi-hel2"}}`)
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/storage/00000000-0000-0000-0000-000000000002"):
+			fmt.Fprint(w, `{"storage": {"access": "private", "state": "online", "type": "normal", "uuid": "00000000-0000-0000-0000-000000000002", "title": "vol2", "zone": "fi-hel2"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": {"error_code": "STORAGE_NOT_FOUND", "error_message": "not found"}}`)
+		}
+	}))
+	defer srv.Close()
+
+	c := service.NewUpCloudService(upsvc.New(client.New("", "", client.WithBaseURL(srv.URL))), service.WithStorageCacheTTL(time.Hour))
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		storages, err := c.ListStorage(ctx, "fi-hel2")
+		require.NoError(t, err)
+		require.Len(t, storages, 1)
+	}
+	assert.Equal(t, 1, listCount, "storages should be listed only once")
+
+	// created storage is written through to the cache
+	_, err := c.CreateStorage(ctx, &request.CreateStorageRequest{Title: "vol2", Zone: "fi-hel2", Size: 10})
+	require.NoError(t, err)
+	storages, err := c.ListStorage(ctx, "fi-hel2")
+	require.NoError(t, err)
+	require.Len(t, storages, 2)
+	assert.Equal(t, 1, listCount)
+
+	// unknown storage name doesn't trigger refresh before cache expires
+	for i := 0; i < 3; i++ {
+		volumes, err := c.GetStorageByName(ctx, "vol3")
+		require.NoError(t, err)
+		assert.Empty(t, volumes)
+	}
+	assert.Equal(t, 1, listCount)
+
+	_, err = c.GetStorageByUUID(ctx, "00000000-0000-0000-0000-000000000003")
+	require.ErrorIs(t, err, service.ErrStorageNotFound)
+}
+
+func TestUpCloudService_GetStorageByUUID_InvalidID(t *testing.T) {
+	t.Parallel()
+	var calls int
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error": {"error_code": "STORAGE_INVALID", "error_message": "bad request"}}`)
+	}))
+	defer srv.Close()
+
+	c := service.NewUpCloudService(upsvc.New(client.New("", "", client.WithBaseURL(srv.URL))))
+	ctx := context.Background()
+
+	// malformed UUID is not sent to the API
+	_, err := c.GetStorageByUUID(ctx, "some-fake-volume-id")
+	require.ErrorIs(t, err, service.ErrStorageNotFound)
+	_, err = c.GetServerByUUID(ctx, "some-fake-node-id")
+	require.ErrorIs(t, err, service.ErrServerNotFound)
+	mu.Lock()
+	assert.Equal(t, 0, calls)
+	mu.Unlock()
+
+	// bad request is returned as an error instead of not found
+	_, err = c.GetStorageByUUID(ctx, "00000000-0000-0000-0000-000000000001")
+	require.Error(t, err)
+	require.NotErrorIs(t, err, service.ErrStorageNotFound)
+}
+
+func TestUpCloudService_Retry(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		key := r.Method + " " + r.URL.Path[strings.Index(r.URL.Path, "/storage"):]
+		calls[key]++
+		switch key {
+		case "GET /storage/00000000-0000-0000-0000-000000000001":
+			if calls[key] < 3 {
+				w.WriteHeader(http.StatusTooManyRequests)
+				fmt.Fprint(w, `{"error": {"error_code": "TOO_MANY_REQUESTS", "error_message": "rate limit exceeded"}}`)
+				return
+			}
+			fmt.Fprint(w, `{"storage": {"access": "private", "state": "online", "type": "normal", "uuid": "00000000-0000-0000-0000-000000000001", "title": "vol1", "zone": "fi-hel2"}}`)
+		case "POST /storage":
+			// storage is created although the response is lost
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprint(w, `{"error": {"error_code": "BAD_GATEWAY", "error_message": "bad gateway"}}`)
+		case "GET /storage/private":
+			fmt.Fprint(w, `{"storages": {"storage": [
+				{"access": "private", "state": "online", "type": "normal", "uuid": "00000000-0000-0000-0000-000000000001", "title": "vol1", "zone": "fi-hel2"}
+			]}}`)
+		case "GET /storage/00000000-0000-0000-0000-000000000002":
+			fmt.Fprint(w, `{"storage": {"access": "private", "state": "online", "type": "normal", "uuid": "00000000-0000-0000-0000-000000000002", "title": "vol2", "zone": "fi-hel2"}}`)
+		case "DELETE /storage/00000000-0000-0000-0000-000000000001":
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"error": {"error_code": "INTERNAL_ERROR", "error_message": "internal error"}}`)
+		case "DELETE /storage/00000000-0000-0000-0000-000000000002":
+			if calls[key] < 2 {
+				w.WriteHeader(http.StatusConflict)
+				fmt.Fprint(w, `{"error": {"error_code": "STORAGE_STATE_ILLEGAL", "error_message": "storage is in maintenance state"}}`)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": {"error_code": "STORAGE_NOT_FOUND", "error_message": "not found"}}`)
+		}
+	}))
+	defer srv.Close()
+
+	c := service.NewUpCloudService(
+		upsvc.New(client.New("", "", client.WithBaseURL(srv.URL))),
+		service.WithRetryPolicy(service.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}),
+		service.WithRateLimit(1000, 1),
+	)
+	ctx := context.Background()
+	count := func(key string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls[key]
+	}
+
+	// rate limited call is retried
+	s, err := c.GetStorageByUUID(ctx, "00000000-0000-0000-0000-000000000001")
+	require.NoError(t, err)
+	assert.Equal(t, "00000000-0000-0000-0000-000000000001", s.UUID)
+	assert.Equal(t, 3, count("GET /storage/00000000-0000-0000-0000-000000000001"))
+
+	// create is not repeated if storage with the same title exists
+	s, err = c.CreateStorage(ctx, &request.CreateStorageRequest{Title: "vol1", Zone: "fi-hel2", Size: 10})
+	require.NoError(t, err)
+	assert.Equal(t, "00000000-0000-0000-0000-000000000001", s.UUID)
+	assert.Equal(t, 1, count("POST /storage"))
+
+	// create is retried if storage doesn't exist
+	_, err = c.CreateStorage(ctx, &request.CreateStorageRequest{Title: "vol2", Zone: "fi-hel2", Size: 10})
+	require.Error(t, err)
+	assert.Equal(t, 4, count("POST /storage"))
+
+	// unsafe call is not retried after server error, but it's retried if the request was rejected
+	require.Error(t, c.DeleteStorage(ctx, "00000000-0000-0000-0000-000000000001"))
+	assert.Equal(t, 1, count("DELETE /storage/00000000-0000-0000-0000-000000000001"))
+	require.NoError(t, c.DeleteStorage(ctx, "00000000-0000-0000-0000-000000000002"))
+	assert.Equal(t, 2, count("DELETE /storage/00000000-0000-0000-0000-000000000002"))
+}
+
 func TestUpCloudService_AttachDetachStorage_Concurrency(t *testing.T) {
 	t.Parallel()
 
@@ -227,3 +478,129 @@ func TestUpCloudService_AttachDetachStorage_Concurrency(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestUpCloudService_Delete_StorageBusy(t *testing.T) {
+	t.Parallel()
+	var deletes int
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method + " " + strings.TrimPrefix(r.URL.Path, "/1.3") {
+		case "GET /storage/01000000-0000-4000-8000-000000000001":
+			fmt.Fprint(w, `{"storage": {"access": "private", "state": "backuping", "type": "normal", "uuid": "01000000-0000-4000-8000-000000000001", "title": "vol1", "zone": "fi-hel2"}}`)
+		case "GET /storage/01000000-0000-4000-8000-000000000002":
+			fmt.Fprint(w, `{"storage": {"access": "private", "state": "maintenance", "type": "backup", "uuid": "01000000-0000-4000-8000-000000000002", "title": "backup1", "origin": "01000000-0000-4000-8000-000000000001", "zone": "fi-hel2"}}`)
+		case "DELETE /storage/01000000-0000-4000-8000-000000000001", "DELETE /storage/01000000-0000-4000-8000-000000000002":
+			deletes++
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": {"error_code": "STORAGE_NOT_FOUND", "error_message": "not found"}}`)
+		}
+	}))
+	defer srv.Close()
+
+	c := service.NewUpCloudService(upsvc.New(client.New("", "", client.WithBaseURL(srv.URL))))
+	ctx := context.Background()
+
+	// delete doesn't wait for backup to finish, caller retries later
+	require.ErrorIs(t, c.DeleteStorage(ctx, "01000000-0000-4000-8000-000000000001"), service.ErrStorageBusy)
+	require.ErrorIs(t, c.DeleteStorageBackup(ctx, "01000000-0000-4000-8000-000000000002"), service.ErrStorageBusy)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 0, deletes)
+}
+
+func TestUpCloudService_FakeAPI(t *testing.T) {
+	t.Parallel()
+	fake := mock.NewFakeService()
+	fake.TransitionDelay = 20 * time.Millisecond
+	fake.Quota[upcloud.StorageTierMaxIOPS] = 100
+	server := fake.AddServer("node-1", "fi-hel2")
+	srv := httptest.NewServer(fake.APIHandler())
+	defer srv.Close()
+
+	c, err := service.NewUpCloudServiceFromCredentials("user", "pass",
+		service.WithAPIURL(srv.URL),
+		service.WithStatePollInterval(5*time.Millisecond),
+	)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	s, err := c.CreateStorage(ctx, &request.CreateStorageRequest{
+		Title:  "vol1",
+		Zone:   "fi-hel2",
+		Size:   10,
+		Tier:   upcloud.StorageTierMaxIOPS,
+		Labels: []upcloud.Label{{Key: "k", Value: "v"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, upcloud.StorageStateOnline, s.State)
+	assert.Equal(t, []upcloud.Label{{Key: "k", Value: "v"}}, s.Labels)
+
+	quota, err := c.GetStorageQuota(ctx, upcloud.StorageTierMaxIOPS)
+	require.NoError(t, err)
+	assert.Equal(t, 100-10-10, quota)
+
+	got, err := c.GetServerByHostname(ctx, "node-1")
+	require.NoError(t, err)
+	assert.Equal(t, server.UUID, got.UUID)
+
+	require.NoError(t, c.AttachStorage(ctx, s.UUID, server.UUID))
+	got, err = c.GetServerByUUID(ctx, server.UUID)
+	require.NoError(t, err)
+	require.Len(t, got.StorageDevices, 2)
+	assert.Equal(t, s.UUID, got.StorageDevices[1].UUID)
+	require.Error(t, c.DeleteStorage(ctx, s.UUID))
+	require.NoError(t, c.DetachStorage(ctx, s.UUID, server.UUID))
+	require.ErrorIs(t, c.DetachStorage(ctx, s.UUID, server.UUID), service.ErrServerStorageNotFound)
+
+	s, err = c.ResizeStorage(ctx, s.UUID, 20, true)
+	require.NoError(t, err)
+	assert.Equal(t, 20, s.Size)
+	assert.Empty(t, s.BackupUUIDs)
+
+	b, err := c.CreateStorageBackup(ctx, s.UUID, "backup1")
+	require.NoError(t, err)
+	require.NoError(t, c.RequireStorageOnline(ctx, &b.Storage))
+	backups, err := c.ListStorageBackups(ctx, s.UUID)
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+
+	clone, err := c.CloneStorage(ctx, &request.CloneStorageRequest{UUID: b.UUID, Zone: "fi-hel2", Title: "vol2"})
+	require.NoError(t, err)
+	assert.Equal(t, 20, clone.Size)
+
+	require.NoError(t, c.DeleteStorageBackup(ctx, b.UUID))
+	require.NoError(t, c.DeleteStorage(ctx, clone.UUID))
+	require.NoError(t, c.DeleteStorage(ctx, s.UUID))
+	_, err = c.GetStorageByUUID(ctx, s.UUID)
+	require.ErrorIs(t, err, service.ErrStorageNotFound)
+}
+
+//nolint:paralleltest // test sets global tracer provider
+func TestTracingService(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	fake := mock.NewFakeService()
+	s := fake.AddStorage("vol1", "fi-hel2", 10)
+	svc := service.NewTracingService(fake)
+	ctx := context.Background()
+
+	got, err := svc.GetStorageByUUID(ctx, s.UUID)
+	require.NoError(t, err)
+	assert.Equal(t, s.UUID, got.UUID)
+	_, err = svc.GetStorageByUUID(ctx, "00000000-0000-0000-0000-000000000000")
+	require.ErrorIs(t, err, service.ErrStorageNotFound, "errors should be returned unchanged")
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	for i, uuid := range []string{s.UUID, "00000000-0000-0000-0000-000000000000"} {
+		assert.Equal(t, "service.GetStorageByUUID", spans[i].Name())
+		assert.Contains(t, spans[i].Attributes(), attribute.String("upcloud.storage_uuid", uuid))
+	}
+	assert.Equal(t, codes.Unset, spans[0].Status().Code)
+	assert.Equal(t, codes.Error, spans[1].Status().Code)
+}
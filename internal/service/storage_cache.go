@@ -0,0 +1,202 @@
+package service
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/request"
+)
+
+// storageCache is an index of account's private storages. Index is refreshed using full storage listing
+// when it's older than TTL. Changes made by the service are written through to the index so that
+// they are visible before the next refresh. Zero TTL refreshes the index on every read.
+type storageCache struct {
+	ttl time.Duration
+
+	// refreshMu makes sure that only one refresh is in progress at the time.
+	refreshMu sync.Mutex
+
+	mu       sync.RWMutex
+	updated  time.Time
+	byUUID   map[string]upcloud.Storage
+	byTitle  map[string]map[string]struct{}
+	byOrigin map[string]map[string]struct{}
+
+	// servers maps server hostname to server UUID.
+	servers sync.Map
+}
+
+func newStorageCache(ttl time.Duration) *storageCache {
+	return &storageCache{
+		ttl:      ttl,
+		byUUID:   make(map[string]upcloud.Storage),
+		byTitle:  make(map[string]map[string]struct{}),
+		byOrigin: make(map[string]map[string]struct{}),
+	}
+}
+
+// storages returns storages that match the filter. Index is refreshed first if it's expired.
+func (c *storageCache) storages(ctx context.Context, client upCloudClient, filter func(upcloud.Storage) bool) ([]upcloud.Storage, error) {
+	if err := c.refreshIfExpired(ctx, client); err != nil {
+		return nil, err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	storages := make([]upcloud.Storage, 0)
+	for _, s := range c.byUUID {
+		if filter(s) {
+			storages = append(storages, s)
+		}
+	}
+	sortStorages(storages)
+	return storages, nil
+}
+
+// storagesByTitle returns storages with the title. Title that is not found is regarded as not found until the index
+// expires, as storages created and deleted by the service are written through to the index.
+func (c *storageCache) storagesByTitle(ctx context.Context, client upCloudClient, title string) ([]upcloud.Storage, error) {
+	if err := c.refreshIfExpired(ctx, client); err != nil {
+		return nil, err
+	}
+	return c.lookup(func() map[string]struct{} { return c.byTitle[title] }), nil
+}
+
+// storagesByOrigin returns storages (e.g. backups) created from the origin storage.
+func (c *storageCache) storagesByOrigin(ctx context.Context, client upCloudClient, origin string) ([]upcloud.Storage, error) {
+	if err := c.refreshIfExpired(ctx, client); err != nil {
+		return nil, err
+	}
+	return c.lookup(func() map[string]struct{} { return c.byOrigin[origin] }), nil
+}
+
+func (c *storageCache) lookup(index func() map[string]struct{}) []upcloud.Storage {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	storages := make([]upcloud.Storage, 0)
+	for uuid := range index() {
+		if s, ok := c.byUUID[uuid]; ok {
+			storages = append(storages, s)
+		}
+	}
+	sortStorages(storages)
+	return storages
+}
+
+func (c *storageCache) refreshIfExpired(ctx context.Context, client upCloudClient) error {
+	requested := time.Now()
+	c.mu.RLock()
+	expired := requested.Sub(c.updated) >= c.ttl
+	c.mu.RUnlock()
+	if !expired {
+		return nil
+	}
+	return c.refresh(ctx, client, requested)
+}
+
+// refresh replaces the index with storages listed from the API. Refresh is skipped if the index
+// has been refreshed by another caller after the refresh was requested.
+func (c *storageCache) refresh(ctx context.Context, client upCloudClient, requested time.Time) error {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+
+	c.mu.RLock()
+	refreshed := c.updated.After(requested)
+	c.mu.RUnlock()
+	if refreshed {
+		return nil
+	}
+
+	started := time.Now()
+	storages, err := client.GetStorages(ctx, &request.GetStoragesRequest{Access: upcloud.StorageAccessPrivate})
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.byUUID = make(map[string]upcloud.Storage, len(storages.Storages))
+	c.byTitle = make(map[string]map[string]struct{})
+	c.byOrigin = make(map[string]map[string]struct{})
+	for _, s := range storages.Storages {
+		c.add(s)
+	}
+	c.updated = started
+	return nil
+}
+
+// upsert adds or updates the storage in the index.
+func (c *storageCache) upsert(s upcloud.Storage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(s.UUID)
+	c.add(s)
+}
+
+// delete removes the storage from the index.
+func (c *storageCache) delete(uuid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(uuid)
+}
+
+func (c *storageCache) add(s upcloud.Storage) {
+	c.byUUID[s.UUID] = s
+	addToIndex(c.byTitle, s.Title, s.UUID)
+	if s.Origin != "" {
+		addToIndex(c.byOrigin, s.Origin, s.UUID)
+	}
+}
+
+func (c *storageCache) remove(uuid string) {
+	s, ok := c.byUUID[uuid]
+	if !ok {
+		return
+	}
+	delete(c.byUUID, uuid)
+	removeFromIndex(c.byTitle, s.Title, uuid)
+	removeFromIndex(c.byOrigin, s.Origin, uuid)
+}
+
+// serverUUID returns cached UUID of the server with the hostname.
+func (c *storageCache) serverUUID(hostname string) (string, bool) {
+	if uuid, ok := c.servers.Load(hostname); ok {
+		return uuid.(string), true //nolint:forcetypeassert // only strings are stored
+	}
+	return "", false
+}
+
+// setServers replaces cached server hostnames.
+func (c *storageCache) setServers(servers []upcloud.Server) {
+	c.servers.Range(func(key, _ any) bool {
+		c.servers.Delete(key)
+		return true
+	})
+	for _, s := range servers {
+		c.servers.Store(s.Hostname, s.UUID)
+	}
+}
+
+// sortStorages sorts storages by UUID so that listings, and pagination based on them, are stable.
+func sortStorages(storages []upcloud.Storage) {
+	sort.Slice(storages, func(i, j int) bool {
+		return storages[i].UUID < storages[j].UUID
+	})
+}
+
+func addToIndex(index map[string]map[string]struct{}, key, uuid string) {
+	if _, ok := index[key]; !ok {
+		index[key] = make(map[string]struct{})
+	}
+	index[key][uuid] = struct{}{}
+}
+
+func removeFromIndex(index map[string]map[string]struct{}, key, uuid string) {
+	if uuids, ok := index[key]; ok {
+		delete(uuids, uuid)
+		if len(uuids) == 0 {
+			delete(index, key)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package service
+
+import (
+	"context"
+
+	"github.com/UpCloudLtd/upcloud-csi/internal/tracing"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/request"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	storageUUIDAttribute string = "upcloud.storage_uuid"
+	serverUUIDAttribute  string = "upcloud.server_uuid"
+	hostnameAttribute    string = "upcloud.hostname"
+	zoneAttribute        string = "upcloud.zone"
+)
+
+// TracingService wraps Service and records a span for each call.
+type TracingService struct {
+	svc Service
+}
+
+func NewTracingService(svc Service) *TracingService {
+	return &TracingService{svc: svc}
+}
+
+func traced[T any](ctx context.Context, name string, fn func(context.Context) (T, error), attrs ...attribute.KeyValue) (T, error) {
+	ctx, span := tracing.Start(ctx, "service."+name, attrs...)
+	v, err := fn(ctx)
+	tracing.End(span, err)
+	return v, err
+}
+
+func tracedErr(ctx context.Context, name string, fn func(context.Context) error, attrs ...attribute.KeyValue) error {
+	_, err := traced(ctx, name, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, fn(ctx)
+	}, attrs...)
+	return err
+}
+
+func (t *TracingService) GetServerByHostname(ctx context.Context, hostname string) (*upcloud.ServerDetails, error) {
+	return traced(ctx, "GetServerByHostname", func(ctx context.Context) (*upcloud.ServerDetails, error) {
+		return t.svc.GetServerByHostname(ctx, hostname)
+	}, attribute.String(hostnameAttribute, hostname))
+}
+
+func (t *TracingService) GetServerByUUID(ctx context.Context, uuid string) (*upcloud.ServerDetails, error) {
+	return traced(ctx, "GetServerByUUID", func(ctx context.Context) (*upcloud.ServerDetails, error) {
+		return t.svc.GetServerByUUID(ctx, uuid)
+	}, attribute.String(serverUUIDAttribute, uuid))
+}
+
+func (t *TracingService) GetStorageByUUID(ctx context.Context, uuid string) (*upcloud.StorageDetails, error) {
+	return traced(ctx, "GetStorageByUUID", func(ctx context.Context) (*upcloud.StorageDetails, error) {
+		return t.svc.GetStorageByUUID(ctx, uuid)
+	}, attribute.String(storageUUIDAttribute, uuid))
+}
+
+func (t *TracingService) GetStorageByName(ctx context.Context, name string) ([]*upcloud.StorageDetails, error) {
+	return traced(ctx, "GetStorageByName", func(ctx context.Context) ([]*upcloud.StorageDetails, error) {
+		return t.svc.GetStorageByName(ctx, name)
+	})
+}
+
+func (t *TracingService) ListStorage(ctx context.Context, zone string) ([]upcloud.Storage, error) {
+	return traced(ctx, "ListStorage", func(ctx context.Context) ([]upcloud.Storage, error) {
+		return t.svc.ListStorage(ctx, zone)
+	}, attribute.String(zoneAttribute, zone))
+}
+
+func (t *TracingService) GetStorageBackupByName(ctx context.Context, name string) (*upcloud.Storage, error) {
+	return traced(ctx, "GetStorageBackupByName", func(ctx context.Context) (*upcloud.Storage, error) {
+		return t.svc.GetStorageBackupByName(ctx, name)
+	})
+}
+
+func (t *TracingService) ListStorageBackups(ctx context.Context, uuid string) ([]upcloud.Storage, error) {
+	return traced(ctx, "ListStorageBackups", func(ctx context.Context) ([]upcloud.Storage, error) {
+		return t.svc.ListStorageBackups(ctx, uuid)
+	}, attribute.String(storageUUIDAttribute, uuid))
+}
+
+func (t *TracingService) RequireStorageOnline(ctx context.Context, s *upcloud.Storage) error {
+	return tracedErr(ctx, "RequireStorageOnline", func(ctx context.Context) error {
+		return t.svc.RequireStorageOnline(ctx, s)
+	}, attribute.String(storageUUIDAttribute, s.UUID))
+}
+
+func (t *TracingService) CreateStorage(ctx context.Context, r *request.CreateStorageRequest) (*upcloud.StorageDetails, error) {
+	return traced(ctx, "CreateStorage", func(ctx context.Context) (*upcloud.StorageDetails, error) {
+		return t.svc.CreateStorage(ctx, r)
+	}, attribute.String(zoneAttribute, r.Zone))
+}
+
+func (t *TracingService) CloneStorage(ctx context.Context, r *request.CloneStorageRequest, label ...upcloud.Label) (*upcloud.StorageDetails, error) {
+	return traced(ctx, "CloneStorage", func(ctx context.Context) (*upcloud.StorageDetails, error) {
+		return t.svc.CloneStorage(ctx, r, label...)
+	}, attribute.String(storageUUIDAttribute, r.UUID), attribute.String(zoneAttribute, r.Zone))
+}
+
+func (t *TracingService) StartCloneStorage(ctx context.Context, r *request.CloneStorageRequest) (*upcloud.StorageDetails, error) {
+	return traced(ctx, "StartCloneStorage", func(ctx context.Context) (*upcloud.StorageDetails, error) {
+		return t.svc.StartCloneStorage(ctx, r)
+	}, attribute.String(storageUUIDAttribute, r.UUID), attribute.String(zoneAttribute, r.Zone))
+}
+
+func (t *TracingService) DeleteStorage(ctx context.Context, uuid string) error {
+	return tracedErr(ctx, "DeleteStorage", func(ctx context.Context) error {
+		return t.svc.DeleteStorage(ctx, uuid)
+	}, attribute.String(storageUUIDAttribute, uuid))
+}
+
+func (t *TracingService) AttachStorage(ctx context.Context, storageUUID, serverUUID string) error {
+	return tracedErr(ctx, "AttachStorage", func(ctx context.Context) error {
+		return t.svc.AttachStorage(ctx, storageUUID, serverUUID)
+	}, attribute.String(storageUUIDAttribute, storageUUID), attribute.String(serverUUIDAttribute, serverUUID))
+}
+
+func (t *TracingService) DetachStorage(ctx context.Context, storageUUID, serverUUID string) error {
+	return tracedErr(ctx, "DetachStorage", func(ctx context.Context) error {
+		return t.svc.DetachStorage(ctx, storageUUID, serverUUID)
+	}, attribute.String(storageUUIDAttribute, storageUUID), attribute.String(serverUUIDAttribute, serverUUID))
+}
+
+func (t *TracingService) ResizeStorage(ctx context.Context, uuid string, newSize int, deleteBackup bool) (*upcloud.StorageDetails, error) {
+	return traced(ctx, "ResizeStorage", func(ctx context.Context) (*upcloud.StorageDetails, error) {
+		return t.svc.ResizeStorage(ctx, uuid, newSize, deleteBackup)
+	}, attribute.String(storageUUIDAttribute, uuid), attribute.Int("upcloud.size", newSize))
+}
+
+func (t *TracingService) ResizeBlockDevice(ctx context.Context, uuid string, newSize int) (*upcloud.StorageDetails, error) {
+	return traced(ctx, "ResizeBlockDevice", func(ctx context.Context) (*upcloud.StorageDetails, error) {
+		return t.svc.ResizeBlockDevice(ctx, uuid, newSize)
+	}, attribute.String(storageUUIDAttribute, uuid), attribute.Int("upcloud.size", newSize))
+}
+
+func (t *TracingService) CreateStorageBackup(ctx context.Context, uuid, title string) (*upcloud.StorageDetails, error) {
+	return traced(ctx, "CreateStorageBackup", func(ctx context.Context) (*upcloud.StorageDetails, error) {
+		return t.svc.CreateStorageBackup(ctx, uuid, title)
+	}, attribute.String(storageUUIDAttribute, uuid))
+}
+
+func (t *TracingService) DeleteStorageBackup(ctx context.Context, uuid string) error {
+	return tracedErr(ctx, "DeleteStorageBackup", func(ctx context.Context) error {
+		return t.svc.DeleteStorageBackup(ctx, uuid)
+	}, attribute.String(storageUUIDAttribute, uuid))
+}
+
+func (t *TracingService) GetAccount(ctx context.Context) (*upcloud.Account, error) {
+	return traced(ctx, "GetAccount", t.svc.GetAccount)
+}
+
+func (t *TracingService) GetStorageQuota(ctx context.Context, tier string) (int, error) {
+	return traced(ctx, "GetStorageQuota", func(ctx context.Context) (int, error) {
+		return t.svc.GetStorageQuota(ctx, tier)
+	}, attribute.String("upcloud.tier", tier))
+}
+
+func (t *TracingService) SetStorageLabels(ctx context.Context, uuid string, labels []upcloud.Label) (*upcloud.StorageDetails, error) {
+	return traced(ctx, "SetStorageLabels", func(ctx context.Context) (*upcloud.StorageDetails, error) {
+		return t.svc.SetStorageLabels(ctx, uuid, labels)
+	}, attribute.String(storageUUIDAttribute, uuid))
+}
@@ -4,80 +4,191 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
 	"sync"
 	"time"
 
+	"github.com/UpCloudLtd/upcloud-csi/internal/metrics"
+	"github.com/UpCloudLtd/upcloud-csi/internal/tracing"
 	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
 	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/client"
 	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/request"
 	upsvc "github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/service"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/time/rate"
 )
 
 const (
 	storageStateTimeout time.Duration = time.Hour
 	serverStateTimeout  time.Duration = 15 * time.Minute
 
+	// defaultStatePollInterval is how often storage and server state is polled while waiting for a state change.
+	defaultStatePollInterval time.Duration = 5 * time.Second
+
 	// clientTimeout helps to tune for timeout on requests to UpCloud API. Measurement: seconds.
 	clientTimeout time.Duration = 120 * time.Second
 )
 
+// upCloudClient is the subset of UpCloud API client used by the service.
 type upCloudClient interface {
-	upsvc.Storage
-
-	WaitForServerState(ctx context.Context, r *request.WaitForServerStateRequest) (*upcloud.ServerDetails, error)
+	GetStorages(ctx context.Context, r *request.GetStoragesRequest) (*upcloud.Storages, error)
+	GetStorageDetails(ctx context.Context, r *request.GetStorageDetailsRequest) (*upcloud.StorageDetails, error)
+	CreateStorage(ctx context.Context, r *request.CreateStorageRequest) (*upcloud.StorageDetails, error)
+	ModifyStorage(ctx context.Context, r *request.ModifyStorageRequest) (*upcloud.StorageDetails, error)
+	AttachStorage(ctx context.Context, r *request.AttachStorageRequest) (*upcloud.ServerDetails, error)
+	DetachStorage(ctx context.Context, r *request.DetachStorageRequest) (*upcloud.ServerDetails, error)
+	CloneStorage(ctx context.Context, r *request.CloneStorageRequest) (*upcloud.StorageDetails, error)
+	CreateBackup(ctx context.Context, r *request.CreateBackupRequest) (*upcloud.StorageDetails, error)
+	DeleteStorage(ctx context.Context, r *request.DeleteStorageRequest) error
+	ResizeStorageFilesystem(ctx context.Context, r *request.ResizeStorageFilesystemRequest) (*upcloud.ResizeStorageFilesystemBackup, error)
 	GetServers(ctx context.Context) (*upcloud.Servers, error)
 	GetServerDetails(ctx context.Context, r *request.GetServerDetailsRequest) (*upcloud.ServerDetails, error)
+	GetAccount(ctx context.Context) (*upcloud.Account, error)
 }
 
 type UpCloudService struct {
 	client upCloudClient
+	cache  *storageCache
+
+	retryPolicy  *RetryPolicy
+	limiter      *rate.Limiter
+	apiURL       string
+	pollInterval time.Duration
 
 	// nodeSync holds per node mutex lock so that only one detach/attach operation can run simultaneously towards the node.
 	nodeSync sync.Map
 }
 
-func NewUpCloudService(svc upCloudClient) *UpCloudService {
-	return &UpCloudService{client: svc}
+// Option configures UpCloudService.
+type Option func(*UpCloudService)
+
+// WithStorageCacheTTL sets how long storage listing is cached before it's refreshed.
+// Zero TTL (default) lists storages on every call.
+func WithStorageCacheTTL(ttl time.Duration) Option {
+	return func(u *UpCloudService) {
+		u.cache = newStorageCache(ttl)
+	}
+}
+
+// WithRetryPolicy enables retrying of API calls that failed with a transient error.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(u *UpCloudService) {
+		u.retryPolicy = &policy
+	}
+}
+
+// WithRateLimit limits the rate of API calls to rps calls per second with bursts of at most burst calls.
+// Limit is shared by all the calls made by the service. Zero rps disables rate limiting.
+func WithRateLimit(rps float64, burst int) Option {
+	return func(u *UpCloudService) {
+		if rps <= 0 {
+			u.limiter = nil
+			return
+		}
+		if burst < 1 {
+			burst = 1
+		}
+		u.limiter = rate.NewLimiter(rate.Limit(rps), burst)
+	}
+}
+
+// WithAPIURL sets base URL of the UpCloud API, e.g. to use local API stand-in in tests.
+// Option is used only when service is created using credentials.
+func WithAPIURL(url string) Option {
+	return func(u *UpCloudService) {
+		u.apiURL = url
+	}
+}
+
+// WithStatePollInterval sets how often storage and server state is polled while waiting for a state change.
+func WithStatePollInterval(interval time.Duration) Option {
+	return func(u *UpCloudService) {
+		if interval > 0 {
+			u.pollInterval = interval
+		}
+	}
+}
+
+func NewUpCloudService(svc upCloudClient, opts ...Option) *UpCloudService {
+	u := newUpCloudService(opts...)
+	u.setClient(svc)
+	return u
 }
 
-func NewUpCloudServiceFromCredentials(username, password string) (*UpCloudService, error) {
+func NewUpCloudServiceFromCredentials(username, password string, opts ...Option) (*UpCloudService, error) {
 	if username == "" {
 		return nil, errors.New("UpCloud API username is missing")
 	}
 	if password == "" {
 		return nil, errors.New("UpCloud API password is missing")
 	}
-	return NewUpCloudService(
-		upsvc.New(client.New(username, password, client.WithTimeout(clientTimeout))),
-	), nil
+	u := newUpCloudService(opts...)
+	clientOpts := []client.ConfigFn{
+		client.WithHTTPClient(&http.Client{Transport: metrics.InstrumentRoundTripper(client.NewDefaultHTTPTransport())}),
+		client.WithTimeout(clientTimeout),
+	}
+	if u.apiURL != "" {
+		clientOpts = append(clientOpts, client.WithBaseURL(u.apiURL))
+	}
+	u.setClient(upsvc.New(client.New(username, password, clientOpts...)))
+	return u, nil
 }
 
+func newUpCloudService(opts ...Option) *UpCloudService {
+	u := &UpCloudService{cache: newStorageCache(0), pollInterval: defaultStatePollInterval}
+	for _, opt := range opts {
+		opt(u)
+	}
+	return u
+}
+
+// setClient sets API client, which is wrapped with retry client if retries or rate limiting is enabled.
+func (u *UpCloudService) setClient(svc upCloudClient) {
+	u.client = svc
+	if u.retryPolicy != nil || u.limiter != nil {
+		policy := RetryPolicy{MaxAttempts: 1}
+		if u.retryPolicy != nil {
+			policy = *u.retryPolicy
+		}
+		u.client = newRetryClient(u.client, policy, u.limiter)
+	}
+}
+
+// GetStorageByUUID returns storage details. Details are always fetched from the API, because callers depend on
+// up-to-date storage state and server attachments, which are not part of the cached storage listing.
 func (u *UpCloudService) GetStorageByUUID(ctx context.Context, storageUUID string) (*upcloud.StorageDetails, error) {
-	gsr := &request.GetStoragesRequest{}
-	storages, err := u.client.GetStorages(ctx, gsr)
-	if err != nil {
-		return nil, err
+	if !IsValidUUID(storageUUID) {
+		// malformed UUID can't match any storage, API would reject it as bad request
+		return nil, ErrStorageNotFound
 	}
-	for _, s := range storages.Storages {
-		if s.UUID == storageUUID {
-			return u.client.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: s.UUID})
+	s, err := u.client.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: storageUUID})
+	if err != nil {
+		if isNotFoundError(err) {
+			u.cache.delete(storageUUID)
+			return nil, ErrStorageNotFound
 		}
+		return nil, err
 	}
-	return nil, ErrStorageNotFound
+	u.cache.upsert(s.Storage)
+	return s, nil
 }
 
 func (u *UpCloudService) GetStorageByName(ctx context.Context, storageName string) ([]*upcloud.StorageDetails, error) {
-	gsr := &request.GetStoragesRequest{}
-	storages, err := u.client.GetStorages(ctx, gsr)
+	storages, err := u.cache.storagesByTitle(ctx, u.client, storageName)
 	if err != nil {
 		return nil, err
 	}
 	volumes := make([]*upcloud.StorageDetails, 0)
-	for _, s := range storages.Storages {
-		if s.Title == storageName {
-			sd, _ := u.client.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: s.UUID})
-			volumes = append(volumes, sd)
+	for _, s := range storages {
+		sd, err := u.GetStorageByUUID(ctx, s.UUID)
+		if err != nil {
+			if errors.Is(err, ErrStorageNotFound) {
+				continue
+			}
+			return nil, err
 		}
+		volumes = append(volumes, sd)
 	}
 	return volumes, nil
 }
@@ -87,6 +198,7 @@ func (u *UpCloudService) CreateStorage(ctx context.Context, csr *request.CreateS
 	if err != nil {
 		return nil, err
 	}
+	u.cache.upsert(s.Storage)
 	return u.waitForStorageOnline(ctx, s.Storage.UUID)
 }
 
@@ -95,6 +207,7 @@ func (u *UpCloudService) CloneStorage(ctx context.Context, r *request.CloneStora
 	if err != nil {
 		return nil, err
 	}
+	u.cache.upsert(s.Storage)
 	s, err = u.waitForStorageOnline(ctx, s.Storage.UUID)
 	if err != nil {
 		return s, err
@@ -112,17 +225,31 @@ func (u *UpCloudService) CloneStorage(ctx context.Context, r *request.CloneStora
 	return s, err
 }
 
+// StartCloneStorage starts cloning storage without waiting for the clone to finish.
+func (u *UpCloudService) StartCloneStorage(ctx context.Context, r *request.CloneStorageRequest) (*upcloud.StorageDetails, error) {
+	s, err := u.client.CloneStorage(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	u.cache.upsert(s.Storage)
+	return s, nil
+}
+
 func (u *UpCloudService) DeleteStorage(ctx context.Context, storageUUID string) error {
 	var err error
 	volume, err := u.GetStorageByUUID(ctx, storageUUID)
 	if err != nil {
 		return err
 	}
+	if err := requireStorageIdle(&volume.Storage); err != nil {
+		return err
+	}
 
 	dsr := &request.DeleteStorageRequest{UUID: volume.UUID}
 	if err = u.client.DeleteStorage(ctx, dsr); err != nil {
 		return err
 	}
+	u.cache.delete(volume.UUID)
 	return nil
 }
 
@@ -130,7 +257,11 @@ func (u *UpCloudService) AttachStorage(ctx context.Context, storageUUID, serverU
 	// Lock attach operation per node because node can only attach single storage at the time.
 	mu, _ := u.nodeSync.LoadOrStore(serverUUID, &sync.Mutex{})
 	if mu != nil {
+		now := time.Now()
+		_, span := tracing.Start(ctx, "service.waitForNodeLock", attribute.String(serverUUIDAttribute, serverUUID))
 		mu.(*sync.Mutex).Lock()
+		span.End()
+		metrics.ObserveNodeLockWait(time.Since(now))
 		defer mu.(*sync.Mutex).Unlock()
 	}
 
@@ -156,7 +287,11 @@ func (u *UpCloudService) DetachStorage(ctx context.Context, storageUUID, serverU
 	// Lock detach operation per node because node can only detach single storage at the time.
 	mu, _ := u.nodeSync.LoadOrStore(serverUUID, &sync.Mutex{})
 	if mu != nil {
+		now := time.Now()
+		_, span := tracing.Start(ctx, "service.waitForNodeLock", attribute.String(serverUUIDAttribute, serverUUID))
 		mu.(*sync.Mutex).Lock()
+		span.End()
+		metrics.ObserveNodeLockWait(time.Since(now))
 		defer mu.(*sync.Mutex).Unlock()
 	}
 
@@ -188,24 +323,24 @@ func (u *UpCloudService) DetachStorage(ctx context.Context, storageUUID, serverU
 }
 
 func (u *UpCloudService) ListStorage(ctx context.Context, zone string) ([]upcloud.Storage, error) {
-	storages, err := u.client.GetStorages(ctx, &request.GetStoragesRequest{Access: upcloud.StorageAccessPrivate})
-	if err != nil {
-		return nil, err
-	}
-	zoneStorage := make([]upcloud.Storage, 0)
-	for _, s := range storages.Storages {
-		if s.Zone == zone && s.Type == upcloud.StorageTypeNormal {
-			zoneStorage = append(zoneStorage, s)
-		}
-	}
-	return zoneStorage, nil
+	return u.cache.storages(ctx, u.client, func(s upcloud.Storage) bool {
+		return s.Zone == zone && s.Type == upcloud.StorageTypeNormal
+	})
 }
 
 func (u *UpCloudService) GetServerByHostname(ctx context.Context, hostname string) (*upcloud.ServerDetails, error) {
+	if uuid, ok := u.cache.serverUUID(hostname); ok {
+		// server might have been deleted or renamed, so fall back to server listing if cached server doesn't match
+		if server, err := u.GetServerByUUID(ctx, uuid); err == nil && server.Hostname == hostname {
+			return server, nil
+		}
+	}
+
 	servers, err := u.client.GetServers(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch servers: %w", err)
 	}
+	u.cache.setServers(servers.Servers)
 
 	for _, server := range servers.Servers {
 		if server.Hostname == hostname {
@@ -218,6 +353,20 @@ func (u *UpCloudService) GetServerByHostname(ctx context.Context, hostname strin
 	return nil, ErrServerNotFound
 }
 
+func (u *UpCloudService) GetServerByUUID(ctx context.Context, uuid string) (*upcloud.ServerDetails, error) {
+	if !IsValidUUID(uuid) {
+		return nil, ErrServerNotFound
+	}
+	server, err := u.client.GetServerDetails(ctx, &request.GetServerDetailsRequest{UUID: uuid})
+	if err != nil {
+		if isNotFoundError(err) {
+			return nil, ErrServerNotFound
+		}
+		return nil, fmt.Errorf("failed to fetch server details: %w", err)
+	}
+	return server, nil
+}
+
 func (u *UpCloudService) ResizeStorage(ctx context.Context, uuid string, newSize int, deleteBackup bool) (*upcloud.StorageDetails, error) {
 	storage, err := u.client.ModifyStorage(ctx, &request.ModifyStorageRequest{
 		UUID: uuid,
@@ -252,6 +401,20 @@ func (u *UpCloudService) ResizeBlockDevice(ctx context.Context, uuid string, new
 	return u.waitForStorageOnline(ctx, storage.Storage.UUID)
 }
 
+// SetStorageLabels replaces storage labels with the given labels.
+func (u *UpCloudService) SetStorageLabels(ctx context.Context, uuid string, labels []upcloud.Label) (*upcloud.StorageDetails, error) {
+	storage, err := u.client.ModifyStorage(ctx, &request.ModifyStorageRequest{
+		UUID:   uuid,
+		Labels: &labels,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return u.waitForStorageOnline(ctx, storage.Storage.UUID)
+}
+
+// CreateStorageBackup starts creating storage backup. Backup is returned without waiting for it to finish,
+// so backup state needs to be checked before backup is used.
 func (u *UpCloudService) CreateStorageBackup(ctx context.Context, uuid, title string) (*upcloud.StorageDetails, error) {
 	// check that a backup creation is not currently in progress
 	storage, err := u.GetStorageByUUID(ctx, uuid)
@@ -270,18 +433,24 @@ func (u *UpCloudService) CreateStorageBackup(ctx context.Context, uuid, title st
 	if err != nil {
 		return nil, err
 	}
-	return u.waitForStorageOnline(ctx, backup.UUID)
+	u.cache.upsert(backup.Storage)
+	return backup, nil
 }
 
 // listStorageBackups lists strage backups. If `originUUID` is empty all backups are retured.
 func (u *UpCloudService) ListStorageBackups(ctx context.Context, originUUID string) ([]upcloud.Storage, error) {
-	storages, err := u.client.GetStorages(ctx, &request.GetStoragesRequest{Type: upcloud.StorageTypeBackup})
+	if originUUID == "" {
+		return u.cache.storages(ctx, u.client, func(s upcloud.Storage) bool {
+			return s.Type == upcloud.StorageTypeBackup && s.Origin != ""
+		})
+	}
+	storages, err := u.cache.storagesByOrigin(ctx, u.client, originUUID)
 	if err != nil {
 		return nil, err
 	}
 	backups := make([]upcloud.Storage, 0)
-	for _, b := range storages.Storages {
-		if originUUID == "" && b.Origin != "" || originUUID != "" && b.Origin == originUUID {
+	for _, b := range storages {
+		if b.Type == upcloud.StorageTypeBackup {
 			backups = append(backups, b)
 		}
 	}
@@ -296,22 +465,72 @@ func (u *UpCloudService) DeleteStorageBackup(ctx context.Context, uuid string) e
 	if s.Type != upcloud.StorageTypeBackup {
 		return fmt.Errorf("unable to delete storage backup '%s' (%s) has invalid type '%s'", s.Title, s.UUID, s.Type)
 	}
-	return u.client.DeleteStorage(ctx, &request.DeleteStorageRequest{UUID: s.UUID})
+	if err := requireStorageIdle(&s.Storage); err != nil {
+		return err
+	}
+	if err := u.client.DeleteStorage(ctx, &request.DeleteStorageRequest{UUID: s.UUID}); err != nil {
+		return err
+	}
+	u.cache.delete(s.UUID)
+	return nil
 }
 
 func (u *UpCloudService) GetStorageBackupByName(ctx context.Context, name string) (*upcloud.Storage, error) {
-	storages, err := u.client.GetStorages(ctx, &request.GetStoragesRequest{Type: upcloud.StorageTypeBackup})
+	storages, err := u.cache.storagesByTitle(ctx, u.client, name)
 	if err != nil {
 		return nil, err
 	}
-	for _, s := range storages.Storages {
-		if s.Title == name {
+	for _, s := range storages {
+		if s.Type == upcloud.StorageTypeBackup {
 			return &s, nil
 		}
 	}
 	return nil, ErrStorageNotFound
 }
 
+// GetAccount returns account of the API credentials.
+func (u *UpCloudService) GetAccount(ctx context.Context) (*upcloud.Account, error) {
+	account, err := u.client.GetAccount(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch account: %w", err)
+	}
+	return account, nil
+}
+
+// GetStorageQuota returns remaining storage quota of the tier in gigabytes.
+// Storage limits are account wide, so quota is calculated using storages from all the zones.
+func (u *UpCloudService) GetStorageQuota(ctx context.Context, tier string) (int, error) {
+	account, err := u.GetAccount(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var limit int
+	switch tier {
+	case upcloud.StorageTierMaxIOPS:
+		limit = account.ResourceLimits.StorageMaxIOPS
+	case upcloud.StorageTierStandard:
+		limit = account.ResourceLimits.StorageSSD
+	case upcloud.StorageTierHDD:
+		limit = account.ResourceLimits.StorageHDD
+	default:
+		return 0, fmt.Errorf("unknown storage tier '%s'", tier)
+	}
+	storages, err := u.cache.storages(ctx, u.client, func(s upcloud.Storage) bool {
+		return s.Tier == tier && s.Type != upcloud.StorageTypeBackup && s.Type != upcloud.StorageTypeCDROM
+	})
+	if err != nil {
+		return 0, err
+	}
+	used := 0
+	for _, s := range storages {
+		used += s.Size
+	}
+	if used > limit {
+		return 0, nil
+	}
+	return limit - used, nil
+}
+
 func (u *UpCloudService) RequireStorageOnline(ctx context.Context, s *upcloud.Storage) error {
 	if s.State != upcloud.StorageStateOnline {
 		if _, err := u.waitForStorageOnline(ctx, s.UUID); err != nil {
@@ -321,21 +540,83 @@ func (u *UpCloudService) RequireStorageOnline(ctx context.Context, s *upcloud.St
 	return nil
 }
 
+// requireStorageIdle returns ErrStorageBusy if storage is in transitional state, e.g. while backup is created, because
+// storage can't be deleted until the operation is finished. Caller is expected to retry later instead of waiting.
+// Storage in error state is regarded as idle so that it can be deleted.
+func requireStorageIdle(s *upcloud.Storage) error {
+	if s.State == upcloud.StorageStateOnline || s.State == upcloud.StorageStateError {
+		return nil
+	}
+	return fmt.Errorf("%w: storage %s is in state %s", ErrStorageBusy, s.UUID, s.State)
+}
+
 func (u *UpCloudService) waitForStorageOnline(ctx context.Context, uuid string) (*upcloud.StorageDetails, error) {
 	ctx, cancel := context.WithTimeout(ctx, storageStateTimeout)
 	defer cancel()
-	return u.client.WaitForStorageState(ctx, &request.WaitForStorageStateRequest{
-		UUID:         uuid,
-		DesiredState: upcloud.StorageStateOnline,
+	defer observeStateWait(metrics.ResourceStorage, time.Now())
+	ctx, span := tracing.Start(ctx, "service.waitForStorageOnline", attribute.String(storageUUIDAttribute, uuid))
+	s, err := pollState(ctx, u.pollInterval, func() (*upcloud.StorageDetails, bool, error) {
+		s, err := u.client.GetStorageDetails(ctx, &request.GetStorageDetailsRequest{UUID: uuid})
+		if err != nil {
+			return nil, false, err
+		}
+		return s, s.State == upcloud.StorageStateOnline, nil
 	})
+	tracing.End(span, err)
+	if err != nil {
+		return s, err
+	}
+	u.cache.upsert(s.Storage)
+	return s, nil
+}
+
+// isNotFoundError checks if API error means that requested resource doesn't exist.
+func isNotFoundError(err error) bool {
+	var svcError *upcloud.Problem
+	return errors.As(err, &svcError) && svcError.Status == http.StatusNotFound
+}
+
+// IsValidUUID checks if the ID is in the canonical UUID format used by UpCloud API.
+func IsValidUUID(id string) bool {
+	_, err := uuid.Parse(id)
+	return err == nil && len(id) == 36
 }
 
 func (u *UpCloudService) waitForServerOnline(ctx context.Context, uuid string) error {
 	ctx, cancel := context.WithTimeout(ctx, serverStateTimeout)
 	defer cancel()
-	_, err := u.client.WaitForServerState(ctx, &request.WaitForServerStateRequest{
-		UUID:         uuid,
-		DesiredState: upcloud.ServerStateStarted,
+	defer observeStateWait(metrics.ResourceServer, time.Now())
+	ctx, span := tracing.Start(ctx, "service.waitForServerOnline", attribute.String(serverUUIDAttribute, uuid))
+	_, err := pollState(ctx, u.pollInterval, func() (*upcloud.ServerDetails, bool, error) {
+		s, err := u.client.GetServerDetails(ctx, &request.GetServerDetailsRequest{UUID: uuid})
+		if err != nil {
+			return nil, false, err
+		}
+		return s, s.State == upcloud.ServerStateStarted, nil
 	})
+	tracing.End(span, err)
 	return err
 }
+
+func observeStateWait(resource string, start time.Time) {
+	metrics.ObserveStateWait(resource, time.Since(start))
+}
+
+// pollState calls check immediately and then once per interval until check reports that desired state is reached.
+// State is polled by the service instead of API client's wait methods, so that each poll goes through the rate limiter.
+func pollState[T any](ctx context.Context, interval time.Duration, check func() (T, bool, error)) (T, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		v, ok, err := check()
+		if err != nil || ok {
+			return v, err
+		}
+		select {
+		case <-ctx.Done():
+			var empty T
+			return empty, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
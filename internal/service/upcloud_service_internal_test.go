@@ -0,0 +1,56 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud"
+	"github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/client"
+	upsvc "github.com/UpCloudLtd/upcloud-go-api/v8/upcloud/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpCloudService_waitForStorageOnline(t *testing.T) {
+	t.Parallel()
+	var calls int
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		state := upcloud.StorageStateMaintenance
+		if calls >= 3 {
+			state = upcloud.StorageStateOnline
+		}
+		fmt.Fprintf(w, `{"storage": {"access": "private", "state": %q, "type": "normal", "uuid": "id1", "title": "vol1", "zone": "fi-hel2"}}`, state)
+	}))
+	defer srv.Close()
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls
+	}
+	api := upsvc.New(client.New("", "", client.WithBaseURL(srv.URL)))
+
+	// polls go through the rate limiter, so the second poll waits for the limiter until context is done
+	u := NewUpCloudService(api, WithRateLimit(1.0/3600, 1))
+	u.pollInterval = time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := u.waitForStorageOnline(ctx, "id1")
+	require.Error(t, err)
+	assert.Equal(t, 1, count())
+
+	u = NewUpCloudService(api)
+	u.pollInterval = time.Millisecond
+	s, err := u.waitForStorageOnline(context.Background(), "id1")
+	require.NoError(t, err)
+	assert.Equal(t, upcloud.StorageStateOnline, s.State)
+	assert.Equal(t, 3, count())
+}
@@ -0,0 +1,26 @@
+// Package topology defines topology segments that describe where volumes are accessible from.
+package topology
+
+const (
+	// ZoneKey is topology key of the UpCloud zone.
+	ZoneKey string = "topology.storage.csi.upcloud.com/zone"
+	// LegacyZoneKey is topology key of the UpCloud zone used by previous driver versions.
+	// It's still reported so that volumes provisioned by previous versions remain accessible.
+	LegacyZoneKey string = "region"
+)
+
+// Segments returns topology segments of the zone.
+func Segments(zone string) map[string]string {
+	return map[string]string{
+		ZoneKey:       zone,
+		LegacyZoneKey: zone,
+	}
+}
+
+// Zone returns zone from the topology segments or empty string if zone is not set.
+func Zone(segments map[string]string) string {
+	if zone, ok := segments[ZoneKey]; ok {
+		return zone
+	}
+	return segments[LegacyZoneKey]
+}
@@ -0,0 +1,101 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.20.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName string = "github.com/UpCloudLtd/upcloud-csi"
+
+// propagator propagates trace context using W3C trace context format, e.g. from controller to node using publish context.
+var propagator = propagation.TraceContext{}
+
+// Config defines how spans are exported.
+type Config struct {
+	// Endpoint is OTLP gRPC endpoint, e.g. otel-collector:4317. Tracing is disabled if endpoint is empty.
+	Endpoint string
+	// Insecure disables TLS of the exporter connection.
+	Insecure bool
+	// SampleRatio is the ratio of traces that are sampled, traces continued from parent span follow parent's decision.
+	SampleRatio float64
+	// ServiceName and ServiceVersion identify the driver in traces.
+	ServiceName    string
+	ServiceVersion string
+}
+
+// Setup configures global tracer provider that exports spans using OTLP. Returned function flushes pending spans
+// and stops the exporter. If endpoint is not set, tracing is disabled and spans are not recorded.
+func Setup(ctx context.Context, c Config) (func(context.Context) error, error) {
+	if c.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(c.Endpoint)}
+	if c.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(c.ServiceName),
+		semconv.ServiceVersion(c.ServiceVersion),
+	))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// Start starts a new span which is child of the span in the context, if there is one.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records the error, if any, and ends the span.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TraceID returns ID of the trace in the context or empty string if context doesn't have a recorded span.
+func TraceID(ctx context.Context) string {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		return sc.TraceID().String()
+	}
+	return ""
+}
+
+// InjectPublishContext adds trace context to the publish context, so that node operations can be traced as part of
+// the same trace as the controller publish.
+func InjectPublishContext(ctx context.Context, publishContext map[string]string) map[string]string {
+	propagator.Inject(ctx, propagation.MapCarrier(publishContext))
+	return publishContext
+}
+
+// ExtractPublishContext returns context with remote span context read from the publish context.
+func ExtractPublishContext(ctx context.Context, publishContext map[string]string) context.Context {
+	if len(publishContext) == 0 {
+		return ctx
+	}
+	return propagator.Extract(ctx, propagation.MapCarrier(publishContext))
+}
@@ -0,0 +1,56 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+//nolint:paralleltest // test sets global tracer provider
+func TestPublishContextPropagation(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	// controller publish
+	ctx, publish := Start(context.Background(), "/csi.v1.Controller/ControllerPublishVolume")
+	publishContext := InjectPublishContext(ctx, map[string]string{"ctx_correlation_id": "c0ffee"})
+	End(publish, nil)
+	assert.Equal(t, "c0ffee", publishContext["ctx_correlation_id"])
+	assert.Contains(t, publishContext, "traceparent")
+
+	// node stage continues the same trace
+	ctx = ExtractPublishContext(context.Background(), publishContext)
+	ctx, stage := Start(ctx, "/csi.v1.Node/NodeStageVolume")
+	_, mkfs := Start(ctx, "exec mkfs.ext4")
+	End(mkfs, errors.New("exit status 1"))
+	End(stage, nil)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 3)
+	traceID := spans[0].SpanContext().TraceID()
+	assert.Equal(t, traceID.String(), TraceID(ctx))
+	for _, s := range spans {
+		assert.Equal(t, traceID, s.SpanContext().TraceID(), s.Name())
+	}
+	assert.Equal(t, spans[0].SpanContext().SpanID(), spans[2].Parent().SpanID())
+	assert.Equal(t, spans[2].SpanContext().SpanID(), spans[1].Parent().SpanID())
+	assert.Equal(t, codes.Error, spans[1].Status().Code)
+	assert.Equal(t, codes.Unset, spans[2].Status().Code)
+
+	assert.Equal(t, context.Background(), ExtractPublishContext(context.Background(), nil))
+}
+
+func TestSetup_Disabled(t *testing.T) {
+	t.Parallel()
+
+	shutdown, err := Setup(context.Background(), Config{})
+	require.NoError(t, err)
+	require.NoError(t, shutdown(context.Background()))
+}
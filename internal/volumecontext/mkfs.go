@@ -0,0 +1,152 @@
+package volumecontext
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MkfsOptionsKey is volume context key of additional mkfs command line options, e.g. "-E lazy_itable_init=0".
+	MkfsOptionsKey string = "mkfsOptions"
+	// BlockSizeKey is volume context key of filesystem block size in bytes.
+	BlockSizeKey string = "blockSize"
+	// FsLabelKey is volume context key of filesystem label.
+	FsLabelKey string = "fsLabel"
+	// InodeRatioKey is volume context key of ext4 bytes-per-inode ratio.
+	InodeRatioKey string = "ext4.inodeRatio"
+	// ReflinkKey is volume context key of XFS reflink support, either "true" or "false".
+	ReflinkKey string = "xfs.reflink"
+
+	fsTypeExt3 string = "ext3"
+	fsTypeExt4 string = "ext4"
+	fsTypeXFS  string = "xfs"
+)
+
+// MkfsKeys are volume context keys that control how filesystem is created.
+var MkfsKeys = []string{MkfsOptionsKey, BlockSizeKey, FsLabelKey, InodeRatioKey, ReflinkKey} //nolint: gochecknoglobals // readonly variable
+
+// mkfsFilesystem describes which options are allowed when creating filesystem of the type.
+type mkfsFilesystem struct {
+	// keys are volume context keys supported by the filesystem.
+	keys []string
+	// options are allowed mkfsOptions flags, flag is mapped to true if it requires a value.
+	options map[string]bool
+	// maxLabelLength is the maximum length of the filesystem label.
+	maxLabelLength int
+}
+
+var mkfsFilesystems = map[string]mkfsFilesystem{ //nolint: gochecknoglobals // readonly variable
+	fsTypeExt3: {
+		keys:           []string{MkfsOptionsKey, BlockSizeKey, FsLabelKey},
+		options:        map[string]bool{"-E": true, "-I": true, "-J": true, "-m": true, "-N": true, "-O": true, "-T": true},
+		maxLabelLength: 16,
+	},
+	fsTypeExt4: {
+		keys:           []string{MkfsOptionsKey, BlockSizeKey, FsLabelKey, InodeRatioKey},
+		options:        map[string]bool{"-E": true, "-I": true, "-J": true, "-m": true, "-N": true, "-O": true, "-T": true},
+		maxLabelLength: 16,
+	},
+	fsTypeXFS: {
+		keys:           []string{MkfsOptionsKey, BlockSizeKey, FsLabelKey, ReflinkKey},
+		options:        map[string]bool{"-d": true, "-i": true, "-l": true, "-m": true, "-n": true, "-s": true, "-K": false},
+		maxLabelLength: 12,
+	},
+}
+
+var (
+	mkfsOptionValueRe = regexp.MustCompile(`^[A-Za-z0-9=,._:^+]+$`)
+	fsLabelRe         = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+)
+
+// MkfsArgs validates mkfs related keys of the volume context and returns arguments passed to mkfs command
+// when filesystem of the given type is created. Empty fsType means the default ext4 filesystem.
+func MkfsArgs(fsType string, volumeContext map[string]string) ([]string, error) {
+	if fsType == "" {
+		fsType = fsTypeExt4
+	}
+	fsType = strings.ToLower(fsType)
+	fs, ok := mkfsFilesystems[fsType]
+	for _, k := range MkfsKeys {
+		if _, set := volumeContext[k]; !set {
+			continue
+		}
+		if !ok || !slices.Contains(fs.keys, k) {
+			return nil, fmt.Errorf("parameter '%s' is not supported with filesystem type '%s'", k, fsType)
+		}
+	}
+	args := make([]string, 0)
+	if !ok {
+		return args, nil
+	}
+	if v, ok := volumeContext[BlockSizeKey]; ok {
+		if v != "1024" && v != "2048" && v != "4096" {
+			return nil, fmt.Errorf("parameter '%s' value '%s' is not supported, supported values are 1024, 2048 and 4096", BlockSizeKey, v)
+		}
+		if fsType == fsTypeXFS {
+			args = append(args, "-b", "size="+v)
+		} else {
+			args = append(args, "-b", v)
+		}
+	}
+	if v, ok := volumeContext[InodeRatioKey]; ok {
+		ratio, err := strconv.Atoi(v)
+		if err != nil || ratio < 1024 || ratio > 67108864 {
+			return nil, fmt.Errorf("parameter '%s' value '%s' needs to be number of bytes between 1024 and 67108864", InodeRatioKey, v)
+		}
+		args = append(args, "-i", v)
+	}
+	if v, ok := volumeContext[ReflinkKey]; ok {
+		reflink, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("parameter '%s' value '%s' needs to be either true or false", ReflinkKey, v)
+		}
+		args = append(args, "-m", fmt.Sprintf("reflink=%d", boolToInt(reflink)))
+	}
+	if v, ok := volumeContext[FsLabelKey]; ok {
+		if !fsLabelRe.MatchString(v) || len(v) > fs.maxLabelLength {
+			return nil, fmt.Errorf("parameter '%s' value '%s' needs to be at most %d letters, digits, '.', '_' or '-'", FsLabelKey, v, fs.maxLabelLength)
+		}
+		args = append(args, "-L", v)
+	}
+	if v, ok := volumeContext[MkfsOptionsKey]; ok {
+		options, err := parseMkfsOptions(fsType, fs, v)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, options...)
+	}
+	return args, nil
+}
+
+// parseMkfsOptions splits options by whitespace and checks that each option is in the allow-list of the filesystem.
+func parseMkfsOptions(fsType string, fs mkfsFilesystem, options string) ([]string, error) {
+	fields := strings.Fields(options)
+	args := make([]string, 0, len(fields))
+	for i := 0; i < len(fields); i++ {
+		flag := fields[i]
+		requiresValue, ok := fs.options[flag]
+		if !ok {
+			return nil, fmt.Errorf("parameter '%s' option '%s' is not supported with filesystem type '%s'", MkfsOptionsKey, flag, fsType)
+		}
+		args = append(args, flag)
+		if !requiresValue {
+			continue
+		}
+		if i+1 >= len(fields) || !mkfsOptionValueRe.MatchString(fields[i+1]) {
+			return nil, fmt.Errorf("parameter '%s' option '%s' requires a valid value", MkfsOptionsKey, flag)
+		}
+		i++
+		args = append(args, fields[i])
+	}
+	return args, nil
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,116 @@
+package volumecontext
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMkfsArgs(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		fsType        string
+		volumeContext map[string]string
+		want          []string
+		wantErr       bool
+	}{
+		{
+			name:          "no options",
+			fsType:        "ext4",
+			volumeContext: map[string]string{EncryptionKey: EncryptionLUKS},
+			want:          []string{},
+		},
+		{
+			name:   "ext4 is the default",
+			fsType: "",
+			volumeContext: map[string]string{
+				BlockSizeKey:   "4096",
+				InodeRatioKey:  "65536",
+				FsLabelKey:     "pgdata",
+				MkfsOptionsKey: "-E lazy_itable_init=0,lazy_journal_init=0  -O ^metadata_csum -m 1",
+			},
+			want: []string{"-b", "4096", "-i", "65536", "-L", "pgdata", "-E", "lazy_itable_init=0,lazy_journal_init=0", "-O", "^metadata_csum", "-m", "1"},
+		},
+		{
+			name:   "xfs",
+			fsType: "XFS",
+			volumeContext: map[string]string{
+				BlockSizeKey:   "2048",
+				ReflinkKey:     "false",
+				FsLabelKey:     "es-data",
+				MkfsOptionsKey: "-K -i maxpct=50",
+			},
+			want: []string{"-b", "size=2048", "-m", "reflink=0", "-L", "es-data", "-K", "-i", "maxpct=50"},
+		},
+		{
+			name:          "ext4 parameter with xfs",
+			fsType:        "xfs",
+			volumeContext: map[string]string{InodeRatioKey: "16384"},
+			wantErr:       true,
+		},
+		{
+			name:          "xfs parameter with ext3",
+			fsType:        "ext3",
+			volumeContext: map[string]string{ReflinkKey: "true"},
+			wantErr:       true,
+		},
+		{
+			name:          "unsupported filesystem",
+			fsType:        "btrfs",
+			volumeContext: map[string]string{BlockSizeKey: "4096"},
+			wantErr:       true,
+		},
+		{
+			name:          "invalid block size",
+			fsType:        "ext4",
+			volumeContext: map[string]string{BlockSizeKey: "8192"},
+			wantErr:       true,
+		},
+		{
+			name:          "invalid inode ratio",
+			fsType:        "ext4",
+			volumeContext: map[string]string{InodeRatioKey: "512"},
+			wantErr:       true,
+		},
+		{
+			name:          "too long label",
+			fsType:        "xfs",
+			volumeContext: map[string]string{FsLabelKey: "elasticsearch"},
+			wantErr:       true,
+		},
+		{
+			name:          "option not in allow-list",
+			fsType:        "ext4",
+			volumeContext: map[string]string{MkfsOptionsKey: "-F"},
+			wantErr:       true,
+		},
+		{
+			name:          "option without value",
+			fsType:        "ext4",
+			volumeContext: map[string]string{MkfsOptionsKey: "-E"},
+			wantErr:       true,
+		},
+		{
+			name:          "option value is another option",
+			fsType:        "xfs",
+			volumeContext: map[string]string{MkfsOptionsKey: "-d -f"},
+			wantErr:       true,
+		},
+	}
+	for _, testCase := range tests {
+		tt := testCase
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := MkfsArgs(tt.fsType, tt.volumeContext)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
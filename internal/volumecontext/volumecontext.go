@@ -0,0 +1,62 @@
+// Package volumecontext defines volume context keys that controller uses to pass volume properties to the node.
+package volumecontext
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	// EncryptionKey is volume context key of the node-side encryption mode.
+	EncryptionKey string = "encryption"
+	// EncryptionLUKS means that volume partition is encrypted by the node using LUKS.
+	EncryptionLUKS string = "luks"
+	// ContentSourceKey is volume context key of the type of the data source the volume was created from.
+	ContentSourceKey string = "contentSource"
+	// ContentSourceSnapshot means that volume was restored from a snapshot.
+	ContentSourceSnapshot string = "snapshot"
+	// ContentSourceVolume means that volume was cloned from another volume.
+	ContentSourceVolume string = "volume"
+	// FsCheckKey is volume context key that enables filesystem check before the volume is mounted, either "true" or "false".
+	FsCheckKey string = "fsCheck"
+	// StorageUUIDKey is publish context key of the UUID of the storage attached to the node. Storage UUID differs from
+	// the volume ID if the storage created with the volume has been replaced, e.g. to change the storage tier.
+	StorageUUIDKey string = "storageUUID"
+)
+
+// LUKS returns true if volume is encrypted by the node using LUKS.
+func LUKS(volumeContext map[string]string) bool {
+	return volumeContext[EncryptionKey] == EncryptionLUKS
+}
+
+// FromContentSource returns true if volume was created as a copy of a snapshot or another volume.
+func FromContentSource(volumeContext map[string]string) bool {
+	switch volumeContext[ContentSourceKey] {
+	case ContentSourceSnapshot, ContentSourceVolume:
+		return true
+	default:
+		return false
+	}
+}
+
+// StorageUUID returns UUID of the storage attached to the node. Volume ID is the storage UUID if publish context
+// doesn't contain the storage UUID, e.g. when volume was published before storage UUID was added to the publish context.
+func StorageUUID(volumeID string, publishContext map[string]string) string {
+	if uuid := publishContext[StorageUUIDKey]; uuid != "" {
+		return uuid
+	}
+	return volumeID
+}
+
+// FsCheck returns true if filesystem needs to be checked before the volume is mounted.
+func FsCheck(volumeContext map[string]string) (bool, error) {
+	v, ok := volumeContext[FsCheckKey]
+	if !ok {
+		return false, nil
+	}
+	check, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("parameter '%s' value '%s' needs to be either true or false", FsCheckKey, v)
+	}
+	return check, nil
+}
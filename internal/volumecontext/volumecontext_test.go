@@ -0,0 +1,15 @@
+package volumecontext
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorageUUID(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "vol-uuid", StorageUUID("vol-uuid", nil))
+	assert.Equal(t, "vol-uuid", StorageUUID("vol-uuid", map[string]string{StorageUUIDKey: ""}))
+	assert.Equal(t, "copy-uuid", StorageUUID("vol-uuid", map[string]string{StorageUUIDKey: "copy-uuid"}))
+}